@@ -0,0 +1,13 @@
+// Command nix-bazel resolves, fetches and inspects Nix packages for Bazel.
+// Run "nix-bazel help" for its commands.
+package main
+
+import (
+	"os"
+
+	"nix-bazel-gen/pkg/cli"
+)
+
+func main() {
+	os.Exit(cli.Main("nix-bazel", os.Args[1:]))
+}
@@ -2,4 +2,8 @@ module nix-bazel-gen
 
 go 1.24.1
 
-require zombiezen.com/go/nix v0.0.0-20250514174927-d97ab08b45de
+require (
+	github.com/andybalholm/brotli v1.2.0
+	github.com/ulikunitz/xz v0.5.15
+	zombiezen.com/go/nix v0.0.0-20250514174927-d97ab08b45de
+)
@@ -0,0 +1,93 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"nix-bazel-gen/pkg/nixbazel"
+)
+
+func runCheck(g *Globals, fs *flag.FlagSet, args []string) error {
+	lockFile := fs.String("lockfile", "nix_deps.lock.json", "Lockfile to check")
+	all := fs.Bool("all", false, "Check every package, not only glibc, libgcc and libstdc++")
+	fix := fs.Bool("fix", false, "Re-resolve the affected repositories from one Hydra evaluation")
+	configFile := fs.String("config", "packages.json", "Config file for re-resolving (with --fix)")
+	channel := fs.String("channel", "", "Nix channel (Hydra jobset) to re-resolve from (with --fix)")
+	// As for resolve, so --fix resolves the same way the lockfile was made
+	manifests := fs.Bool("manifests", false, "Record file manifests of re-resolved store paths next to the lockfile (with --fix)")
+	localDB := fs.String("local-db", "", "Resolve store paths from this Nix database when it has them (with --fix)")
+	var packages stringsFlag
+	fs.Var(&packages, "package", "Package to check, by name and output (e.g. glibc, gcc-lib); can be repeated")
+	var substituters stringsFlag
+	fs.Var(&substituters, "substituter", "Binary cache checked for paths from --local-db without a URL; can be repeated (with --fix)")
+	if err := g.parse(fs, args); err != nil {
+		return err
+	}
+
+	lock, err := nixbazel.LoadLockfile(*lockFile)
+	if err != nil {
+		return err
+	}
+	inconsistencies := nixbazel.CheckConsistency(lock, packages, *all)
+	if *fix && len(inconsistencies) > 0 {
+		repos := make(map[string]bool)
+		for _, i := range inconsistencies {
+			for _, name := range i.Repositories() {
+				repos[name] = true
+			}
+		}
+		var names []string
+		for name := range repos {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(g.progress, "Re-resolving %s from one Hydra evaluation...\n", strings.Join(names, ", "))
+		opts := nixbazel.ResolveOptions{
+			ConfigFile:   *configFile,
+			LockFile:     *lockFile,
+			Channel:      *channel,
+			CacheURL:     g.CacheURL,
+			Manifests:    *manifests,
+			Substituters: substituters,
+			Reresolve:    names,
+			SingleEval:   true,
+			Progress:     g.progress,
+		}
+		if *localDB != "" {
+			opts.LocalDB = &nixbazel.LocalDB{Path: *localDB}
+		}
+		if err := nixbazel.RunResolve(opts); err != nil {
+			return err
+		}
+		if lock, err = nixbazel.LoadLockfile(*lockFile); err != nil {
+			return err
+		}
+		inconsistencies = nixbazel.CheckConsistency(lock, packages, *all)
+	}
+
+	if inconsistencies == nil {
+		inconsistencies = []nixbazel.Inconsistency{}
+	}
+	err = g.emit(inconsistencies, func(w io.Writer) {
+		for _, i := range inconsistencies {
+			fmt.Fprintf(w, "%s has %d store paths:\n", i.Package, len(i.Variants))
+			for _, v := range i.Variants {
+				fmt.Fprintf(w, "  %s: %s\n", path.Base(v.StorePath), strings.Join(v.Repositories, ", "))
+			}
+		}
+		if len(inconsistencies) == 0 {
+			fmt.Fprintln(w, "All repositories share the same store paths")
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if len(inconsistencies) > 0 {
+		return fmt.Errorf("%d packages differ between repositories", len(inconsistencies))
+	}
+	return nil
+}
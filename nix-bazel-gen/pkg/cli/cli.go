@@ -0,0 +1,228 @@
+// Package cli implements the nix-bazel command. The older nix-bazel-*
+// binaries are aliases for its subcommands.
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"nix-bazel-gen/pkg/nixbazel"
+)
+
+const defaultCacheURL = "https://cache.nixos.org"
+
+// errUsage is returned for bad command lines, after the flag package has
+// printed the problem and the usage.
+var errUsage = errors.New("usage")
+
+// Globals are the flags shared by every subcommand. They can be given
+// before or after the subcommand name.
+type Globals struct {
+	CacheURL string
+	Jobs     int
+	Quiet    bool
+	Verbose  bool
+	Format   string // "text" or "json"
+
+	out      io.Writer       // Command results
+	progress io.Writer       // Progress messages; io.Discard with --quiet
+	set      map[string]bool // Flags given on the command line
+}
+
+func newGlobals() *Globals {
+	return &Globals{
+		CacheURL: defaultCacheURL,
+		Jobs:     runtime.NumCPU(),
+		Format:   "text",
+		out:      os.Stdout,
+		progress: os.Stdout,
+		set:      make(map[string]bool),
+	}
+}
+
+// register adds the global flags to fs, with the values parsed so far as
+// defaults so a subcommand's flag set does not reset them.
+func (g *Globals) register(fs *flag.FlagSet) {
+	fs.StringVar(&g.CacheURL, "cache", g.CacheURL, "Binary cache URL (http(s):// or file://)")
+	fs.IntVar(&g.Jobs, "jobs", g.Jobs, "Number of parallel jobs")
+	fs.BoolVar(&g.Quiet, "q", g.Quiet, "Only print results, not progress")
+	fs.BoolVar(&g.Quiet, "quiet", g.Quiet, "Only print results, not progress")
+	fs.BoolVar(&g.Verbose, "v", g.Verbose, "Print the settings used and how long the command took")
+	fs.StringVar(&g.Format, "format", g.Format, "Output format of results: text or json")
+}
+
+// parse parses a subcommand's flags and applies the global ones.
+func (g *Globals) parse(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	fs.Visit(func(f *flag.Flag) { g.set[f.Name] = true })
+	if g.Format != "text" && g.Format != "json" {
+		fmt.Fprintf(os.Stderr, "Error: unknown --format %q (expected text or json)\n", g.Format)
+		return errUsage
+	}
+	if g.Quiet {
+		g.progress = io.Discard
+	}
+	if g.Verbose {
+		fmt.Fprintf(os.Stderr, "cache: %s, jobs: %d, format: %s\n", g.CacheURL, g.Jobs, g.Format)
+	}
+	return nil
+}
+
+// newFetcher returns a fetcher for --cache that prints progress unless
+// --quiet is given.
+func (g *Globals) newFetcher(outDir string) *nixbazel.Fetcher {
+	fetcher := nixbazel.NewFetcher(g.CacheURL, outDir)
+	fetcher.SetProgress(g.progress)
+	return fetcher
+}
+
+// emit prints a command's result as JSON or, with --format text, with text.
+func (g *Globals) emit(value any, text func(w io.Writer)) error {
+	if g.Format == "json" {
+		enc := json.NewEncoder(g.out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(value)
+	}
+	text(g.out)
+	return nil
+}
+
+// command is a nix-bazel subcommand. run defines its flags on fs, parses
+// args with g.parse and runs it.
+type command struct {
+	name    string
+	summary string
+	run     func(g *Globals, fs *flag.FlagSet, args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"resolve", "Resolve packages.json into a lockfile", runResolve},
+		{"fetch", "Unpack NAR archives, or every package of a lockfile", runFetch},
+		{"generate", "Generate BUILD files from a lockfile", runGenerate},
+		{"verify", "Check unpacked store paths against the lockfile's narHash", runVerify},
+		{"diff", "Compare two lockfiles", runDiff},
+		{"why", "Show why a store path is in a repository's closure", runWhy},
+		{"size", "Report the closure size of each repository", runSize},
+		{"graph", "Export the dependency graph as DOT, GraphML or JSON", runGraph},
+		{"query", "List the lockfile's packages matching a selector", runQuery},
+		{"check", "Check that repositories share one glibc, libgcc and libstdc++", runCheck},
+		{"sbom", "Write CycloneDX or SPDX SBOMs of repository closures", runSBOM},
+		{"mirror", "Copy every package of a lockfile to another binary cache", runMirror},
+		{"pack", "Serialise a file or directory into a NAR and print its hashes", runPack},
+		{"upload", "Publish a file or directory to a binary cache as a new store path", runUpload},
+	}
+}
+
+func lookup(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+func usage(prog string, fs *flag.FlagSet) {
+	w := fs.Output()
+	fmt.Fprintf(w, "Usage: %s [global flags] <command> [flags]\n\n", prog)
+	fmt.Fprintln(w, "Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-9s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(w, "\nGlobal flags:")
+	fs.PrintDefaults()
+}
+
+// Main runs "prog <command> [flags]" and returns the exit code.
+func Main(prog string, args []string) int {
+	return mainWith(newGlobals(), prog, args)
+}
+
+func mainWith(g *Globals, prog string, args []string) int {
+	fs := flag.NewFlagSet(prog, flag.ContinueOnError)
+	g.register(fs)
+	fs.Usage = func() { usage(prog, fs) }
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	fs.Visit(func(f *flag.Flag) { g.set[f.Name] = true })
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	name := fs.Arg(0)
+	if name == "help" {
+		fs.SetOutput(os.Stdout)
+		usage(prog, fs)
+		return 0
+	}
+	cmd := lookup(name)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "Error: unknown command %q\n", name)
+		fs.Usage()
+		return 2
+	}
+	return run(g, prog+" "+name, cmd, fs.Args()[1:])
+}
+
+// Alias runs command as the old single-purpose binary prog, e.g.
+// nix-bazel-resolve for "nix-bazel resolve".
+func Alias(prog, command string, args []string) int {
+	cmd := lookup(command)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "Error: unknown command %q\n", command)
+		return 2
+	}
+	return run(newGlobals(), prog, cmd, args)
+}
+
+func run(g *Globals, name string, cmd *command, args []string) int {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	g.register(fs)
+	start := time.Now()
+	err := cmd.run(g, fs, args)
+	if g.Verbose {
+		fmt.Fprintf(os.Stderr, "%s finished in %v\n", name, time.Since(start).Round(time.Millisecond))
+	}
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, flag.ErrHelp):
+		return 0
+	case errors.Is(err, errUsage):
+		return 2
+	default:
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+}
+
+// stringsFlag collects every occurrence of a repeated flag.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
@@ -0,0 +1,214 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ulikunitz/xz"
+
+	"nix-bazel-gen/pkg/nixbazel"
+)
+
+const (
+	testHelloPath = "/nix/store/b1ayn0ln6n8bm2spz441csqc2ss66az3-hello-2.12.2"
+	testNarHash   = "0000000000000000000000000000000000000000000000000000000000000000"
+)
+
+func writeLockfile(t *testing.T, dir, name, repos string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	data := `{"repositories": {` + repos + `}, "packages": {"` + testHelloPath + `": {"narHash": "` + testNarHash + `", "narSize": 10}}}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMainDiff(t *testing.T) {
+	dir := t.TempDir()
+	oldLock := writeLockfile(t, dir, "old.json", ``)
+	newLock := writeLockfile(t, dir, "new.json", `"hello": {"storePath": "`+testHelloPath+`"}`)
+
+	// Global flags go before or after the command
+	for _, args := range [][]string{
+		{"--format", "json", "diff", oldLock, newLock},
+		{"diff", "--format=json", oldLock, newLock},
+	} {
+		g := newGlobals()
+		var out bytes.Buffer
+		g.out = &out
+		if code := mainWith(g, "nix-bazel", args); code != 0 {
+			t.Fatalf("mainWith(%q) = %d, expected 0", args, code)
+		}
+		var diff struct {
+			Repositories []struct{ Name, New string }
+		}
+		if err := json.Unmarshal(out.Bytes(), &diff); err != nil {
+			t.Fatalf("mainWith(%q) printed %q: %v", args, out.String(), err)
+		}
+		if len(diff.Repositories) != 1 || diff.Repositories[0].New != testHelloPath {
+			t.Errorf("mainWith(%q) printed %q, expected hello to be added", args, out.String())
+		}
+	}
+
+	g := newGlobals()
+	var out bytes.Buffer
+	g.out = &out
+	if code := mainWith(g, "nix-bazel", []string{"diff", oldLock, newLock}); code != 0 {
+		t.Fatalf("diff exited with %d", code)
+	}
+	if !strings.HasPrefix(out.String(), "+ hello: "+testHelloPath+"\n") {
+		t.Errorf("text diff = %q, expected hello to be added", out.String())
+	}
+}
+
+func TestMainErrors(t *testing.T) {
+	tests := []struct {
+		args     []string
+		expected int
+	}{
+		{[]string{}, 2},
+		{[]string{"frobnicate"}, 2},
+		{[]string{"--format", "xml", "diff", "a", "b"}, 2},
+		{[]string{"diff", "--no-such-flag"}, 2},
+		{[]string{"diff", "only-one"}, 1},
+		{[]string{"help"}, 0},
+	}
+	stderr := os.Stderr
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+	os.Stderr = devNull
+	defer func() { os.Stderr = stderr }()
+
+	for _, test := range tests {
+		g := newGlobals()
+		g.out = &bytes.Buffer{}
+		if code := mainWith(g, "nix-bazel", test.args); code != test.expected {
+			t.Errorf("mainWith(%q) = %d, expected %d", test.args, code, test.expected)
+		}
+	}
+}
+
+// check --fix takes the resolve options that shape a lockfile, so fixing it
+// resolves the same way; a consistent lockfile needs no re-resolve.
+func TestCheckFixResolveFlags(t *testing.T) {
+	lock := writeLockfile(t, t.TempDir(), "nix_deps.lock.json", `"hello": {"storePath": "`+testHelloPath+`"}`)
+	args := []string{"check", "--lockfile", lock, "--fix", "--manifests", "--local-db", "/nonexistent/db.sqlite", "--substituter", "http://127.0.0.1:0"}
+	g := newGlobals()
+	g.out = &bytes.Buffer{}
+	if code := mainWith(g, "nix-bazel", args); code != 0 {
+		t.Errorf("mainWith(%q) = %d, expected 0", args, code)
+	}
+}
+
+// writeArchive packs dir into an xz-compressed NAR, as fetch expects.
+func writeArchive(t *testing.T, dir, archive string) {
+	t.Helper()
+	var nar bytes.Buffer
+	if _, err := nixbazel.PackNar(&nar, dir, "none"); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	w, err := xz.NewWriter(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(nar.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(archive, out.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// --dedup only links read-only files, so it must make the trees canonical
+// itself rather than silently do nothing.
+func TestFetchDedupImpliesCanonical(t *testing.T) {
+	dir := t.TempDir()
+	var args []string
+	for _, name := range []string{"aaa-one", "bbb-two"} {
+		src := filepath.Join(dir, name)
+		if err := os.MkdirAll(src, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(src, "COPYING"), []byte("same license text"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		archive := filepath.Join(dir, name+".nar.xz")
+		writeArchive(t, src, archive)
+		args = append(args, "--archive", archive, "--store-path", "/nix/store/"+name)
+	}
+
+	out := filepath.Join(dir, "out")
+	// Canonical directories are read-only, which TempDir cannot remove
+	t.Cleanup(func() {
+		filepath.WalkDir(out, func(path string, d fs.DirEntry, err error) error {
+			if err == nil && d.IsDir() {
+				os.Chmod(path, 0755)
+			}
+			return nil
+		})
+	})
+	g := newGlobals()
+	g.out = &bytes.Buffer{}
+	if code := mainWith(g, "nix-bazel", append([]string{"fetch", "--out", out, "--dedup"}, args...)); code != 0 {
+		t.Fatalf("fetch --dedup exited with %d", code)
+	}
+	one, err := os.Stat(filepath.Join(out, "aaa-one/COPYING"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	two, err := os.Stat(filepath.Join(out, "bbb-two/COPYING"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(one, two) {
+		t.Errorf("COPYING files were not linked by fetch --dedup")
+	}
+	if one.Mode().Perm() != 0444 {
+		t.Errorf("COPYING mode = %v, expected 0444", one.Mode().Perm())
+	}
+}
+
+// --quiet drops progress through the fetcher rather than replacing the
+// process-wide os.Stdout.
+func TestFetchQuiet(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "aaa-one")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(dir, "aaa-one.nar.xz")
+	writeArchive(t, src, archive)
+	stdout := os.Stdout
+
+	for _, quiet := range []bool{false, true} {
+		args := []string{"fetch", "--out", filepath.Join(dir, "out"), "--archive", archive, "--store-path", "/nix/store/aaa-one"}
+		if quiet {
+			args = append([]string{"--quiet"}, args...)
+		}
+		g := newGlobals()
+		var out, progress bytes.Buffer
+		g.out, g.progress = &out, &progress
+		if code := mainWith(g, "nix-bazel", args); code != 0 {
+			t.Fatalf("mainWith(%q) = %d, expected 0", args, code)
+		}
+		if os.Stdout != stdout {
+			t.Errorf("mainWith(%q) replaced os.Stdout", args)
+		}
+		if got := strings.Contains(progress.String(), "Unpacking "); got == quiet {
+			t.Errorf("mainWith(%q) printed progress %q", args, progress.String())
+		}
+	}
+}
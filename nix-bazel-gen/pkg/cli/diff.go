@@ -0,0 +1,52 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+
+	"nix-bazel-gen/pkg/nixbazel"
+)
+
+func runDiff(g *Globals, fs *flag.FlagSet, args []string) error {
+	if err := g.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errors.New("diff needs an old and a new lockfile")
+	}
+	oldLock, err := nixbazel.LoadLockfile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	newLock, err := nixbazel.LoadLockfile(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	diff := nixbazel.DiffLockfiles(oldLock, newLock)
+	return g.emit(diff, func(w io.Writer) {
+		for _, repo := range diff.Repositories {
+			switch {
+			case repo.Old == "":
+				fmt.Fprintf(w, "+ %s: %s\n", repo.Name, repo.New)
+			case repo.New == "":
+				fmt.Fprintf(w, "- %s: %s\n", repo.Name, repo.Old)
+			default:
+				fmt.Fprintf(w, "~ %s: %s -> %s\n", repo.Name, repo.Old, repo.New)
+			}
+		}
+		for _, storePath := range diff.Added {
+			fmt.Fprintf(w, "+ %s\n", storePath)
+		}
+		for _, storePath := range diff.Removed {
+			fmt.Fprintf(w, "- %s\n", storePath)
+		}
+		for _, storePath := range diff.Changed {
+			fmt.Fprintf(w, "~ %s\n", storePath)
+		}
+		fmt.Fprintf(w, "%d repositories changed; packages: %d added, %d removed, %d changed; NAR size %+d bytes, download size %+d bytes\n",
+			len(diff.Repositories), len(diff.Added), len(diff.Removed), len(diff.Changed), diff.NarSizeDelta, diff.FileSizeDelta)
+	})
+}
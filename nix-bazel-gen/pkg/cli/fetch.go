@@ -0,0 +1,139 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"nix-bazel-gen/pkg/nixbazel"
+)
+
+func runFetch(g *Globals, fs *flag.FlagSet, args []string) error {
+	outDir := fs.String("out", ".", "Output directory")
+	lockFile := fs.String("lockfile", "", "Download and unpack every package of this lockfile from --cache and generate build files, instead of unpacking archives")
+	var archives, storePaths stringsFlag
+	fs.Var(&archives, "archive", "Path to NAR archive; can be repeated, paired with --store-path in order")
+	fs.Var(&storePaths, "store-path", "Store path (e.g. /nix/store/...); can be repeated")
+	unpackManifest := fs.String("unpack-manifest", "", "JSON file listing {\"archive\", \"storePath\", \"references\"} entries to unpack")
+	canonical := fs.Bool("canonical", false, "Make unpacked trees read-only (0444/0555) with mtime 1, like the Nix store")
+	dedup := fs.Bool("dedup", false, "Hardlink identical files across the unpacked packages; implies --canonical, which makes them read-only")
+	localStore := fs.Bool("local-store", false, "Copy store paths from a local Nix store when present instead of unpacking archives")
+	localStoreDir := fs.String("local-store-dir", "/nix/store", "Local Nix store directory (with --local-store)")
+	localStoreSymlink := fs.Bool("local-store-symlink", false, "Symlink local store paths instead of copying them; they are not patched or canonicalised (with --local-store)")
+	verifyLocal := fs.Bool("verify-local", false, "Check the NarHash of local store paths (from --unpack-manifest \"narHash\") before using them")
+	relativeSymlinks := fs.Bool("relative-symlinks", false, "Rewrite /nix/store symlinks in --out to relative ones after unpacking")
+	var extract stringsFlag
+	fs.Var(&extract, "extract", "Only extract this path (relative to the store path) into --out; can be repeated")
+	copyDir := fs.String("copy", "", "Copy this directory (e.g. a subdirectory of a --relative-symlinks tree) into --out, following symlinks, instead of unpacking")
+	patch := fs.Bool("patch", false, "Patch unpacked ELF files with --interpreter and --rpath")
+	interpreter := fs.String("interpreter", "", "ELF interpreter to set when patching")
+	rpath := fs.String("rpath", "", "RUNPATH to set when patching")
+	relocate := fs.Bool("relocate", false, "Rewrite ELF interpreters and RUNPATHs to load from --out instead of /nix/store")
+	interpreterPrefix := fs.String("interpreter-prefix", "", "Directory replacing /nix/store in relocated interpreters (default: --out)")
+	rewriteText := fs.Bool("rewrite-text", false, "Rewrite shebangs and /nix/store paths in unpacked text files")
+	placeholder := fs.String("store-placeholder", "", "Replace /nix/store in every text file with this placeholder (e.g. @NIX_STORE@) instead of a script- or .pc-relative path (with --rewrite-text)")
+	launcher := fs.String("shebang-launcher", "/usr/bin/env", "Launcher replacing /nix/store interpreters in shebangs (with --rewrite-text)")
+	rewriteReport := fs.String("rewrite-report", "", "Where to write the JSON report of rewritten files (default: <out>/<store name>.rewrites.json)")
+	var references stringsFlag
+	fs.Var(&references, "reference", "Store path in the closure whose lib directory is added to relocated RUNPATHs; can be repeated")
+	if err := g.parse(fs, args); err != nil {
+		return err
+	}
+
+	fetcher := g.newFetcher(*outDir)
+	// Only read-only files are linked, so dedup needs canonical trees
+	fetcher.SetCanonical(*canonical || *dedup)
+	fetcher.SetDedup(*dedup)
+	if *localStore {
+		fetcher.SetLocalStore(nixbazel.LocalStore{Dir: *localStoreDir, Symlink: *localStoreSymlink, Verify: *verifyLocal})
+	}
+
+	if *copyDir != "" {
+		if *lockFile != "" || len(archives) > 0 || *unpackManifest != "" {
+			return errors.New("--copy cannot be combined with --lockfile, --archive or --unpack-manifest")
+		}
+		if err := nixbazel.CopyTree(*copyDir, *outDir, g.progress); err != nil {
+			return fmt.Errorf("failed to copy %s: %w", *copyDir, err)
+		}
+		return nil
+	}
+
+	if *lockFile != "" {
+		if len(archives) > 0 || *unpackManifest != "" {
+			return errors.New("--lockfile cannot be combined with --archive or --unpack-manifest")
+		}
+		if *patch || *relocate || *rewriteText || len(extract) > 0 {
+			return errors.New("--patch, --relocate, --rewrite-text and --extract only apply to archives")
+		}
+		lock, err := nixbazel.LoadLockfile(*lockFile)
+		if err != nil {
+			return err
+		}
+		return fetcher.FetchAllFromLock(lock)
+	}
+
+	if len(archives) != len(storePaths) {
+		return errors.New("every --archive needs a matching --store-path")
+	}
+	var requests []nixbazel.UnpackRequest
+	for i := range archives {
+		requests = append(requests, nixbazel.UnpackRequest{Archive: archives[i], StorePath: storePaths[i]})
+	}
+	if *unpackManifest != "" {
+		loaded, err := nixbazel.LoadUnpackRequests(*unpackManifest)
+		if err != nil {
+			return err
+		}
+		requests = append(requests, loaded...)
+	}
+	if len(requests) == 0 {
+		return errors.New("--archive and --store-path (or --unpack-manifest, or --lockfile) are required")
+	}
+	if len(requests) > 1 && (len(extract) > 0 || *rewriteReport != "") {
+		return errors.New("--extract and --rewrite-report need a single archive")
+	}
+
+	if *patch {
+		if *interpreter == "" && !g.set["rpath"] {
+			return errors.New("--patch requires --interpreter or --rpath")
+		}
+		fetcher.SetElfPatch(nixbazel.ElfPatch{
+			Interpreter: *interpreter,
+			RunPath:     *rpath,
+			SetRunPath:  g.set["rpath"],
+		})
+	}
+	if *relocate {
+		prefix := *interpreterPrefix
+		if prefix == "" {
+			prefix = *outDir
+		}
+		fetcher.SetRelocation(nixbazel.Relocation{
+			InterpreterPrefix: prefix,
+			References:        references,
+		})
+	}
+	if *rewriteText {
+		fetcher.SetTextRewrite(nixbazel.TextRewrite{
+			Placeholder: *placeholder,
+			Launcher:    *launcher,
+		}, *rewriteReport)
+	}
+	if len(extract) > 0 {
+		if err := fetcher.Extract(requests[0].Archive, requests[0].StorePath, extract); err != nil {
+			return fmt.Errorf("failed to extract: %w", err)
+		}
+		return nil
+	}
+	if err := fetcher.UnpackAll(requests, g.Jobs); err != nil {
+		return fmt.Errorf("failed to unpack: %w", err)
+	}
+	if *relativeSymlinks {
+		rewritten, err := nixbazel.RewriteStoreSymlinks(*outDir)
+		if err != nil {
+			return fmt.Errorf("failed to rewrite symlinks: %w", err)
+		}
+		fmt.Fprintf(g.progress, "Rewrote %d symlinks in %s\n", rewritten, *outDir)
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+package cli
+
+import (
+	"flag"
+)
+
+func runGenerate(g *Globals, fs *flag.FlagSet, args []string) error {
+	outDir := fs.String("out", ".", "Output directory")
+	lockFile := fs.String("lockfile", "nix_deps.lock.json", "Lockfile to generate BUILD files for")
+	channel := fs.String("channel", "", "Nix channel (Hydra jobset) to use for resolution")
+	if err := g.parse(fs, args); err != nil {
+		return err
+	}
+
+	fetcher := g.newFetcher(*outDir)
+	return fetcher.GenerateBuildFiles(*lockFile, *channel)
+}
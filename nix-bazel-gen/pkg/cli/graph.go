@@ -0,0 +1,41 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+
+	"nix-bazel-gen/pkg/nixbazel"
+)
+
+func runGraph(g *Globals, fs *flag.FlagSet, args []string) error {
+	lockFile := fs.String("lockfile", "nix_deps.lock.json", "Lockfile to read")
+	repo := fs.String("repo", "", "Only the closure of this repository")
+	reduce := fs.Bool("reduce", false, "Drop edges implied by longer paths (transitive reduction)")
+	as := fs.String("as", "dot", "Graph syntax: dot, graphml or json (same as --format json)")
+	if err := g.parse(fs, args); err != nil {
+		return err
+	}
+
+	lock, err := nixbazel.LoadLockfile(*lockFile)
+	if err != nil {
+		return err
+	}
+	graph, err := nixbazel.BuildGraph(lock, *repo, *reduce)
+	if err != nil {
+		return err
+	}
+	if g.Format == "json" {
+		*as = "json"
+	}
+	switch *as {
+	case "dot":
+		return graph.WriteDOT(g.out)
+	case "graphml":
+		return graph.WriteGraphML(g.out)
+	case "json":
+		g.Format = "json"
+		return g.emit(graph, nil)
+	default:
+		return fmt.Errorf("unknown graph syntax %q (expected dot, graphml or json)", *as)
+	}
+}
@@ -0,0 +1,38 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+
+	"nix-bazel-gen/pkg/nixbazel"
+)
+
+func runMirror(g *Globals, fs *flag.FlagSet, args []string) error {
+	lockFile := fs.String("lockfile", "nix_deps.lock.json", "Lockfile whose packages are mirrored")
+	dest := fs.String("to", "", "Binary cache to copy to (http(s):// or file://)")
+	if err := g.parse(fs, args); err != nil {
+		return err
+	}
+	if *dest == "" {
+		return errors.New("mirror needs --to")
+	}
+
+	lock, err := nixbazel.LoadLockfile(*lockFile)
+	if err != nil {
+		return err
+	}
+	fetcher := g.newFetcher("")
+	report, err := fetcher.Mirror(context.Background(), lock, *dest, g.Jobs)
+	if err != nil {
+		return err
+	}
+	return g.emit(report, func(w io.Writer) {
+		for _, storePath := range report.LocalOnly {
+			fmt.Fprintf(w, "Skipped %s: only in a local store\n", storePath)
+		}
+		fmt.Fprintf(w, "Copied %d store paths (%d bytes) to %s, %d already there\n", len(report.Copied), report.Bytes, *dest, len(report.Skipped))
+	})
+}
@@ -0,0 +1,148 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"zombiezen.com/go/nix"
+
+	"nix-bazel-gen/pkg/nixbazel"
+)
+
+// packResult is the JSON form of a packed NAR, with narinfo-style hashes.
+type packResult struct {
+	Compression string `json:"compression"`
+	FileHash    string `json:"fileHash"`
+	FileSize    int64  `json:"fileSize"`
+	NarHash     string `json:"narHash"`
+	NarSize     int64  `json:"narSize"`
+}
+
+func runPack(g *Globals, fs *flag.FlagSet, args []string) error {
+	output := fs.String("o", "", "Write the NAR to this file instead of stdout")
+	compression := fs.String("compression", "none", "Compression: none or xz")
+	if err := g.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("pack needs exactly one path")
+	}
+
+	var w io.Writer = g.out
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	} else {
+		// Keep stdout clean for the NAR itself
+		g.out = os.Stderr
+	}
+
+	pack, err := nixbazel.PackNar(w, fs.Arg(0), *compression)
+	if err != nil {
+		return err
+	}
+	result := packResult{
+		Compression: pack.Compression,
+		FileHash:    pack.FileHash.Base32(),
+		FileSize:    pack.FileSize,
+		NarHash:     pack.NarHash.Base32(),
+		NarSize:     pack.NarSize,
+	}
+	return g.emit(result, func(w io.Writer) {
+		fmt.Fprintf(w, "Compression: %s\n", result.Compression)
+		fmt.Fprintf(w, "FileHash: %s\n", result.FileHash)
+		fmt.Fprintf(w, "FileSize: %d\n", result.FileSize)
+		fmt.Fprintf(w, "NarHash: %s\n", result.NarHash)
+		fmt.Fprintf(w, "NarSize: %d\n", result.NarSize)
+	})
+}
+
+// verifyResult is the JSON form of a verify run.
+type verifyResult struct {
+	Verified   int                        `json:"verified"`
+	Mismatches []nixbazel.NarHashMismatch `json:"mismatches"`
+}
+
+func runVerify(g *Globals, fs *flag.FlagSet, args []string) error {
+	lockFile := fs.String("lockfile", "nix_deps.lock.json", "Lockfile with the expected narHash values")
+	root := fs.String("root", ".", "Directory the store paths were unpacked into")
+	if err := g.parse(fs, args); err != nil {
+		return err
+	}
+
+	mismatches, verified, err := nixbazel.VerifyTrees(*lockFile, *root)
+	if err != nil {
+		return err
+	}
+	result := verifyResult{Verified: verified, Mismatches: mismatches}
+	if result.Mismatches == nil {
+		result.Mismatches = []nixbazel.NarHashMismatch{}
+	}
+	err = g.emit(result, func(w io.Writer) {
+		for _, m := range mismatches {
+			if m.Error != "" {
+				fmt.Fprintf(w, "%s: %s\n", m.StorePath, m.Error)
+			} else {
+				fmt.Fprintf(w, "%s: narHash %s, expected %s\n", m.StorePath, m.Actual, m.Expected)
+			}
+		}
+		fmt.Fprintf(w, "Verified %d store paths, %d mismatches\n", verified, len(mismatches))
+	})
+	if err != nil {
+		return err
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("%d store paths do not match the lockfile", len(mismatches))
+	}
+	return nil
+}
+
+func runUpload(g *Globals, fs *flag.FlagSet, args []string) error {
+	name := fs.String("name", "", "Store path name, e.g. mytool-1.0")
+	lockFile := fs.String("lockfile", "", "Lockfile whose packages are scanned for as references")
+	compression := fs.String("compression", "xz", "Compression: none or xz")
+	keyFile := fs.String("key", "", "Secret key file (as made by nix-store --generate-binary-cache-key) to sign the narinfo")
+	if err := g.parse(fs, args); err != nil {
+		return err
+	}
+	// Never upload to the default cache by accident
+	if fs.NArg() != 1 || !g.set["cache"] || *name == "" {
+		return errors.New("upload needs --cache, --name and exactly one path")
+	}
+
+	opts := nixbazel.UploadOptions{
+		Path:        fs.Arg(0),
+		Name:        *name,
+		LockFile:    *lockFile,
+		Compression: *compression,
+	}
+	if *keyFile != "" {
+		data, err := os.ReadFile(*keyFile)
+		if err != nil {
+			return fmt.Errorf("failed to read key: %w", err)
+		}
+		key, err := nix.ParsePrivateKey(strings.TrimSpace(string(data)))
+		if err != nil {
+			return fmt.Errorf("failed to parse key: %w", err)
+		}
+		opts.SigningKey = key
+	}
+
+	fetcher := g.newFetcher(".")
+	info, err := fetcher.Upload(context.Background(), opts)
+	if err != nil {
+		return fmt.Errorf("failed to upload: %w", err)
+	}
+	return g.emit(map[string]string{"storePath": string(info.StorePath)}, func(w io.Writer) {
+		fmt.Fprintln(w, info.StorePath)
+	})
+}
@@ -0,0 +1,40 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"text/tabwriter"
+
+	"nix-bazel-gen/pkg/nixbazel"
+)
+
+func runQuery(g *Globals, fs *flag.FlagSet, args []string) error {
+	lockFile := fs.String("lockfile", "nix_deps.lock.json", "Lockfile to read")
+	if err := g.parse(fs, args); err != nil {
+		return err
+	}
+	// Terms may be given as one argument or several
+	sel, err := nixbazel.ParseSelector(strings.Join(fs.Args(), " "))
+	if err != nil {
+		return err
+	}
+
+	lock, err := nixbazel.LoadLockfile(*lockFile)
+	if err != nil {
+		return err
+	}
+	results := nixbazel.Query(lock, sel)
+	return g.emit(results, func(w io.Writer) {
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tVERSION\tSIZE\tDOWNLOAD\tREPOSITORIES\tSTORE PATH")
+		for _, p := range results {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", p.Name, p.Version,
+				nixbazel.FormatSize(p.NarSize), nixbazel.FormatSize(p.FileSize),
+				strings.Join(p.Repositories, ","), path.Base(p.StorePath))
+		}
+		tw.Flush()
+	})
+}
@@ -0,0 +1,51 @@
+package cli
+
+import (
+	"flag"
+
+	"nix-bazel-gen/pkg/nixbazel"
+)
+
+func runResolve(g *Globals, fs *flag.FlagSet, args []string) error {
+	configFile := fs.String("config", "packages.json", "Config file for resolution")
+	lockFile := fs.String("lockfile", "nix_deps.lock.json", "Lockfile output path")
+	channel := fs.String("channel", "", "Nix channel (Hydra jobset) to use for resolution")
+	doFetch := fs.Bool("fetch", false, "Download packages and generate build files")
+	manifests := fs.Bool("manifests", false, "Record file manifests of each store path next to the lockfile")
+	dedup := fs.Bool("dedup", false, "With --fetch, make fetched trees read-only and hardlink identical files")
+	localStore := fs.Bool("local-store", false, "With --fetch, copy store paths from the local Nix store when present")
+	localStoreDir := fs.String("local-store-dir", "/nix/store", "Local Nix store directory (with --local-store)")
+	verifyLocal := fs.Bool("verify-local", false, "Check the NarHash of local store paths before using them (with --local-store)")
+	localDB := fs.String("local-db", "", "Resolve store paths from this Nix database (e.g. /nix/var/nix/db/db.sqlite) when it has them")
+	pathInfo := fs.String("path-info", "", "Merge the output of 'nix path-info --json --recursive' into the lockfile")
+	singleEval := fs.Bool("single-eval", false, "Resolve Hydra packages from the latest evaluation of the jobset that built all of them, instead of each job's latest build")
+	var reresolve stringsFlag
+	fs.Var(&reresolve, "reresolve", "Repository to resolve again even though the lockfile has it; can be repeated")
+	var substituters stringsFlag
+	fs.Var(&substituters, "substituter", "Binary cache checked for paths from --local-db or --path-info without a URL; can be repeated (default: https://cache.nixos.org)")
+	if err := g.parse(fs, args); err != nil {
+		return err
+	}
+
+	opts := nixbazel.ResolveOptions{
+		ConfigFile:   *configFile,
+		LockFile:     *lockFile,
+		Channel:      *channel,
+		CacheURL:     g.CacheURL,
+		Fetch:        *doFetch,
+		Manifests:    *manifests,
+		Dedup:        *dedup,
+		PathInfo:     *pathInfo,
+		Substituters: substituters,
+		Reresolve:    reresolve,
+		SingleEval:   *singleEval,
+		Progress:     g.progress,
+	}
+	if *localStore {
+		opts.LocalStore = &nixbazel.LocalStore{Dir: *localStoreDir, Verify: *verifyLocal}
+	}
+	if *localDB != "" {
+		opts.LocalDB = &nixbazel.LocalDB{Path: *localDB}
+	}
+	return nixbazel.RunResolve(opts)
+}
@@ -0,0 +1,86 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"nix-bazel-gen/pkg/nixbazel"
+)
+
+func runSBOM(g *Globals, fs *flag.FlagSet, args []string) error {
+	lockFile := fs.String("lockfile", "nix_deps.lock.json", "Lockfile to read")
+	as := fs.String("as", "cyclonedx", "SBOM format: cyclonedx or spdx")
+	outDir := fs.String("out", "", "Write one <repo>.cdx.json or <repo>.spdx.json per repository to this directory")
+	var repos stringsFlag
+	fs.Var(&repos, "repo", "Repository to describe (default: all); can be repeated")
+	if err := g.parse(fs, args); err != nil {
+		return err
+	}
+	extension := map[string]string{"cyclonedx": ".cdx.json", "spdx": ".spdx.json"}[*as]
+	if extension == "" {
+		return fmt.Errorf("unknown SBOM format %q (expected cyclonedx or spdx)", *as)
+	}
+
+	lock, err := nixbazel.LoadLockfile(*lockFile)
+	if err != nil {
+		return err
+	}
+	if len(repos) == 0 {
+		for name := range lock.Repositories {
+			repos = append(repos, name)
+		}
+		sort.Strings(repos)
+	}
+	if *outDir == "" && len(repos) != 1 {
+		return errors.New("sbom writes one document per repository: use --out, or a single --repo to print it")
+	}
+
+	opts := nixbazel.SBOMOptions{CacheURL: g.CacheURL, Created: time.Now()}
+	// Reproducible builds set SOURCE_DATE_EPOCH
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		seconds, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid SOURCE_DATE_EPOCH: %w", err)
+		}
+		opts.Created = time.Unix(seconds, 0)
+	}
+
+	for _, repo := range repos {
+		var doc any
+		if *as == "spdx" {
+			doc, err = nixbazel.SPDX(lock, repo, opts)
+		} else {
+			doc, err = nixbazel.CycloneDX(lock, repo, opts)
+		}
+		if err != nil {
+			return err
+		}
+		data, err := json.MarshalIndent(doc, "", "  ")
+		if err != nil {
+			return err
+		}
+		data = append(data, '\n')
+		if *outDir == "" {
+			if _, err := g.out.Write(data); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.MkdirAll(*outDir, 0755); err != nil {
+			return err
+		}
+		file := filepath.Join(*outDir, repo+extension)
+		if err := os.WriteFile(file, data, 0644); err != nil {
+			return fmt.Errorf("failed to write SBOM: %w", err)
+		}
+		fmt.Fprintf(g.progress, "Generated %s\n", file)
+	}
+	return nil
+}
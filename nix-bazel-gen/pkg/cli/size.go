@@ -0,0 +1,57 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"path"
+
+	"nix-bazel-gen/pkg/nixbazel"
+)
+
+func runSize(g *Globals, fs *flag.FlagSet, args []string) error {
+	lockFile := fs.String("lockfile", "nix_deps.lock.json", "Lockfile to read")
+	top := fs.Int("top", 5, "Number of largest store paths to list per repository")
+	if err := g.parse(fs, args); err != nil {
+		return err
+	}
+
+	lock, err := nixbazel.LoadLockfile(*lockFile)
+	if err != nil {
+		return err
+	}
+	sizes := nixbazel.ClosureSizes(lock, *top)
+	if fs.NArg() > 0 {
+		// Only the repositories named on the command line
+		wanted := make(map[string]bool)
+		for _, name := range fs.Args() {
+			if _, ok := lock.Repositories[name]; !ok {
+				return fmt.Errorf("repository %q not found in lockfile", name)
+			}
+			wanted[name] = true
+		}
+		filtered := sizes[:0]
+		for _, size := range sizes {
+			if wanted[size.Repository] {
+				filtered = append(filtered, size)
+			}
+		}
+		sizes = filtered
+	}
+
+	return g.emit(sizes, func(w io.Writer) {
+		for _, size := range sizes {
+			fmt.Fprintf(w, "%s: %d paths, %s (%s download), %s unique (%s download)\n",
+				size.Repository, size.Paths,
+				nixbazel.FormatSize(size.NarSize), nixbazel.FormatSize(size.FileSize),
+				nixbazel.FormatSize(size.UniqueNarSize), nixbazel.FormatSize(size.UniqueFileSize))
+			for _, p := range size.Largest {
+				unique := ""
+				if p.Unique {
+					unique = ", unique"
+				}
+				fmt.Fprintf(w, "  %10s  %s%s\n", nixbazel.FormatSize(p.NarSize), path.Base(p.StorePath), unique)
+			}
+		}
+	})
+}
@@ -0,0 +1,49 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"nix-bazel-gen/pkg/nixbazel"
+)
+
+// whyResult is the JSON form of a why run.
+type whyResult struct {
+	Repository string     `json:"repository"`
+	Target     string     `json:"target"`
+	Chains     [][]string `json:"chains"`
+}
+
+func runWhy(g *Globals, fs *flag.FlagSet, args []string) error {
+	lockFile := fs.String("lockfile", "nix_deps.lock.json", "Lockfile to read")
+	all := fs.Bool("all", false, "Print every reference chain, not only the shortest ones")
+	if err := g.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errors.New("why needs a repository and a store path or package name")
+	}
+
+	lock, err := nixbazel.LoadLockfile(*lockFile)
+	if err != nil {
+		return err
+	}
+	chains, err := nixbazel.WhyDepends(lock, fs.Arg(0), fs.Arg(1), *all)
+	if err != nil {
+		return err
+	}
+	result := whyResult{Repository: fs.Arg(0), Target: fs.Arg(1), Chains: chains}
+	return g.emit(result, func(w io.Writer) {
+		for _, chain := range chains {
+			names := make([]string, len(chain))
+			for i, storePath := range chain {
+				names[i] = path.Base(storePath)
+			}
+			fmt.Fprintln(w, strings.Join(names, " -> "))
+		}
+	})
+}
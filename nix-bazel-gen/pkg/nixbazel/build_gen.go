@@ -1,21 +1,22 @@
 package nixbazel
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
 func (f *Fetcher) GenerateBuildFiles(lockFile, channel string) error {
-	data, err := os.ReadFile(lockFile)
+	lock, err := LoadLockfile(lockFile)
 	if err != nil {
-		return fmt.Errorf("failed to read lockfile: %w", err)
+		return err
 	}
-	var lock Lockfile
-	if err := json.Unmarshal(data, &lock); err != nil {
-		return fmt.Errorf("failed to parse lockfile: %w", err)
+
+	// Manifests are optional; without them we only know the store paths.
+	if f.manifests, err = LoadManifests(ManifestPath(lockFile)); err != nil {
+		return err
 	}
 
 	// Collect all unique store paths
@@ -31,10 +32,13 @@ func (f *Fetcher) GenerateBuildFiles(lockFile, channel string) error {
 		}
 	}
 
-	return f.generateBuildFiles(lock, uniquePaths, channel)
+	return f.generateBuildFiles(*lock, uniquePaths, channel)
 }
 
 func (f *Fetcher) generateBuildFiles(lock Lockfile, uniquePaths map[string]*NarInfo, channel string) error {
+	// C/C++ targets need to know every package's files up front
+	ccPlan := planCcPackages(lock, f.manifests, f.progress)
+
 	// 1. Generate per-package BUILD files
 	for storePath := range uniquePaths {
 		storeName := filepath.Base(storePath)
@@ -53,7 +57,8 @@ func (f *Fetcher) generateBuildFiles(lock Lockfile, uniquePaths map[string]*NarI
 
 		fmt.Fprintf(file, "load(\"@nix_deps//:nix_unpack.bzl\", \"nix_unpack\")\n")
 		fmt.Fprintf(file, "load(\"@nix_deps//:nix_root.bzl\", \"nix_root\")\n")
-		fmt.Fprintf(file, "load(\"@nix_deps//:nix_bwrap.bzl\", \"nix_bwrap_run\")\n\n")
+		fmt.Fprintf(file, "load(\"@nix_deps//:nix_bwrap.bzl\", \"nix_bwrap_run\")\n")
+		fmt.Fprintf(file, "load(\"@nix_deps//:nix_extract.bzl\", \"nix_extract\")\n\n")
 		fmt.Fprintf(file, "package(default_visibility = [\"//visibility:public\"])\n\n")
 
 		// Calculate dependencies (transitive closure)
@@ -106,6 +111,17 @@ func (f *Fetcher) generateBuildFiles(lock Lockfile, uniquePaths map[string]*NarI
 		fmt.Fprintf(file, "    name = \"%s\",\n", storeName)
 		fmt.Fprintf(file, "    nar_file = \"//:downloads/%s\",\n", uniquePaths[storePath].FileHash)
 		fmt.Fprintf(file, "    store_name = \"%s\",\n", storeName)
+		var unpackRefs []string
+		for _, ref := range lock.Packages[storePath].References {
+			if ref != storeName {
+				unpackRefs = append(unpackRefs, fmt.Sprintf("\"%s\"", ref))
+			}
+		}
+		sort.Strings(unpackRefs)
+		fmt.Fprintf(file, "    references = [%s],\n", strings.Join(unpackRefs, ", "))
+		if narHash := lock.Packages[storePath].NarHash; narHash != "" {
+			fmt.Fprintf(file, "    nar_hash = \"%s\",\n", narHash)
+		}
 		fmt.Fprintf(file, ")\n\n")
 
 		// Binaries
@@ -147,12 +163,25 @@ func (f *Fetcher) generateBuildFiles(lock Lockfile, uniquePaths map[string]*NarI
 		fmt.Fprintf(file, "    deps = [%s],\n", strings.Join(rootDeps, ", "))
 		fmt.Fprintf(file, ")\n\n")
 
+		reserved := map[string]bool{storeName: true, "root": true}
+		if p, ok := ccPlan[storePath]; ok {
+			narFile := fmt.Sprintf("//:downloads/%s", uniquePaths[storePath].FileHash)
+			for _, name := range writeCcTargets(file, storePath, p, ccPlan, lock.Packages[storePath], narFile) {
+				reserved[name] = true
+			}
+		}
+
+		// With a manifest we know the binaries up front.
+		if m := f.manifestFor(lock.Packages[storePath]); m != nil {
+			writeBinaryTargets(file, storeName, m, reserved)
+		}
+
 		file.Close()
 	}
 
 	// 2. Generate root BUILD file with aliases
 	rootBuildPath := filepath.Join(f.outDir, "BUILD.bazel")
-	fmt.Printf("Generating root %s...\n", rootBuildPath)
+	fmt.Fprintf(f.progress, "Generating root %s...\n", rootBuildPath)
 
 	file, err := os.Create(rootBuildPath)
 	if err != nil {
@@ -160,6 +189,7 @@ func (f *Fetcher) generateBuildFiles(lock Lockfile, uniquePaths map[string]*NarI
 	}
 	defer file.Close()
 
+	fmt.Fprintf(file, "load(\"@nix_deps//:nix_root.bzl\", \"nix_root_subdir\")\n\n")
 	fmt.Fprintf(file, "package(default_visibility = [\"//visibility:public\"])\n\n")
 
 	// Explicitly export downloaded NAR files
@@ -183,9 +213,34 @@ func (f *Fetcher) generateBuildFiles(lock Lockfile, uniquePaths map[string]*NarI
 		fmt.Fprintf(file, "    name = \"%s\",\n", repoName)
 		fmt.Fprintf(file, "    actual = \"%s\",\n", target)
 		fmt.Fprintf(file, ")\n\n")
+
+		// Alias for the C/C++ library, e.g. @nix_deps//:zlib_cc
+		if p, ok := ccPlan[storePath]; ok && p.hasTarget() {
+			fmt.Fprintf(file, "alias(\n")
+			fmt.Fprintf(file, "    name = \"%s_cc\",\n", repoName)
+			fmt.Fprintf(file, "    actual = \"//%s:cc\",\n", storeName)
+			fmt.Fprintf(file, ")\n\n")
+		}
+
+		// Filegroups for bin, lib, include, ... e.g. @nix_deps//:python3_lib
+		writeSubdirTargets(file, repoName, storeName, f.manifestFor(lock.Packages[storePath]))
+
+		// Files explicitly requested on nix.package
+		exported, err := f.extractRequestedFiles(repoName, repoLock, lock.Packages[storePath])
+		if err != nil {
+			return err
+		}
+		if len(exported) > 0 {
+			fmt.Fprintf(file, "exports_files(%s)\n\n", starlarkList(exported))
+		}
 	}
 
-	// 3. Generate update_nix_lock target
+	// 3. Generate toolchains
+	if err := f.generateToolchains(lock); err != nil {
+		return err
+	}
+
+	// 4. Generate update_nix_lock target
 	fmt.Fprintf(file, "sh_binary(\n")
 	fmt.Fprintf(file, "    name = \"update_nix_lock\",\n")
 	fmt.Fprintf(file, "    srcs = [\"update_nix_lock.sh\"],\n")
@@ -223,7 +278,8 @@ CHANNEL_ARG=""
 if [ -n "%s" ]; then
   CHANNEL_ARG="--channel %s"
 fi
-"$TOOL" --config "$PACKAGES_JSON" --lockfile "$BUILD_WORKSPACE_DIRECTORY/nix_deps.lock.json" $CHANNEL_ARG
+# The manifest sidecar drives the cc, binary and file targets
+"$TOOL" --config "$PACKAGES_JSON" --lockfile "$BUILD_WORKSPACE_DIRECTORY/nix_deps.lock.json" --manifests $CHANNEL_ARG
 `
 	scriptContent = fmt.Sprintf(scriptContent, channel, channel)
 	if err := os.WriteFile(scriptPath, []byte(scriptContent), 0755); err != nil {
@@ -233,6 +289,34 @@ fi
 	return nil
 }
 
+// manifestFor returns the recorded manifest of a package, if any.
+func (f *Fetcher) manifestFor(node ClosureNode) *Manifest {
+	if f.manifests == nil || node.NarHash == "" {
+		return nil
+	}
+	return f.manifests[node.NarHash]
+}
+
+// writeBinaryTargets emits a nix_bwrap_run target for every executable in bin/.
+func writeBinaryTargets(file *os.File, storeName string, m *Manifest, reserved map[string]bool) {
+	for _, e := range m.Dir("bin") {
+		if e.Type == EntryDirectory || (e.Type == EntryRegular && !e.Executable) {
+			continue
+		}
+		binName := filepath.Base(e.Path)
+		if reserved[binName] || !isValidLabelName(binName) {
+			// Would clash with the targets above
+			continue
+		}
+		fmt.Fprintf(file, "nix_bwrap_run(\n")
+		fmt.Fprintf(file, "    name = \"%s\",\n", binName)
+		fmt.Fprintf(file, "    root = \":root\",\n")
+		fmt.Fprintf(file, "    entrypoint = \":%s\",\n", storeName)
+		fmt.Fprintf(file, "    bin_path = \"%s\",\n", e.Path)
+		fmt.Fprintf(file, ")\n\n")
+	}
+}
+
 func getTransitiveClosure(root string, packages map[string]ClosureNode) []string {
 	closure := make(map[string]bool)
 	var traverse func(string)
@@ -267,7 +351,7 @@ func (f *Fetcher) generateBuildFile(info *NarInfo) error {
 	// We want to generate BUILD.bazel in repo_root
 	buildFilePath := filepath.Join(f.outDir, "BUILD.bazel")
 
-	fmt.Printf("Generating %s...\n", buildFilePath)
+	fmt.Fprintf(f.progress, "Generating %s...\n", buildFilePath)
 
 	file, err := os.Create(buildFilePath)
 	if err != nil {
@@ -275,7 +359,6 @@ func (f *Fetcher) generateBuildFile(info *NarInfo) error {
 	}
 	defer file.Close()
 
-	fmt.Fprintf(file, "load(\"@nix_deps//:patchelf.bzl\", \"nix_patchelf\")\n\n")
 	fmt.Fprintf(file, "package(default_visibility = [\"//visibility:public\"])\n\n")
 
 	// Expose all files
@@ -292,9 +375,9 @@ func (f *Fetcher) generateBuildFile(info *NarInfo) error {
 				// path relative to repo root: <store_name>/bin/<name>
 				relPath := filepath.Join(storeName, "bin", binName)
 
-				fmt.Fprintf(file, "nix_patchelf(\n")
+				fmt.Fprintf(file, "sh_binary(\n")
 				fmt.Fprintf(file, "    name = \"%s\",\n", binName)
-				fmt.Fprintf(file, "    src = \"%s\",\n", relPath)
+				fmt.Fprintf(file, "    srcs = [\"%s\"],\n", relPath)
 				// We need to include all files as data so it can find libs/resources
 				fmt.Fprintf(file, "    data = [\":all_files\"],\n")
 				fmt.Fprintf(file, ")\n\n")
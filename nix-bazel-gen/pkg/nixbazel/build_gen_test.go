@@ -0,0 +1,50 @@
+package nixbazel
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The update script must record manifests, which the cc, binary and file
+// targets are generated from.
+func TestUpdateScriptManifests(t *testing.T) {
+	dir := t.TempDir()
+	f := NewFetcher("", dir)
+	lock := Lockfile{Repositories: map[string]RepositoryLock{}, Packages: map[string]ClosureNode{}}
+	if err := f.generateBuildFiles(lock, map[string]*NarInfo{}, "nixpkgs/trunk"); err != nil {
+		t.Fatal(err)
+	}
+	script, err := os.ReadFile(filepath.Join(dir, "update_nix_lock.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(script), `nix_deps.lock.json" --manifests $CHANNEL_ARG`) {
+		t.Errorf("update_nix_lock.sh does not pass --manifests:\n%s", script)
+	}
+}
+
+// nix_root checks local store copies against the NarHash on nix_unpack.
+func TestGenerateUnpackNarHash(t *testing.T) {
+	dir := t.TempDir()
+	f := NewFetcher("", dir)
+	lock := Lockfile{
+		Repositories: map[string]RepositoryLock{"hello": {StorePath: testHelloPath}},
+		Packages: map[string]ClosureNode{
+			testHelloPath: {NarHash: testGlibcHash, FileHash: testGlibcHash, References: []string{path.Base(testGlibcPath)}},
+		},
+	}
+	uniquePaths := map[string]*NarInfo{testHelloPath: {StorePath: testHelloPath, FileHash: testGlibcHash}}
+	if err := f.generateBuildFiles(lock, uniquePaths, ""); err != nil {
+		t.Fatal(err)
+	}
+	build, err := os.ReadFile(filepath.Join(dir, path.Base(testHelloPath), "BUILD.bazel"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(build), `    nar_hash = "`+testGlibcHash+`",`) {
+		t.Errorf("nix_unpack has no nar_hash:\n%s", build)
+	}
+}
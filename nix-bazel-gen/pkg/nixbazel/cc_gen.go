@@ -0,0 +1,494 @@
+package nixbazel
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ccPackage collects the C/C++ targets generated for one store path.
+type ccPackage struct {
+	hdrs    []string
+	imports []ccImport
+	// Files extracted from this package's NAR
+	outs map[string]bool
+	// Files that are copies of a file extracted by another package, keyed by
+	// the output name in this package
+	links map[string]string
+	// Derived from the package's pkg-config files
+	flags ccFlags
+	// Store paths providing the pkg-config modules this package requires
+	requires []string
+}
+
+// ccImport describes a cc_import for one library in lib/.
+type ccImport struct {
+	name   string
+	lib    string // As passed to -l
+	shared string
+	static string
+}
+
+// hasTarget reports whether the package gets a cc_library of its own.
+func (p *ccPackage) hasTarget() bool {
+	return len(p.hdrs) > 0 || len(p.imports) > 0 || len(p.requires) > 0 ||
+		len(p.flags.defines) > 0 || len(p.flags.linkopts) > 0
+}
+
+// hasLib reports whether the package imports the library passed as -l<lib>.
+func (p *ccPackage) hasLib(lib string) bool {
+	for _, imp := range p.imports {
+		if imp.lib == lib {
+			return true
+		}
+	}
+	return false
+}
+
+// manifestsByStorePath indexes the recorded manifests of every locked package.
+func manifestsByStorePath(lock Lockfile, manifests Manifests) map[string]*Manifest {
+	byPath := make(map[string]*Manifest)
+	for storePath, node := range lock.Packages {
+		if m, ok := manifests[node.NarHash]; ok && node.NarHash != "" {
+			byPath[storePath] = m
+		}
+	}
+	return byPath
+}
+
+// resolveManifestPath follows symlinks through the manifests until it reaches
+// a regular file, returning its store path and path relative to that store
+// path. Only the final path component may be a symlink.
+func resolveManifestPath(byPath map[string]*Manifest, storePath, rel string) (string, string, bool) {
+	for hops := 0; hops < maxSymlinkHops; hops++ {
+		m, ok := byPath[storePath]
+		if !ok {
+			return "", "", false
+		}
+		e := m.Lookup(rel)
+		if e == nil {
+			return "", "", false
+		}
+		switch e.Type {
+		case EntryRegular:
+			return storePath, rel, true
+		case EntryDirectory:
+			return "", "", false
+		}
+
+		target := e.Target
+		if !path.IsAbs(target) {
+			target = path.Join(storePath, path.Dir(rel), target)
+		}
+		rest, ok := strings.CutPrefix(path.Clean(target), nixStoreDir+"/")
+		if !ok {
+			return "", "", false
+		}
+		base, sub, _ := strings.Cut(rest, "/")
+		storePath, rel = nixStoreDir+"/"+base, sub
+	}
+	return "", "", false
+}
+
+// sharedLibrarySoname returns the file name linked binaries load the shared
+// library rel (lib<lib>.so) of storePath by. There is no ELF header in the
+// manifest, so it is the shortest lib<lib>.so.* name next to the library's
+// real file that resolves to it, as in libz.so -> libz.so.1 -> libz.so.1.3.1.
+// It returns "" if there is none.
+func sharedLibrarySoname(byPath map[string]*Manifest, storePath, rel, lib string) string {
+	owner, real, ok := resolveManifestPath(byPath, storePath, rel)
+	if !ok {
+		return ""
+	}
+	soname := ""
+	for _, e := range byPath[owner].Dir(path.Dir(real)) {
+		name := path.Base(e.Path)
+		if !strings.HasPrefix(name, "lib"+lib+".so.") || e.Type == EntryDirectory {
+			continue
+		}
+		if o, r, ok := resolveManifestPath(byPath, owner, e.Path); !ok || o != owner || r != real {
+			continue
+		}
+		if soname == "" || len(name) < len(soname) || (len(name) == len(soname) && name < soname) {
+			soname = name
+		}
+	}
+	return soname
+}
+
+// ccSystemLibraries are packages that come with the C toolchain. Their cc
+// targets are generated but not wired into other packages' deps, as linking
+// against them only works with a matching toolchain.
+var ccSystemLibraries = map[string]bool{
+	"glibc": true,
+}
+
+var (
+	labelNameRE  = regexp.MustCompile(`^[A-Za-z0-9_.+\-@=,~/]+$`)
+	libraryRE    = regexp.MustCompile(`^lib(.+)\.(so|a)$`)
+	targetNameRE = regexp.MustCompile(`[^A-Za-z0-9_]`)
+)
+
+// isValidLabelName reports whether name can be used as a package-relative
+// Bazel target name.
+func isValidLabelName(name string) bool {
+	if !labelNameRE.MatchString(name) {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// planCcPackages decides which headers and libraries every package exposes.
+// Symlinks that resolve into another store path (typical for -dev outputs)
+// become copies of a file extracted by the owning package.
+func planCcPackages(lock Lockfile, manifests Manifests, progress io.Writer) map[string]*ccPackage {
+	byPath := manifestsByStorePath(lock, manifests)
+	plan := make(map[string]*ccPackage)
+	pkg := func(storePath string) *ccPackage {
+		p, ok := plan[storePath]
+		if !ok {
+			p = &ccPackage{outs: make(map[string]bool), links: make(map[string]string)}
+			plan[storePath] = p
+		}
+		return p
+	}
+
+	// exposeAs makes rel available as the output out of storePath, returning
+	// false if it cannot be resolved to a regular file. out must be rel or,
+	// if rel resolves into storePath itself, another path of storePath.
+	exposeAs := func(storePath, out, rel string) bool {
+		if !isValidLabelName(out) {
+			return false
+		}
+		owner, real, ok := resolveManifestPath(byPath, storePath, rel)
+		if !ok || !isValidLabelName(real) {
+			return false
+		}
+		if owner == storePath {
+			// The extractor follows links inside the same store path
+			pkg(storePath).outs[out] = true
+			return true
+		}
+		pkg(owner).outs[real] = true
+		pkg(storePath).links[out] = fmt.Sprintf("//%s:%s", path.Base(owner), real)
+		return true
+	}
+	expose := func(storePath, rel string) bool {
+		return exposeAs(storePath, rel, rel)
+	}
+
+	storePaths := make([]string, 0, len(byPath))
+	for storePath := range byPath {
+		storePaths = append(storePaths, storePath)
+	}
+	sort.Strings(storePaths)
+
+	for _, storePath := range storePaths {
+		m := byPath[storePath]
+		var hdrs []string
+		for _, e := range m.Entries {
+			if !strings.HasPrefix(e.Path, "include/") || e.Type == EntryDirectory {
+				continue
+			}
+			if expose(storePath, e.Path) {
+				hdrs = append(hdrs, e.Path)
+			}
+		}
+
+		imports := make(map[string]*ccImport)
+		for _, e := range m.Dir("lib") {
+			match := libraryRE.FindStringSubmatch(path.Base(e.Path))
+			if match == nil || e.Type == EntryDirectory {
+				continue
+			}
+			rel := e.Path
+			if match[2] == "so" {
+				// Binaries load the library by its SONAME, not by the
+				// unversioned name they were linked with
+				if soname := sharedLibrarySoname(byPath, storePath, e.Path, match[1]); soname != "" {
+					rel = path.Join(path.Dir(e.Path), soname)
+				}
+			}
+			if !exposeAs(storePath, rel, e.Path) {
+				continue
+			}
+			imp, ok := imports[match[1]]
+			if !ok {
+				imp = &ccImport{name: "cc_lib" + targetNameRE.ReplaceAllString(match[1], "_"), lib: match[1]}
+				imports[match[1]] = imp
+			}
+			if match[2] == "so" {
+				imp.shared = rel
+			} else {
+				imp.static = rel
+			}
+		}
+
+		if len(hdrs) == 0 && len(imports) == 0 {
+			continue
+		}
+		p := pkg(storePath)
+		p.hdrs = hdrs
+		for _, imp := range imports {
+			p.imports = append(p.imports, *imp)
+		}
+		sort.Slice(p.imports, func(i, j int) bool { return p.imports[i].name < p.imports[j].name })
+	}
+
+	// Module name -> providing store path, for pkg-config Requires
+	providers := make(map[string]string)
+	for _, storePath := range storePaths {
+		for pcPath := range byPath[storePath].PkgConfig {
+			providers[strings.TrimSuffix(path.Base(pcPath), ".pc")] = storePath
+		}
+	}
+	for _, storePath := range storePaths {
+		if len(byPath[storePath].PkgConfig) > 0 {
+			applyPkgConfig(lock, plan, providers, storePath, byPath[storePath], pkg(storePath), progress)
+		}
+	}
+
+	// Include directories in other store paths, such as glib's
+	// lib/glib-2.0/include, are exported by the owning package's target
+	for _, storePath := range storePaths {
+		p, ok := plan[storePath]
+		if !ok {
+			continue
+		}
+		for _, dir := range p.flags.external {
+			owner, sub, _ := storeRelative(dir)
+			var hdrs []string
+			if m, ok := byPath[owner]; ok {
+				for _, e := range m.Entries {
+					if strings.HasPrefix(e.Path, sub+"/") && e.Type != EntryDirectory && expose(owner, e.Path) {
+						hdrs = append(hdrs, e.Path)
+					}
+				}
+			}
+			if len(hdrs) == 0 {
+				fmt.Fprintf(progress, "Warning: %s: dropping flag %q, no headers of it are in the manifests\n", storePath, "-I"+dir)
+				continue
+			}
+			ownerPkg := pkg(owner)
+			ownerPkg.hdrs = appendUnique(ownerPkg.hdrs, hdrs...)
+			sort.Strings(ownerPkg.hdrs)
+			if sub != "include" {
+				ownerPkg.flags.includes = appendUnique(ownerPkg.flags.includes, sub)
+			}
+			if owner != storePath {
+				p.requires = appendUnique(p.requires, owner)
+				sort.Strings(p.requires)
+			}
+		}
+	}
+	return plan
+}
+
+// applyPkgConfig derives compile and link flags as well as dependencies from
+// the package's pkg-config files.
+func applyPkgConfig(lock Lockfile, plan map[string]*ccPackage, providers map[string]string, storePath string, m *Manifest, p *ccPackage, progress io.Writer) {
+	var pcPaths []string
+	for pcPath := range m.PkgConfig {
+		pcPaths = append(pcPaths, pcPath)
+	}
+	sort.Strings(pcPaths)
+
+	closure := getTransitiveClosure(storePath, lock.Packages)
+	knownLib := func(lib string) bool {
+		if p.hasLib(lib) {
+			return true
+		}
+		for _, ref := range closure {
+			if refPkg, ok := plan[ref]; ok && refPkg.hasLib(lib) {
+				return true
+			}
+		}
+		return false
+	}
+
+	requires := make(map[string]bool)
+	for _, pcPath := range pcPaths {
+		pc, err := parsePkgConfig(storePath+"/"+pcPath, m.PkgConfig[pcPath])
+		if err != nil {
+			fmt.Fprintf(progress, "Warning: skipping pkg-config file: %v\n", err)
+			continue
+		}
+
+		flags, skipped := translatePkgConfigFlags(storePath, pc.Cflags, pc.Libs)
+		for _, flag := range skipped {
+			fmt.Fprintf(progress, "Warning: %s/%s: dropping flag %q\n", storePath, pcPath, flag)
+		}
+		p.flags.includes = appendUnique(p.flags.includes, flags.includes...)
+		p.flags.external = appendUnique(p.flags.external, flags.external...)
+		p.flags.defines = appendUnique(p.flags.defines, flags.defines...)
+		p.flags.linkopts = appendUnique(p.flags.linkopts, flags.linkopts...)
+		for _, lib := range flags.libs {
+			if !knownLib(lib) {
+				// Not provided by the closure, e.g. -lm or -lpthread
+				p.flags.linkopts = appendUnique(p.flags.linkopts, "-l"+lib)
+			}
+		}
+
+		for _, module := range append(pc.Requires, pc.RequiresPrivate...) {
+			if provider, ok := providers[module]; ok && provider != storePath {
+				requires[provider] = true
+			}
+		}
+	}
+	for provider := range requires {
+		p.requires = append(p.requires, provider)
+	}
+	sort.Strings(p.requires)
+}
+
+func appendUnique(list []string, values ...string) []string {
+	for _, v := range values {
+		found := false
+		for _, existing := range list {
+			if existing == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// writeCcTargets emits the nix_extract, cc_import and cc_library targets of a
+// package and returns the names it used.
+func writeCcTargets(file *os.File, storePath string, p *ccPackage, plan map[string]*ccPackage, node ClosureNode, narFile string) []string {
+	storeName := path.Base(storePath)
+
+	var outs []string
+	for out := range p.outs {
+		outs = append(outs, out)
+	}
+	for out := range p.links {
+		outs = append(outs, out)
+	}
+	sort.Strings(outs)
+
+	fmt.Fprintf(file, "nix_extract(\n")
+	fmt.Fprintf(file, "    name = \"files\",\n")
+	fmt.Fprintf(file, "    nar_file = \"%s\",\n", narFile)
+	fmt.Fprintf(file, "    store_name = \"%s\",\n", storeName)
+	fmt.Fprintf(file, "    outs = [\n")
+	for _, out := range outs {
+		fmt.Fprintf(file, "        \"%s\",\n", out)
+	}
+	fmt.Fprintf(file, "    ],\n")
+	if len(p.links) > 0 {
+		var links []string
+		srcs := make(map[string]bool)
+		for out, src := range p.links {
+			links = append(links, out)
+			srcs[src] = true
+		}
+		sort.Strings(links)
+		fmt.Fprintf(file, "    links = {\n")
+		for _, out := range links {
+			fmt.Fprintf(file, "        \"%s\": \"%s\",\n", out, p.links[out])
+		}
+		fmt.Fprintf(file, "    },\n")
+		var linkSrcs []string
+		for src := range srcs {
+			linkSrcs = append(linkSrcs, fmt.Sprintf("\"%s\"", src))
+		}
+		sort.Strings(linkSrcs)
+		fmt.Fprintf(file, "    link_srcs = [%s],\n", strings.Join(linkSrcs, ", "))
+	}
+	fmt.Fprintf(file, ")\n\n")
+
+	names := []string{"files"}
+	if !p.hasTarget() {
+		return names
+	}
+
+	var deps []string
+	for _, imp := range p.imports {
+		fmt.Fprintf(file, "cc_import(\n")
+		fmt.Fprintf(file, "    name = \"%s\",\n", imp.name)
+		if imp.shared != "" {
+			fmt.Fprintf(file, "    shared_library = \":%s\",\n", imp.shared)
+		}
+		if imp.static != "" {
+			fmt.Fprintf(file, "    static_library = \":%s\",\n", imp.static)
+		}
+		fmt.Fprintf(file, ")\n\n")
+		deps = append(deps, fmt.Sprintf("\":%s\"", imp.name))
+		names = append(names, imp.name)
+	}
+
+	// Wire up the library targets of directly referenced store paths and of
+	// the pkg-config modules the package requires
+	var refDeps []string
+	refPaths := append([]string{}, p.requires...)
+	for _, ref := range node.References {
+		refPaths = appendUnique(refPaths, nixStoreDir+"/"+path.Base(ref))
+	}
+	for _, refPath := range refPaths {
+		if refPath == storePath {
+			continue
+		}
+		if name, _ := parseStoreName(refPath); ccSystemLibraries[name] {
+			continue
+		}
+		if refPkg, ok := plan[refPath]; ok && refPkg.hasTarget() {
+			refDeps = append(refDeps, fmt.Sprintf("\"//%s:cc\"", path.Base(refPath)))
+		}
+	}
+	sort.Strings(refDeps)
+	deps = append(deps, refDeps...)
+
+	fmt.Fprintf(file, "cc_library(\n")
+	fmt.Fprintf(file, "    name = \"cc\",\n")
+	if len(p.hdrs) > 0 {
+		fmt.Fprintf(file, "    hdrs = [\n")
+		for _, hdr := range p.hdrs {
+			fmt.Fprintf(file, "        \":%s\",\n", hdr)
+		}
+		fmt.Fprintf(file, "    ],\n")
+	}
+	includes := p.flags.includes
+	if len(p.hdrs) > 0 {
+		includes = append([]string{"include"}, includes...)
+	}
+	if len(includes) > 0 {
+		fmt.Fprintf(file, "    includes = %s,\n", starlarkList(includes))
+	}
+	if len(p.flags.defines) > 0 {
+		fmt.Fprintf(file, "    defines = %s,\n", starlarkList(p.flags.defines))
+	}
+	if len(p.flags.linkopts) > 0 {
+		fmt.Fprintf(file, "    linkopts = %s,\n", starlarkList(p.flags.linkopts))
+	}
+	if len(deps) > 0 {
+		fmt.Fprintf(file, "    deps = [%s],\n", strings.Join(deps, ", "))
+	}
+	fmt.Fprintf(file, ")\n\n")
+	names = append(names, "cc")
+
+	return names
+}
+
+// starlarkList formats values as a Starlark list of strings.
+func starlarkList(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = strconv.Quote(v)
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
@@ -0,0 +1,182 @@
+package nixbazel
+
+import (
+	"io"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPlanCcPackages(t *testing.T) {
+	const (
+		zlib    = "/nix/store/00xpncfcvafhr6vx9q05hkhazm70zw5g-zlib-1.3.1"
+		zlibDev = "/nix/store/01ddsmlfxa22al7yxasdj8rvm72b275m-zlib-1.3.1-dev"
+		glibc   = "/nix/store/xx7cm72qy2c0643cm1ipngd87aqwkcdp-glibc-2.40-66"
+	)
+	lock := Lockfile{
+		Packages: map[string]ClosureNode{
+			zlib:    {NarHash: "aa", References: []string{"xx7cm72qy2c0643cm1ipngd87aqwkcdp-glibc-2.40-66"}},
+			zlibDev: {NarHash: "bb", References: []string{"00xpncfcvafhr6vx9q05hkhazm70zw5g-zlib-1.3.1"}},
+			glibc:   {NarHash: "cc"},
+		},
+	}
+	manifests := Manifests{
+		"aa": {StorePath: zlib, Entries: []ManifestEntry{
+			{Path: "", Type: EntryDirectory},
+			{Path: "lib", Type: EntryDirectory},
+			{Path: "lib/libz.so.1", Type: EntrySymlink, Target: "libz.so.1.3.1"},
+			{Path: "lib/libz.so.1.3.1", Type: EntryRegular, Executable: true, Size: 100},
+		}},
+		"bb": {StorePath: zlibDev, Entries: []ManifestEntry{
+			{Path: "", Type: EntryDirectory},
+			{Path: "include", Type: EntryDirectory},
+			{Path: "include/zconf.h", Type: EntryRegular, Size: 10},
+			{Path: "include/zlib.h", Type: EntryRegular, Size: 10},
+			{Path: "lib", Type: EntryDirectory},
+			{Path: "lib/libz.a", Type: EntryRegular, Size: 10},
+			{Path: "lib/libz.so", Type: EntrySymlink, Target: zlib + "/lib/libz.so.1"},
+		}},
+	}
+
+	plan := planCcPackages(lock, manifests, io.Discard)
+
+	dev, ok := plan[zlibDev]
+	if !ok || !dev.hasTarget() {
+		t.Fatalf("expected a cc target for %s", zlibDev)
+	}
+	if len(dev.hdrs) != 2 {
+		t.Errorf("hdrs = %v, expected 2 headers", dev.hdrs)
+	}
+	if len(dev.imports) != 1 {
+		t.Fatalf("imports = %+v, expected one library", dev.imports)
+	}
+	imp := dev.imports[0]
+	// The shared library is imported by its SONAME, the name binaries
+	// linked against it load at runtime
+	if imp.name != "cc_libz" || imp.shared != "lib/libz.so.1" || imp.static != "lib/libz.a" {
+		t.Errorf("import = %+v", imp)
+	}
+	if got, want := dev.links["lib/libz.so.1"], "//00xpncfcvafhr6vx9q05hkhazm70zw5g-zlib-1.3.1:lib/libz.so.1.3.1"; got != want {
+		t.Errorf("links[lib/libz.so.1] = %q, expected %q", got, want)
+	}
+
+	out, ok := plan[zlib]
+	if !ok || !out.outs["lib/libz.so.1.3.1"] {
+		t.Errorf("expected %s to extract lib/libz.so.1.3.1", zlib)
+	}
+
+	if _, ok := plan[glibc]; ok {
+		t.Errorf("package without manifest should not be planned")
+	}
+}
+
+// glib's glibconfig.h is in lib/ of the glib output, which its .pc file in
+// the dev output points at.
+func TestPlanCcPackagesExternalInclude(t *testing.T) {
+	const (
+		glib    = "/nix/store/00xpncfcvafhr6vx9q05hkhazm70zw5g-glib-2.84.0"
+		glibDev = "/nix/store/01ddsmlfxa22al7yxasdj8rvm72b275m-glib-2.84.0-dev"
+	)
+	lock := Lockfile{
+		Packages: map[string]ClosureNode{
+			glib:    {NarHash: "aa"},
+			glibDev: {NarHash: "bb", References: []string{path.Base(glib)}},
+		},
+	}
+	manifests := Manifests{
+		"aa": {StorePath: glib, Entries: []ManifestEntry{
+			{Path: "", Type: EntryDirectory},
+			{Path: "lib", Type: EntryDirectory},
+			{Path: "lib/glib-2.0", Type: EntryDirectory},
+			{Path: "lib/glib-2.0/include", Type: EntryDirectory},
+			{Path: "lib/glib-2.0/include/glibconfig.h", Type: EntryRegular, Size: 10},
+		}},
+		"bb": {StorePath: glibDev, Entries: []ManifestEntry{
+			{Path: "", Type: EntryDirectory},
+			{Path: "include", Type: EntryDirectory},
+			{Path: "include/glib-2.0", Type: EntryDirectory},
+			{Path: "include/glib-2.0/glib.h", Type: EntryRegular, Size: 10},
+			{Path: "lib", Type: EntryDirectory},
+			{Path: "lib/pkgconfig", Type: EntryDirectory},
+			{Path: "lib/pkgconfig/glib-2.0.pc", Type: EntryRegular, Size: 100},
+		}, PkgConfig: map[string]string{
+			"lib/pkgconfig/glib-2.0.pc": "prefix=" + glibDev + "\nlibdir=" + glib + "/lib\nincludedir=${prefix}/include\n" +
+				"Name: GLib\nCflags: -I${includedir}/glib-2.0 -I${libdir}/glib-2.0/include -I/nix/store/02ddsmlfxa22al7yxasdj8rvm72b275m-missing/include\n",
+		}},
+	}
+
+	var warnings strings.Builder
+	plan := planCcPackages(lock, manifests, &warnings)
+
+	out := plan[glib]
+	if out == nil || !reflect.DeepEqual(out.hdrs, []string{"lib/glib-2.0/include/glibconfig.h"}) {
+		t.Fatalf("expected %s to export glibconfig.h, got %+v", glib, out)
+	}
+	if got, want := out.flags.includes, []string{"lib/glib-2.0/include"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("includes of %s = %q, expected %q", glib, got, want)
+	}
+	if got, want := plan[glibDev].requires, []string{glib}; !reflect.DeepEqual(got, want) {
+		t.Errorf("requires of %s = %q, expected %q", glibDev, got, want)
+	}
+	if got, want := plan[glibDev].flags.includes, []string{"include/glib-2.0"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("includes of %s = %q, expected %q", glibDev, got, want)
+	}
+	// Directories that cannot be mapped are reported, not silently dropped
+	if !strings.Contains(warnings.String(), "02ddsmlfxa22al7yxasdj8rvm72b275m-missing/include") {
+		t.Errorf("expected a warning about the unknown include directory, got %q", warnings.String())
+	}
+}
+
+func TestIsValidLabelName(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{"include/zlib.h", true},
+		{"lib/libstdc++.so", true},
+		{"include/../etc/passwd", false},
+		{"include/with space.h", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		if result := isValidLabelName(test.input); result != test.expected {
+			t.Errorf("isValidLabelName(%q) = %v, expected %v", test.input, result, test.expected)
+		}
+	}
+}
+
+func TestSharedLibrarySoname(t *testing.T) {
+	const store = "/nix/store/00xpncfcvafhr6vx9q05hkhazm70zw5g-libs-1.0"
+	byPath := map[string]*Manifest{store: {StorePath: store, Entries: []ManifestEntry{
+		{Path: "", Type: EntryDirectory},
+		{Path: "lib", Type: EntryDirectory},
+		// A same-named file that is not the library is not its SONAME
+		{Path: "lib/libfoo.so", Type: EntryRegular, Size: 100},
+		{Path: "lib/libfoo.so.2", Type: EntryRegular, Size: 100},
+		// The real file is named by the SONAME
+		{Path: "lib/libpython3.12.so", Type: EntrySymlink, Target: "libpython3.12.so.1.0"},
+		{Path: "lib/libpython3.12.so.1.0", Type: EntryRegular, Size: 100},
+		// The development link points straight at the real file
+		{Path: "lib/libz.so", Type: EntrySymlink, Target: "libz.so.1.3.1"},
+		{Path: "lib/libz.so.1", Type: EntrySymlink, Target: "libz.so.1.3.1"},
+		{Path: "lib/libz.so.1.3.1", Type: EntryRegular, Size: 100},
+	}}}
+
+	tests := []struct {
+		rel      string
+		lib      string
+		expected string
+	}{
+		{"lib/libz.so", "z", "libz.so.1"},
+		{"lib/libpython3.12.so", "python3.12", "libpython3.12.so.1.0"},
+		{"lib/libfoo.so", "foo", ""},
+	}
+
+	for _, test := range tests {
+		if result := sharedLibrarySoname(byPath, store, test.rel, test.lib); result != test.expected {
+			t.Errorf("sharedLibrarySoname(%q) = %q, expected %q", test.rel, result, test.expected)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package nixbazel
+
+import (
+	"path"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// runtimeCriticalPackages are the packages every binary of a closure loads
+// from the same store path: glibc (with the ld-linux loader), and GCC's
+// libgcc_s and libstdc++. Mixing two of them in one nix_root tree breaks.
+var runtimeCriticalPackages = []string{"glibc", "gcc-lib", "gcc-libgcc", "libgcc", "xgcc-libgcc"}
+
+// Inconsistency is a package that repositories' closures have in more than
+// one store path.
+type Inconsistency struct {
+	Package  string           `json:"package"` // Name and output, e.g. gcc-lib
+	Variants []PackageVariant `json:"variants"`
+}
+
+// PackageVariant is one store path of an inconsistent package.
+type PackageVariant struct {
+	StorePath    string   `json:"storePath"`
+	Version      string   `json:"version"`
+	Repositories []string `json:"repositories"`
+}
+
+// Repositories returns every repository using a variant of the package.
+func (i Inconsistency) Repositories() []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, v := range i.Variants {
+		for _, name := range v.Repositories {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// packageKey returns the name and output of a store path, e.g. "gcc-lib"
+// for gcc-14.3.0-lib and "glibc" for glibc-2.40-66, with its version
+// without the output.
+func packageKey(storePath string) (key, version string) {
+	name, version := parseStoreName(storePath)
+	if i := strings.LastIndex(version, "-"); i >= 0 && i+1 < len(version) && unicode.IsLetter(rune(version[i+1])) {
+		return name + version[i:], version[:i]
+	}
+	return name, version
+}
+
+// CheckConsistency returns the packages that the closures of lock's
+// repositories have in more than one store path, e.g. two glibcs. Only the
+// given packages (name and output, as in "gcc-lib") are checked, or
+// glibc, libgcc and libstdc++ if packages is empty; with all, every package
+// is. The result is sorted by package.
+func CheckConsistency(lock *Lockfile, packages []string, all bool) []Inconsistency {
+	if len(packages) == 0 {
+		packages = runtimeCriticalPackages
+	}
+	checked := make(map[string]bool)
+	for _, p := range packages {
+		checked[p] = true
+	}
+
+	// package -> store path -> repositories
+	variants := make(map[string]map[string][]string)
+	for name, repo := range lock.Repositories {
+		closure := append([]string{repo.StorePath}, getTransitiveClosure(repo.StorePath, lock.Packages)...)
+		for _, storePath := range closure {
+			key, _ := packageKey(storePath)
+			if !all && !checked[key] {
+				continue
+			}
+			if variants[key] == nil {
+				variants[key] = make(map[string][]string)
+			}
+			variants[key][storePath] = append(variants[key][storePath], name)
+		}
+	}
+
+	var result []Inconsistency
+	for key, storePaths := range variants {
+		if len(storePaths) < 2 {
+			continue
+		}
+		inconsistency := Inconsistency{Package: key}
+		for storePath, repos := range storePaths {
+			_, version := packageKey(storePath)
+			sort.Strings(repos)
+			inconsistency.Variants = append(inconsistency.Variants, PackageVariant{
+				StorePath:    storePath,
+				Version:      version,
+				Repositories: repos,
+			})
+		}
+		sort.Slice(inconsistency.Variants, func(i, j int) bool {
+			a, b := inconsistency.Variants[i], inconsistency.Variants[j]
+			if c := compareVersions(a.Version, b.Version); c != 0 {
+				return c > 0
+			}
+			return path.Base(a.StorePath) < path.Base(b.StorePath)
+		})
+		result = append(result, inconsistency)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Package < result[j].Package })
+	return result
+}
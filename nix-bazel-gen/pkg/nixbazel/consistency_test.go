@@ -0,0 +1,136 @@
+package nixbazel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestPackageKey(t *testing.T) {
+	tests := []struct {
+		storePath, key, version string
+	}{
+		{testLibcPath, "glibc", "2.40-66"},
+		{testGraphPath("h", "gcc-14.3.0-lib"), "gcc-lib", "14.3.0"},
+		{testGraphPath("h", "xgcc-14.3.0-libgcc"), "xgcc-libgcc", "14.3.0"},
+		{testGraphPath("h", "glibc-2.40-66-bin"), "glibc-bin", "2.40-66"},
+	}
+	for _, test := range tests {
+		if key, version := packageKey(test.storePath); key != test.key || version != test.version {
+			t.Errorf("packageKey(%q) = %q, %q, expected %q, %q", test.storePath, key, version, test.key, test.version)
+		}
+	}
+}
+
+func TestCheckConsistency(t *testing.T) {
+	lock := testGraphLockfile()
+	if got := CheckConsistency(lock, nil, false); len(got) != 0 {
+		t.Errorf("CheckConsistency() = %+v, expected none", got)
+	}
+
+	// zlib resolved later against a newer glibc
+	newLibc := testGraphPath("h", "glibc-2.40-218")
+	lock.Packages[newLibc] = ClosureNode{NarHash: testHelloHash, References: []string{}}
+	zlib := lock.Packages[testZlibPath]
+	zlib.References = []string{path.Base(newLibc)}
+	lock.Packages[testZlibPath] = zlib
+
+	expected := []Inconsistency{{
+		Package: "glibc",
+		Variants: []PackageVariant{
+			{StorePath: newLibc, Version: "2.40-218", Repositories: []string{"zlib"}},
+			{StorePath: testLibcPath, Version: "2.40-66", Repositories: []string{"imagemagick"}},
+		},
+	}}
+	got := CheckConsistency(lock, nil, false)
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("CheckConsistency() = %+v, expected %+v", got, expected)
+	}
+	if repos := got[0].Repositories(); !reflect.DeepEqual(repos, []string{"imagemagick", "zlib"}) {
+		t.Errorf("Repositories() = %q, expected imagemagick and zlib", repos)
+	}
+	if got := CheckConsistency(lock, []string{"llvm"}, false); len(got) != 0 {
+		t.Errorf("CheckConsistency(llvm) = %+v, expected none", got)
+	}
+	if got := CheckConsistency(lock, []string{"llvm"}, true); len(got) != 1 {
+		t.Errorf("CheckConsistency(all) = %+v, expected glibc", got)
+	}
+}
+
+func TestResolveHydraSingleEval(t *testing.T) {
+	built := func(id int, path string) string {
+		return fmt.Sprintf(`{"id": %d, "finished": 1, "buildstatus": 0, "buildoutputs": {"out": {"path": "%s"}}}`, id, path)
+	}
+	evalRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path + "?" + r.URL.RawQuery {
+		case "/jobset/nixpkgs/trunk/evals?":
+			evalRequests++
+			w.Write([]byte(`{"evals": [{"id": 44}, {"id": 43}], "next": "?page=2"}`))
+		case "/jobset/nixpkgs/trunk/evals?page=2":
+			w.Write([]byte(`{"evals": [{"id": 42}, {"id": 41}]}`))
+		// 44 is still building hello, 43 failed glibc
+		case "/eval/44/job/hello.x86_64-linux?":
+			w.Write([]byte(`{"id": 4, "finished": 0, "buildstatus": null, "buildoutputs": {"out": {"path": "/nix/store/unbuilt-hello"}}}`))
+		case "/eval/44/job/glibc.x86_64-linux?", "/eval/43/job/hello.x86_64-linux?":
+			w.Write([]byte(built(3, "/nix/store/newer")))
+		case "/eval/43/job/glibc.x86_64-linux?":
+			w.Write([]byte(`{"id": 2, "finished": 1, "buildstatus": 1, "buildoutputs": {"out": {"path": "/nix/store/failed-glibc"}}}`))
+		case "/eval/42/job/hello.x86_64-linux?":
+			w.Write([]byte(built(1, testHelloPath)))
+		case "/eval/42/job/glibc.x86_64-linux?":
+			w.Write([]byte(built(0, testGlibcPath)))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	f := NewFetcher(server.URL, "")
+	f.hydraURL = server.URL
+	f.hydraEvals = make(map[string]int64)
+	// nixos.tests is in another jobset, so evaluations without it qualify
+	f.hydraJobs = []string{"nixpkgs.glibc.x86_64-linux", "nixpkgs.hello.x86_64-linux", "nixos.tests.x86_64-linux"}
+	for pkg, expected := range map[string]string{
+		"nixpkgs.hello.x86_64-linux": testHelloPath,
+		"nixpkgs.glibc.x86_64-linux": testGlibcPath,
+	} {
+		storePath, err := f.resolveHydra(context.Background(), pkg, "nixpkgs/trunk")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if storePath != expected {
+			t.Errorf("resolveHydra(%q) = %q, expected %q", pkg, storePath, expected)
+		}
+	}
+	if evalRequests != 1 {
+		t.Errorf("evals were listed %d times, expected once", evalRequests)
+	}
+	if id := f.hydraEvals["nixpkgs/trunk"]; id != 42 {
+		t.Errorf("picked evaluation %d, expected 42", id)
+	}
+}
+
+func TestHydraBuildOutputNotBuilt(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/unfinished":
+			w.Write([]byte(`{"id": 1, "finished": 0, "buildstatus": null, "buildoutputs": {"out": {"path": "` + testHelloPath + `"}}}`))
+		case "/failed":
+			w.Write([]byte(`{"id": 2, "finished": 1, "buildstatus": 3, "buildoutputs": {"out": {"path": "` + testHelloPath + `"}}}`))
+		}
+	}))
+	defer server.Close()
+
+	f := NewFetcher(server.URL, "")
+	for _, p := range []string{"/unfinished", "/failed"} {
+		if _, err := f.hydraBuildOutput(context.Background(), server.URL+p); !errors.Is(err, errHydraNotBuilt) {
+			t.Errorf("hydraBuildOutput(%q) error = %v, expected not built", p, err)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package nixbazel
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+)
+
+// DedupReport summarises a deduplication pass.
+type DedupReport struct {
+	FilesScanned int
+	FilesLinked  int
+	BytesSaved   int64
+}
+
+// dedupKey identifies files that can share an inode: hard links share the
+// mode, so it must match along with the contents.
+type dedupKey struct {
+	sum  [sha256.Size]byte
+	mode fs.FileMode
+}
+
+// SetDedup makes UnpackAll and FetchAllFromLock hardlink identical read-only
+// files across the packages they unpack.
+func (f *Fetcher) SetDedup(dedup bool) {
+	f.dedup = dedup
+}
+
+// dedupStorePaths deduplicates the given store paths unpacked in f.outDir
+// and prints the bytes saved.
+func (f *Fetcher) dedupStorePaths(storePaths []string) error {
+	roots := make([]string, 0, len(storePaths))
+	for _, storePath := range storePaths {
+		roots = append(roots, filepath.Join(f.outDir, filepath.Base(storePath)))
+	}
+	sort.Strings(roots)
+	report, err := DedupTrees(roots)
+	if err != nil {
+		return fmt.Errorf("failed to deduplicate %s: %w", f.outDir, err)
+	}
+	fmt.Fprintf(f.progress, "Deduplicated %d of %d read-only files in %s, saving %d bytes\n", report.FilesLinked, report.FilesScanned, f.outDir, report.BytesSaved)
+	return nil
+}
+
+// DedupTrees replaces identical read-only regular files below roots with
+// hard links to a single copy, like nix-store --optimise. Writable files are
+// left alone, since a later write through one link would change every copy.
+func DedupTrees(roots []string) (*DedupReport, error) {
+	report := &DedupReport{}
+	seen := make(map[dedupKey]string)
+	for _, root := range roots {
+		if err := dedupTree(root, seen, report); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+func dedupTree(root string, seen map[dedupKey]string, report *DedupReport) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.Mode().Perm()&0222 != 0 || info.Size() == 0 {
+			return nil
+		}
+		report.FilesScanned++
+
+		sum, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		key := dedupKey{sum: sum, mode: info.Mode().Perm()}
+		first, ok := seen[key]
+		if !ok {
+			seen[key] = path
+			return nil
+		}
+		firstInfo, err := os.Stat(first)
+		if err != nil {
+			return err
+		}
+		if os.SameFile(firstInfo, info) {
+			return nil
+		}
+
+		err = replaceWithLink(first, path)
+		if errors.Is(err, syscall.EMLINK) {
+			// Too many links to the first copy: start a new one
+			seen[key] = path
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to link %s to %s: %w", path, first, err)
+		}
+		report.FilesLinked++
+		report.BytesSaved += info.Size()
+		return nil
+	})
+}
+
+// hashFile returns the sha256 of the file at path.
+func hashFile(path string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	file, err := os.Open(path)
+	if err != nil {
+		return sum, err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// replaceWithLink atomically replaces path with a hard link to target.
+func replaceWithLink(target, path string) error {
+	dir := filepath.Dir(path)
+	return withWritableDir(dir, func() error {
+		tmp := filepath.Join(dir, ".dedup-"+filepath.Base(path))
+		if err := os.Link(target, tmp); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		return nil
+	})
+}
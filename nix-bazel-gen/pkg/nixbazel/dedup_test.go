@@ -0,0 +1,70 @@
+package nixbazel
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDedupTrees(t *testing.T) {
+	dir := t.TempDir()
+	files := []struct {
+		path    string
+		content string
+		mode    os.FileMode
+	}{
+		{"a-python/lib/LICENSE", "same license", 0444},
+		{"b-imagemagick/share/LICENSE", "same license", 0444},
+		{"c-zlib/share/LICENSE", "same license", 0444},
+		{"c-zlib/bin/tool", "same license", 0555}, // Different mode
+		{"d-writable/LICENSE", "same license", 0644},
+		{"d-writable/other", "other", 0444},
+	}
+	for _, f := range files {
+		path := filepath.Join(dir, f.path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(f.content), f.mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	roots := []string{
+		filepath.Join(dir, "a-python"),
+		filepath.Join(dir, "b-imagemagick"),
+		filepath.Join(dir, "c-zlib"),
+		filepath.Join(dir, "d-writable"),
+	}
+	report, err := DedupTrees(roots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.FilesLinked != 2 || report.BytesSaved != int64(2*len("same license")) {
+		t.Errorf("report = %+v, expected 2 files linked", report)
+	}
+
+	stat := func(p string) os.FileInfo {
+		info, err := os.Stat(filepath.Join(dir, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+	first := stat("a-python/lib/LICENSE")
+	for _, p := range []string{"b-imagemagick/share/LICENSE", "c-zlib/share/LICENSE"} {
+		if !os.SameFile(first, stat(p)) {
+			t.Errorf("%s is not linked to a-python/lib/LICENSE", p)
+		}
+	}
+	for _, p := range []string{"c-zlib/bin/tool", "d-writable/LICENSE"} {
+		if os.SameFile(first, stat(p)) {
+			t.Errorf("%s should not be linked", p)
+		}
+	}
+
+	// A second pass finds nothing new
+	if report, err := DedupTrees(roots); err != nil || report.FilesLinked != 0 {
+		t.Errorf("second pass = %+v, %v", report, err)
+	}
+}
@@ -0,0 +1,77 @@
+package nixbazel
+
+import (
+	"sort"
+)
+
+// LockfileDiff is the difference between two lockfiles.
+type LockfileDiff struct {
+	Repositories []RepositoryChange `json:"repositories"`
+	// Store paths only in the new lockfile, only in the old one, and in both
+	// with different contents (NarHash) or download (URL, FileHash).
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Changed []string `json:"changed"`
+	// Change in the total NarSize and FileSize of all packages, in bytes
+	NarSizeDelta  int64 `json:"narSizeDelta"`
+	FileSizeDelta int64 `json:"fileSizeDelta"`
+}
+
+// RepositoryChange is a repository whose store path was added, removed or
+// changed.
+type RepositoryChange struct {
+	Name string `json:"name"`
+	Old  string `json:"old,omitempty"` // Empty if added
+	New  string `json:"new,omitempty"` // Empty if removed
+}
+
+// DiffLockfiles compares two lockfiles. Lists are sorted.
+func DiffLockfiles(old, new *Lockfile) *LockfileDiff {
+	diff := &LockfileDiff{
+		Repositories: []RepositoryChange{},
+		Added:        []string{},
+		Removed:      []string{},
+		Changed:      []string{},
+	}
+
+	names := make(map[string]bool)
+	for name := range old.Repositories {
+		names[name] = true
+	}
+	for name := range new.Repositories {
+		names[name] = true
+	}
+	for name := range names {
+		oldPath := old.Repositories[name].StorePath
+		newPath := new.Repositories[name].StorePath
+		if oldPath != newPath {
+			diff.Repositories = append(diff.Repositories, RepositoryChange{Name: name, Old: oldPath, New: newPath})
+		}
+	}
+	sort.Slice(diff.Repositories, func(i, j int) bool {
+		return diff.Repositories[i].Name < diff.Repositories[j].Name
+	})
+
+	for storePath, node := range new.Packages {
+		oldNode, ok := old.Packages[storePath]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, storePath)
+		case oldNode.NarHash != node.NarHash || oldNode.URL != node.URL || oldNode.FileHash != node.FileHash:
+			diff.Changed = append(diff.Changed, storePath)
+		}
+		diff.NarSizeDelta += node.NarSize
+		diff.FileSizeDelta += node.FileSize
+	}
+	for storePath, node := range old.Packages {
+		if _, ok := new.Packages[storePath]; !ok {
+			diff.Removed = append(diff.Removed, storePath)
+		}
+		diff.NarSizeDelta -= node.NarSize
+		diff.FileSizeDelta -= node.FileSize
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Changed)
+	return diff
+}
@@ -0,0 +1,50 @@
+package nixbazel
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffLockfiles(t *testing.T) {
+	old := &Lockfile{
+		Repositories: map[string]RepositoryLock{
+			"hello": {StorePath: testHelloPath},
+			"gone":  {StorePath: "/nix/store/00000000000000000000000000000000-gone"},
+		},
+		Packages: map[string]ClosureNode{
+			testHelloPath: {NarHash: testHelloHash, NarSize: 100, FileSize: 50},
+			testGlibcPath: {NarHash: testGlibcHash, NarSize: 1000, FileSize: 500},
+			"/nix/store/00000000000000000000000000000000-gone": {NarSize: 10, FileSize: 5},
+		},
+	}
+	new := &Lockfile{
+		Repositories: map[string]RepositoryLock{
+			"hello": {StorePath: testHelloPath},
+			"glibc": {StorePath: testGlibcPath},
+		},
+		Packages: map[string]ClosureNode{
+			testHelloPath: {NarHash: testHelloHash, NarSize: 100, FileSize: 50},
+			testGlibcPath: {NarHash: testHelloHash, NarSize: 1200, FileSize: 600},
+			"/nix/store/11111111111111111111111111111111-new": {NarSize: 30, FileSize: 20},
+		},
+	}
+
+	expected := &LockfileDiff{
+		Repositories: []RepositoryChange{
+			{Name: "glibc", New: testGlibcPath},
+			{Name: "gone", Old: "/nix/store/00000000000000000000000000000000-gone"},
+		},
+		Added:         []string{"/nix/store/11111111111111111111111111111111-new"},
+		Removed:       []string{"/nix/store/00000000000000000000000000000000-gone"},
+		Changed:       []string{testGlibcPath},
+		NarSizeDelta:  220,
+		FileSizeDelta: 115,
+	}
+	if diff := DiffLockfiles(old, new); !reflect.DeepEqual(diff, expected) {
+		t.Errorf("DiffLockfiles() = %+v, expected %+v", diff, expected)
+	}
+
+	if diff := DiffLockfiles(new, new); len(diff.Repositories)+len(diff.Added)+len(diff.Removed)+len(diff.Changed) != 0 {
+		t.Errorf("DiffLockfiles(new, new) = %+v, expected no changes", diff)
+	}
+}
@@ -0,0 +1,600 @@
+package nixbazel
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// ElfPatch describes changes to apply to an ELF file.
+type ElfPatch struct {
+	// Interpreter replaces PT_INTERP if non-empty. Files without PT_INTERP
+	// (shared libraries, static binaries) are left alone.
+	Interpreter string
+	// RunPath replaces DT_RUNPATH (or DT_RPATH if that is what the file
+	// uses) when SetRunPath is true. A DT_RUNPATH entry is added to dynamic
+	// objects that have neither.
+	RunPath    string
+	SetRunPath bool
+}
+
+// ErrNotELF is returned by PatchELF for files that are not ELF objects.
+var ErrNotELF = errors.New("not an ELF file")
+
+// ErrNoNoteSegment is returned by PatchELF for files that need a new segment
+// but have no PT_NOTE program header to map it with. PatchELFTree and
+// RelocateTree skip such files with a warning.
+var ErrNoNoteSegment = errors.New("no PT_NOTE program header to reuse for the new segment")
+
+// isELF reports whether the file at path starts with the ELF magic.
+func isELF(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	var magic [4]byte
+	if _, err := file.Read(magic[:]); err != nil {
+		return false
+	}
+	return string(magic[:]) == elf.ELFMAG
+}
+
+// PatchELF applies patch to the ELF file at path, rewriting it in place. It
+// reports whether the file was changed.
+func PatchELF(path string, patch ElfPatch) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	ef, err := parseElfFile(data)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", path, err)
+	}
+	changed, err := ef.apply(patch)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", path, err)
+	}
+	if !changed {
+		return false, nil
+	}
+
+	if err := rewriteFile(path, ef.data); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// rewriteFile replaces the contents of an existing file, keeping its mode.
+func rewriteFile(path string, data []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	// The file may be read-only, as in the Nix store
+	if info.Mode().Perm()&0200 == 0 {
+		if err := os.Chmod(path, info.Mode().Perm()|0200); err != nil {
+			return err
+		}
+		defer os.Chmod(path, info.Mode().Perm())
+	}
+	return os.WriteFile(path, data, info.Mode().Perm())
+}
+
+// PatchELFTree applies patch to every ELF file below root and returns the
+// number of files changed.
+func PatchELFTree(root string, patch ElfPatch, progress io.Writer) (int, error) {
+	patched := 0
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || !isELF(path) {
+			return nil
+		}
+		changed, err := PatchELF(path, patch)
+		if errors.Is(err, ErrNotELF) {
+			return nil
+		}
+		if errors.Is(err, ErrNoNoteSegment) {
+			fmt.Fprintf(progress, "Warning: not patching %v\n", err)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if changed {
+			patched++
+		}
+		return nil
+	})
+	return patched, err
+}
+
+// elfProg is a program header, independent of the ELF class.
+type elfProg struct {
+	Type   elf.ProgType
+	Flags  elf.ProgFlag
+	Off    uint64
+	Vaddr  uint64
+	Paddr  uint64
+	Filesz uint64
+	Memsz  uint64
+	Align  uint64
+}
+
+// elfDyn is a dynamic section entry.
+type elfDyn struct {
+	Tag elf.DynTag
+	Val uint64
+}
+
+// elfFile is a minimal ELF reader/writer operating on the raw bytes. Only
+// the program headers, the dynamic section and the section headers of the
+// moved sections are rewritten; everything else stays byte-for-byte intact.
+type elfFile struct {
+	data  []byte
+	class elf.Class
+	order binary.ByteOrder
+	progs []elfProg
+
+	phoff     uint64
+	phentsize uint64
+	shoff     uint64
+	shentsize uint64
+	shnum     uint64
+	shstrndx  uint64
+}
+
+func parseElfFile(data []byte) (*elfFile, error) {
+	if len(data) < elf.EI_NIDENT || string(data[:4]) != elf.ELFMAG {
+		return nil, ErrNotELF
+	}
+	ef := &elfFile{data: data, class: elf.Class(data[elf.EI_CLASS])}
+	switch elf.Data(data[elf.EI_DATA]) {
+	case elf.ELFDATA2LSB:
+		ef.order = binary.LittleEndian
+	case elf.ELFDATA2MSB:
+		ef.order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("unknown ELF data encoding %d", data[elf.EI_DATA])
+	}
+
+	var phnum uint64
+	switch ef.class {
+	case elf.ELFCLASS64:
+		if len(data) < 64 {
+			return nil, fmt.Errorf("truncated ELF header")
+		}
+		ef.phoff = ef.order.Uint64(data[32:])
+		ef.shoff = ef.order.Uint64(data[40:])
+		ef.phentsize = uint64(ef.order.Uint16(data[54:]))
+		phnum = uint64(ef.order.Uint16(data[56:]))
+		ef.shentsize = uint64(ef.order.Uint16(data[58:]))
+		ef.shnum = uint64(ef.order.Uint16(data[60:]))
+		ef.shstrndx = uint64(ef.order.Uint16(data[62:]))
+	case elf.ELFCLASS32:
+		if len(data) < 52 {
+			return nil, fmt.Errorf("truncated ELF header")
+		}
+		ef.phoff = uint64(ef.order.Uint32(data[28:]))
+		ef.shoff = uint64(ef.order.Uint32(data[32:]))
+		ef.phentsize = uint64(ef.order.Uint16(data[42:]))
+		phnum = uint64(ef.order.Uint16(data[44:]))
+		ef.shentsize = uint64(ef.order.Uint16(data[46:]))
+		ef.shnum = uint64(ef.order.Uint16(data[48:]))
+		ef.shstrndx = uint64(ef.order.Uint16(data[50:]))
+	default:
+		return nil, fmt.Errorf("unknown ELF class %d", ef.class)
+	}
+
+	// Both are 16-bit, so the product cannot overflow
+	size := uint64(len(data))
+	if ef.phentsize < ef.progSize() {
+		return nil, fmt.Errorf("program header size %d too small", ef.phentsize)
+	}
+	if ef.phoff > size || phnum*ef.phentsize > size-ef.phoff {
+		return nil, fmt.Errorf("program headers out of range")
+	}
+	for i := uint64(0); i < phnum; i++ {
+		ef.progs = append(ef.progs, ef.readProg(data[ef.phoff+i*ef.phentsize:]))
+	}
+	for _, p := range ef.progs {
+		if p.Type != elf.PT_NULL && p.Filesz > 0 && (p.Off > size || p.Filesz > size-p.Off) {
+			return nil, fmt.Errorf("segment %v out of range", p.Type)
+		}
+	}
+	return ef, nil
+}
+
+// progSize is the size of a program header of the file's class.
+func (ef *elfFile) progSize() uint64 {
+	if ef.class == elf.ELFCLASS64 {
+		return 56
+	}
+	return 32
+}
+
+func (ef *elfFile) readProg(b []byte) elfProg {
+	o := ef.order
+	if ef.class == elf.ELFCLASS64 {
+		return elfProg{
+			Type:   elf.ProgType(o.Uint32(b[0:])),
+			Flags:  elf.ProgFlag(o.Uint32(b[4:])),
+			Off:    o.Uint64(b[8:]),
+			Vaddr:  o.Uint64(b[16:]),
+			Paddr:  o.Uint64(b[24:]),
+			Filesz: o.Uint64(b[32:]),
+			Memsz:  o.Uint64(b[40:]),
+			Align:  o.Uint64(b[48:]),
+		}
+	}
+	return elfProg{
+		Type:   elf.ProgType(o.Uint32(b[0:])),
+		Off:    uint64(o.Uint32(b[4:])),
+		Vaddr:  uint64(o.Uint32(b[8:])),
+		Paddr:  uint64(o.Uint32(b[12:])),
+		Filesz: uint64(o.Uint32(b[16:])),
+		Memsz:  uint64(o.Uint32(b[20:])),
+		Flags:  elf.ProgFlag(o.Uint32(b[24:])),
+		Align:  uint64(o.Uint32(b[28:])),
+	}
+}
+
+func (ef *elfFile) writeProgs() {
+	o := ef.order
+	for i, p := range ef.progs {
+		b := ef.data[ef.phoff+uint64(i)*ef.phentsize:]
+		if ef.class == elf.ELFCLASS64 {
+			o.PutUint32(b[0:], uint32(p.Type))
+			o.PutUint32(b[4:], uint32(p.Flags))
+			o.PutUint64(b[8:], p.Off)
+			o.PutUint64(b[16:], p.Vaddr)
+			o.PutUint64(b[24:], p.Paddr)
+			o.PutUint64(b[32:], p.Filesz)
+			o.PutUint64(b[40:], p.Memsz)
+			o.PutUint64(b[48:], p.Align)
+		} else {
+			o.PutUint32(b[0:], uint32(p.Type))
+			o.PutUint32(b[4:], uint32(p.Off))
+			o.PutUint32(b[8:], uint32(p.Vaddr))
+			o.PutUint32(b[12:], uint32(p.Paddr))
+			o.PutUint32(b[16:], uint32(p.Filesz))
+			o.PutUint32(b[20:], uint32(p.Memsz))
+			o.PutUint32(b[24:], uint32(p.Flags))
+			o.PutUint32(b[28:], uint32(p.Align))
+		}
+	}
+}
+
+func (ef *elfFile) dynEntrySize() uint64 {
+	if ef.class == elf.ELFCLASS64 {
+		return 16
+	}
+	return 8
+}
+
+func (ef *elfFile) prog(typ elf.ProgType) *elfProg {
+	for i := range ef.progs {
+		if ef.progs[i].Type == typ {
+			return &ef.progs[i]
+		}
+	}
+	return nil
+}
+
+// dynamic returns the entries of the dynamic section up to and including the
+// first DT_NULL, plus the number of slots in the section.
+func (ef *elfFile) dynamic() ([]elfDyn, int) {
+	p := ef.prog(elf.PT_DYNAMIC)
+	if p == nil {
+		return nil, 0
+	}
+	size := ef.dynEntrySize()
+	slots := int(p.Filesz / size)
+	var dyns []elfDyn
+	for i := 0; i < slots; i++ {
+		b := ef.data[p.Off+uint64(i)*size:]
+		var d elfDyn
+		if ef.class == elf.ELFCLASS64 {
+			d = elfDyn{elf.DynTag(ef.order.Uint64(b)), ef.order.Uint64(b[8:])}
+		} else {
+			d = elfDyn{elf.DynTag(int32(ef.order.Uint32(b))), uint64(ef.order.Uint32(b[4:]))}
+		}
+		dyns = append(dyns, d)
+		if d.Tag == elf.DT_NULL {
+			break
+		}
+	}
+	return dyns, slots
+}
+
+func (ef *elfFile) encodeDynamic(dyns []elfDyn) []byte {
+	size := ef.dynEntrySize()
+	b := make([]byte, uint64(len(dyns))*size)
+	for i, d := range dyns {
+		e := b[uint64(i)*size:]
+		if ef.class == elf.ELFCLASS64 {
+			ef.order.PutUint64(e, uint64(d.Tag))
+			ef.order.PutUint64(e[8:], d.Val)
+		} else {
+			ef.order.PutUint32(e, uint32(d.Tag))
+			ef.order.PutUint32(e[4:], uint32(d.Val))
+		}
+	}
+	return b
+}
+
+// vaddrToOffset maps a virtual address to a file offset via the PT_LOADs.
+func (ef *elfFile) vaddrToOffset(addr uint64) (uint64, bool) {
+	for _, p := range ef.progs {
+		if p.Type == elf.PT_LOAD && addr >= p.Vaddr && addr < p.Vaddr+p.Filesz {
+			return addr - p.Vaddr + p.Off, true
+		}
+	}
+	return 0, false
+}
+
+func dynValue(dyns []elfDyn, tag elf.DynTag) (uint64, int) {
+	for i, d := range dyns {
+		if d.Tag == tag {
+			return d.Val, i
+		}
+	}
+	return 0, -1
+}
+
+// cString reads a NUL-terminated string at off.
+func (ef *elfFile) cString(off uint64) string {
+	if off >= uint64(len(ef.data)) {
+		return ""
+	}
+	end := bytes.IndexByte(ef.data[off:], 0)
+	if end < 0 {
+		return string(ef.data[off:])
+	}
+	return string(ef.data[off : off+uint64(end)])
+}
+
+// overwriteString writes s over old in place, zeroing the rest of the old
+// string.
+func (ef *elfFile) overwriteString(off uint64, old, s string) {
+	copy(ef.data[off:], s)
+	for i := uint64(len(s)); i < uint64(len(old)); i++ {
+		ef.data[off+i] = 0
+	}
+}
+
+// Interpreter returns the PT_INTERP path, or "" if there is none.
+func (ef *elfFile) Interpreter() string {
+	if p := ef.prog(elf.PT_INTERP); p != nil {
+		return ef.cString(p.Off)
+	}
+	return ""
+}
+
+// RunPath returns DT_RUNPATH, or DT_RPATH if there is no DT_RUNPATH.
+func (ef *elfFile) RunPath() string {
+	dyns, _ := ef.dynamic()
+	strtab, _ := dynValue(dyns, elf.DT_STRTAB)
+	strOff, ok := ef.vaddrToOffset(strtab)
+	if !ok {
+		return ""
+	}
+	for _, tag := range []elf.DynTag{elf.DT_RUNPATH, elf.DT_RPATH} {
+		if val, i := dynValue(dyns, tag); i >= 0 {
+			return ef.cString(strOff + val)
+		}
+	}
+	return ""
+}
+
+// newSegment accumulates data appended to the file in a new PT_LOAD.
+type newSegment struct {
+	off   uint64
+	vaddr uint64
+	data  []byte
+}
+
+// add appends b to the segment and returns its file offset and address.
+func (s *newSegment) add(b []byte, align int) (uint64, uint64) {
+	for len(s.data)%align != 0 {
+		s.data = append(s.data, 0)
+	}
+	pos := uint64(len(s.data))
+	s.data = append(s.data, b...)
+	return s.off + pos, s.vaddr + pos
+}
+
+func (ef *elfFile) apply(patch ElfPatch) (bool, error) {
+	interp := ef.prog(elf.PT_INTERP)
+	dyns, slots := ef.dynamic()
+
+	const pageSize = 0x10000 // Covers 4K, 16K and 64K page kernels
+	var seg *newSegment
+	segment := func() *newSegment {
+		if seg == nil {
+			var end uint64
+			for _, p := range ef.progs {
+				if p.Type == elf.PT_LOAD && p.Vaddr+p.Memsz > end {
+					end = p.Vaddr + p.Memsz
+				}
+			}
+			off := alignUp(uint64(len(ef.data)), pageSize)
+			seg = &newSegment{off: off, vaddr: alignUp(end, pageSize) + off%pageSize}
+		}
+		return seg
+	}
+
+	changed := false
+	if patch.Interpreter != "" && interp != nil {
+		old := ef.cString(interp.Off)
+		if old != patch.Interpreter {
+			changed = true
+			if uint64(len(patch.Interpreter)) < interp.Filesz {
+				ef.overwriteString(interp.Off, old, patch.Interpreter)
+			} else {
+				b := append([]byte(patch.Interpreter), 0)
+				off, addr := segment().add(b, 1)
+				interp.Off, interp.Vaddr, interp.Paddr = off, addr, addr
+				interp.Filesz, interp.Memsz = uint64(len(b)), uint64(len(b))
+				ef.updateSection(".interp", off, addr, uint64(len(b)))
+			}
+		}
+	}
+
+	if patch.SetRunPath && dyns != nil {
+		strtab, strtabIdx := dynValue(dyns, elf.DT_STRTAB)
+		strsz, strszIdx := dynValue(dyns, elf.DT_STRSZ)
+		strOff, ok := ef.vaddrToOffset(strtab)
+		if strtabIdx < 0 || strszIdx < 0 || !ok || strOff+strsz > uint64(len(ef.data)) {
+			return false, fmt.Errorf("dynamic string table not found")
+		}
+
+		tag := elf.DT_RUNPATH
+		val, idx := dynValue(dyns, elf.DT_RUNPATH)
+		if idx < 0 {
+			if val, idx = dynValue(dyns, elf.DT_RPATH); idx >= 0 {
+				tag = elf.DT_RPATH
+			}
+		}
+
+		old := ""
+		if idx >= 0 {
+			old = ef.cString(strOff + val)
+		}
+		if idx < 0 || old != patch.RunPath {
+			changed = true
+			if idx >= 0 && len(patch.RunPath) <= len(old) {
+				ef.overwriteString(strOff+val, old, patch.RunPath)
+			} else {
+				// Copy the string table with the new path appended
+				table := append([]byte{}, ef.data[strOff:strOff+strsz]...)
+				newVal := uint64(len(table))
+				table = append(table, patch.RunPath...)
+				table = append(table, 0)
+				off, addr := segment().add(table, 8)
+				ef.updateSection(".dynstr", off, addr, uint64(len(table)))
+
+				dyns[strtabIdx].Val = addr
+				dyns[strszIdx].Val = uint64(len(table))
+				if idx >= 0 {
+					dyns[idx].Val = newVal
+				} else {
+					// Insert before the terminating DT_NULL
+					dyns = append(dyns[:len(dyns)-1], elfDyn{tag, newVal}, elfDyn{elf.DT_NULL, 0})
+				}
+
+				dynProg := ef.prog(elf.PT_DYNAMIC)
+				encoded := ef.encodeDynamic(dyns)
+				if len(dyns) <= slots {
+					copy(ef.data[dynProg.Off:], encoded)
+				} else {
+					// No spare slots: move the dynamic section
+					off, addr := segment().add(encoded, 8)
+					dynProg.Off, dynProg.Vaddr, dynProg.Paddr = off, addr, addr
+					dynProg.Filesz, dynProg.Memsz = uint64(len(encoded)), uint64(len(encoded))
+					ef.updateSection(".dynamic", off, addr, uint64(len(encoded)))
+				}
+			}
+		}
+	}
+
+	if seg != nil {
+		if err := ef.addLoadSegment(seg); err != nil {
+			return false, err
+		}
+	}
+	if changed {
+		ef.writeProgs()
+	}
+	return changed, nil
+}
+
+// addLoadSegment appends seg to the file and maps it by turning the PT_NOTE
+// program header into a PT_LOAD. Notes are not needed at runtime, and this
+// avoids having to grow the program header table.
+func (ef *elfFile) addLoadSegment(seg *newSegment) error {
+	noteIdx := -1
+	for i, p := range ef.progs {
+		if p.Type == elf.PT_NOTE {
+			noteIdx = i
+			break
+		}
+	}
+	if noteIdx < 0 {
+		return ErrNoNoteSegment
+	}
+
+	padding := make([]byte, seg.off-uint64(len(ef.data)))
+	ef.data = append(ef.data, padding...)
+	ef.data = append(ef.data, seg.data...)
+
+	// Writable like patchelf's: a moved dynamic section gets DT_DEBUG
+	// written into it by ld.so.
+	load := elfProg{
+		Type:   elf.PT_LOAD,
+		Flags:  elf.PF_R | elf.PF_W,
+		Off:    seg.off,
+		Vaddr:  seg.vaddr,
+		Paddr:  seg.vaddr,
+		Filesz: uint64(len(seg.data)),
+		Memsz:  uint64(len(seg.data)),
+		Align:  0x10000,
+	}
+
+	// PT_LOADs must stay sorted by address, so place the new one right after
+	// the last existing PT_LOAD.
+	progs := append(ef.progs[:noteIdx:noteIdx], ef.progs[noteIdx+1:]...)
+	lastLoad := -1
+	for i, p := range progs {
+		if p.Type == elf.PT_LOAD {
+			lastLoad = i
+		}
+	}
+	progs = append(progs[:lastLoad+1], append([]elfProg{load}, progs[lastLoad+1:]...)...)
+	ef.progs = progs
+	return nil
+}
+
+// updateSection points the named section header at a new location, keeping
+// tools like readelf in sync with the program headers.
+func (ef *elfFile) updateSection(name string, off, addr, size uint64) {
+	if ef.shoff == 0 || ef.shstrndx >= ef.shnum || ef.shoff+ef.shnum*ef.shentsize > uint64(len(ef.data)) {
+		return
+	}
+	o := ef.order
+	header := func(i uint64) []byte { return ef.data[ef.shoff+i*ef.shentsize:] }
+	var strOff uint64
+	if ef.class == elf.ELFCLASS64 {
+		strOff = o.Uint64(header(ef.shstrndx)[24:])
+	} else {
+		strOff = uint64(o.Uint32(header(ef.shstrndx)[16:]))
+	}
+	for i := uint64(0); i < ef.shnum; i++ {
+		h := header(i)
+		if ef.cString(strOff+uint64(o.Uint32(h))) != name {
+			continue
+		}
+		if ef.class == elf.ELFCLASS64 {
+			o.PutUint64(h[16:], addr)
+			o.PutUint64(h[24:], off)
+			o.PutUint64(h[32:], size)
+		} else {
+			o.PutUint32(h[12:], uint32(addr))
+			o.PutUint32(h[16:], uint32(off))
+			o.PutUint32(h[20:], uint32(size))
+		}
+		return
+	}
+}
+
+func alignUp(n, align uint64) uint64 {
+	return (n + align - 1) / align * align
+}
@@ -0,0 +1,233 @@
+package nixbazel
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// copyHostBinary copies a dynamically linked binary from the host into dir.
+func copyHostBinary(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	src := "/bin/ls"
+	ef, err := elf.Open(src)
+	if err != nil {
+		t.Skipf("no host ELF binary: %v", err)
+	}
+	defer ef.Close()
+	var interp string
+	for _, p := range ef.Progs {
+		if p.Type == elf.PT_INTERP {
+			b := make([]byte, p.Filesz)
+			if _, err := p.ReadAt(b, 0); err != nil {
+				t.Fatal(err)
+			}
+			interp = strings.TrimRight(string(b), "\x00")
+		}
+	}
+	if interp == "" {
+		t.Skip("host binary is not dynamically linked")
+	}
+
+	data, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(dir, "ls")
+	if err := os.WriteFile(dst, data, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return dst, interp
+}
+
+func readPatched(t *testing.T, path string) (string, string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ef, err := parseElfFile(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The result must still be readable by the standard library
+	std, err := elf.Open(path)
+	if err != nil {
+		t.Fatalf("debug/elf cannot read patched file: %v", err)
+	}
+	std.Close()
+	return ef.Interpreter(), ef.RunPath()
+}
+
+func TestPatchELF(t *testing.T) {
+	dir := t.TempDir()
+	bin, hostInterp := copyHostBinary(t, dir)
+
+	// A longer interpreter path than the original forces a new segment. Point
+	// it back at the host loader so the binary still runs.
+	longDir := filepath.Join(dir, strings.Repeat("x", 100))
+	if err := os.MkdirAll(longDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	interp := filepath.Join(longDir, "ld.so")
+	if err := os.Symlink(hostInterp, interp); err != nil {
+		t.Fatal(err)
+	}
+	runPath := "$ORIGIN/../lib:" + strings.Repeat("/nowhere", 40)
+
+	changed, err := PatchELF(bin, ElfPatch{Interpreter: interp, RunPath: runPath, SetRunPath: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Fatal("expected the file to change")
+	}
+	gotInterp, gotRunPath := readPatched(t, bin)
+	if gotInterp != interp {
+		t.Errorf("interpreter = %q, expected %q", gotInterp, interp)
+	}
+	if gotRunPath != runPath {
+		t.Errorf("runpath = %q, expected %q", gotRunPath, runPath)
+	}
+	if out, err := exec.Command(bin, "/").CombinedOutput(); err != nil {
+		t.Fatalf("patched binary failed: %v\n%s", err, out)
+	}
+
+	// Shorter values are written in place
+	changed, err = PatchELF(bin, ElfPatch{Interpreter: hostInterp, RunPath: "$ORIGIN", SetRunPath: true})
+	if err != nil || !changed {
+		t.Fatalf("PatchELF = %v, %v", changed, err)
+	}
+	gotInterp, gotRunPath = readPatched(t, bin)
+	if gotInterp != hostInterp || gotRunPath != "$ORIGIN" {
+		t.Errorf("interpreter, runpath = %q, %q", gotInterp, gotRunPath)
+	}
+	if out, err := exec.Command(bin, "/").CombinedOutput(); err != nil {
+		t.Fatalf("patched binary failed: %v\n%s", err, out)
+	}
+
+	// Applying the same patch again is a no-op
+	if changed, err := PatchELF(bin, ElfPatch{Interpreter: hostInterp, RunPath: "$ORIGIN", SetRunPath: true}); err != nil || changed {
+		t.Errorf("PatchELF = %v, %v, expected no change", changed, err)
+	}
+}
+
+// With no spare dynamic slots the dynamic section moves into the new
+// segment, which must be writable: ld.so stores DT_DEBUG in it.
+func TestPatchELFFullDynamic(t *testing.T) {
+	dir := t.TempDir()
+	bin, _ := copyHostBinary(t, dir)
+	data, err := os.ReadFile(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ef, err := parseElfFile(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dyns, _ := ef.dynamic()
+	dynProg := ef.prog(elf.PT_DYNAMIC)
+	dynProg.Filesz = uint64(len(dyns)) * ef.dynEntrySize()
+	ef.writeProgs()
+	if err := os.WriteFile(bin, ef.data, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	runPath := "$ORIGIN/../lib:" + strings.Repeat("/nowhere", 40)
+	if _, err := PatchELF(bin, ElfPatch{RunPath: runPath, SetRunPath: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, gotRunPath := readPatched(t, bin); gotRunPath != runPath {
+		t.Errorf("runpath = %q, expected %q", gotRunPath, runPath)
+	}
+	if out, err := exec.Command(bin, "/").CombinedOutput(); err != nil {
+		t.Fatalf("patched binary failed: %v\n%s", err, out)
+	}
+}
+
+func TestPatchELFNotELF(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "script")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PatchELF(path, ElfPatch{Interpreter: "/lib/ld.so"}); !errors.Is(err, ErrNotELF) {
+		t.Errorf("PatchELF(script) error = %v, expected ErrNotELF", err)
+	}
+}
+
+func TestPatchELFTreeNoNote(t *testing.T) {
+	dir := t.TempDir()
+	bin, _ := copyHostBinary(t, dir)
+	data, err := os.ReadFile(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ef, err := parseElfFile(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range ef.progs {
+		if ef.progs[i].Type == elf.PT_NOTE {
+			ef.progs[i].Type = elf.PT_NULL
+		}
+	}
+	ef.writeProgs()
+	if err := os.WriteFile(bin, ef.data, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// A longer interpreter needs a new segment, which cannot be mapped
+	patch := ElfPatch{Interpreter: "/" + strings.Repeat("x", 200) + "/ld.so"}
+	if _, err := PatchELF(bin, patch); !errors.Is(err, ErrNoNoteSegment) {
+		t.Errorf("PatchELF() error = %v, expected ErrNoNoteSegment", err)
+	}
+	patched, err := PatchELFTree(dir, patch, io.Discard)
+	if err != nil || patched != 0 {
+		t.Errorf("PatchELFTree() = %d, %v, expected the file to be skipped", patched, err)
+	}
+	if after, err := os.ReadFile(bin); err != nil || string(after) != string(ef.data) {
+		t.Errorf("skipped file was modified: %v", err)
+	}
+}
+
+// elf64Header returns a little-endian ELF64 header followed by extra bytes.
+func elf64Header(phoff uint64, phentsize, phnum uint16, extra int) []byte {
+	data := make([]byte, 64+extra)
+	copy(data, elf.ELFMAG)
+	data[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	data[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	binary.LittleEndian.PutUint64(data[32:], phoff)
+	binary.LittleEndian.PutUint16(data[54:], phentsize)
+	binary.LittleEndian.PutUint16(data[56:], phnum)
+	return data
+}
+
+func TestParseElfFileMalformed(t *testing.T) {
+	// A PT_LOAD whose offset plus size wraps around
+	wrapping := elf64Header(64, 56, 1, 56)
+	binary.LittleEndian.PutUint32(wrapping[64:], uint32(elf.PT_LOAD))
+	binary.LittleEndian.PutUint64(wrapping[64+8:], ^uint64(0))
+	binary.LittleEndian.PutUint64(wrapping[64+32:], 2)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"short phentsize", elf64Header(64, 8, 1, 8)},
+		{"wrapping phoff", elf64Header(^uint64(0)-7, 56, 1, 0)},
+		{"headers past the end", elf64Header(64, 56, 2, 56)},
+		{"wrapping segment", wrapping},
+	}
+
+	for _, test := range tests {
+		if _, err := parseElfFile(test.data); err == nil {
+			t.Errorf("parseElfFile(%s) succeeded, expected an error", test.name)
+		}
+	}
+}
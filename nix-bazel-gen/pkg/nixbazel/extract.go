@@ -0,0 +1,197 @@
+package nixbazel
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const nixStoreDir = "/nix/store"
+
+// maxSymlinkHops bounds symlink resolution, matching Linux's MAXSYMLINKS.
+const maxSymlinkHops = 40
+
+// Extract copies individual files out of a NAR into f.outDir, keeping their
+// paths relative to the store path. Symlinks are followed as long as they stay
+// inside the store path, so requesting lib/libfoo.so yields the contents of
+// the library it points to.
+func (f *Fetcher) Extract(archivePath, storePath string, paths []string) error {
+	tmpDir, err := os.MkdirTemp("", "nix-extract")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	unpacker := NewFetcher("", tmpDir)
+	unpacker.progress = f.progress
+	if err := unpacker.Unpack(archivePath, storePath); err != nil {
+		return err
+	}
+	root := filepath.Join(tmpDir, filepath.Base(storePath))
+
+	for _, p := range paths {
+		src, err := resolveInStorePath(root, storePath, p)
+		if err != nil {
+			return fmt.Errorf("failed to extract %s: %w", p, err)
+		}
+		if err := copyExtracted(src, filepath.Join(f.outDir, filepath.FromSlash(p))); err != nil {
+			return fmt.Errorf("failed to extract %s: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// resolveInStorePath follows symlinks for rel inside an unpacked store path
+// rooted at root, returning the on-disk path of the final regular file. Every
+// path component is resolved by hand so that links can never lead outside of
+// the store path.
+func resolveInStorePath(root, storePath, rel string) (string, error) {
+	hops := 0
+	resolved := "" // Relative to root, contains no symlinks
+	rest := strings.Split(rel, "/")
+	for len(rest) > 0 {
+		name := rest[0]
+		rest = rest[1:]
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			if resolved == "" {
+				return "", fmt.Errorf("path %s escapes %s", rel, storePath)
+			}
+			if resolved = path.Dir(resolved); resolved == "." {
+				resolved = ""
+			}
+			continue
+		}
+
+		next := path.Join(resolved, name)
+		p := filepath.Join(root, filepath.FromSlash(next))
+		info, err := os.Lstat(p)
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		if hops++; hops > maxSymlinkHops {
+			return "", fmt.Errorf("too many levels of symbolic links resolving %s", rel)
+		}
+		target, err := os.Readlink(p)
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			if target != storePath && !strings.HasPrefix(target, storePath+"/") {
+				return "", fmt.Errorf("%s points outside of %s (%s)", next, storePath, target)
+			}
+			target = strings.TrimPrefix(target, storePath)
+			resolved = ""
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+
+	p := filepath.Join(root, filepath.FromSlash(resolved))
+	info, err := os.Lstat(p)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", rel)
+	}
+	return p, nil
+}
+
+// CopyTree copies the directory src into dst, following symlinks like
+// cp -RL, for taking a subdirectory out of a nix_root whose symlinks are
+// relative. A missing src yields an empty dst. Dangling symlinks are
+// skipped with a warning to progress, and symlinks back to a directory being copied
+// are an error rather than an endless copy.
+func CopyTree(src, dst string, progress io.Writer) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		return nil
+	}
+	return copyDereferenced(src, dst, map[string]bool{}, progress)
+}
+
+// copyDereferenced copies src into the existing directory dst. active holds the
+// resolved directories being copied, to detect cycles.
+func copyDereferenced(src, dst string, active map[string]bool, progress io.Writer) error {
+	resolved, err := filepath.EvalSymlinks(src)
+	if err != nil {
+		return err
+	}
+	if active[resolved] {
+		return fmt.Errorf("symlink cycle at %s", src)
+	}
+	active[resolved] = true
+	defer delete(active, resolved)
+
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		from := filepath.Join(src, entry.Name())
+		to := filepath.Join(dst, entry.Name())
+		info, err := os.Stat(from)
+		if os.IsNotExist(err) {
+			fmt.Fprintf(progress, "Warning: skipping dangling symlink %s\n", from)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case info.IsDir():
+			if err := os.MkdirAll(to, 0755); err != nil {
+				return err
+			}
+			if err := copyDereferenced(from, to, active, progress); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			if err := copyExtracted(from, to); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func copyExtracted(src, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	mode := os.FileMode(0644)
+	if info.Mode()&0111 != 0 {
+		mode = 0755
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
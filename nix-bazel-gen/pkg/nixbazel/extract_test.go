@@ -0,0 +1,98 @@
+package nixbazel
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// nix_extract runs the fetch tool without PATH, like nix_root.
+func TestExtractWithoutPath(t *testing.T) {
+	dir := t.TempDir()
+	archive := writeTestArchive(t, dir, "zlib.nar.xz", []testNarEntry{
+		{path: "", mode: fs.ModeDir},
+		{path: "lib", mode: fs.ModeDir},
+		{path: "lib/libz.so", mode: fs.ModeSymlink, target: "libz.so.1.3.1"},
+		{path: "lib/libz.so.1.3.1", mode: 0755, content: "libz"},
+	})
+	t.Setenv("PATH", "")
+
+	out := filepath.Join(dir, "out")
+	f := NewFetcher("", out)
+	if err := f.Extract(archive, "/nix/store/abc-zlib", []string{"lib/libz.so"}); err != nil {
+		t.Fatalf("Extract without PATH: %v", err)
+	}
+	info, err := os.Lstat(filepath.Join(out, "lib/libz.so"))
+	if err != nil || !info.Mode().IsRegular() || info.Mode().Perm() != 0755 {
+		t.Errorf("lib/libz.so = %v, %v, expected an executable regular file", info, err)
+	}
+}
+
+func TestCopyTree(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	for _, d := range []string{"abc-hello/lib", "def-glibc/lib/gconv", "loop"} {
+		if err := os.MkdirAll(filepath.Join(root, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		"def-glibc/lib/libc.so.6":       "libc",
+		"def-glibc/lib/gconv/UTF-16.so": "utf16",
+		"abc-hello/lib/libhello.so":     "hello",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"abc-hello/lib/libc.so.6": "../../def-glibc/lib/libc.so.6",
+		"abc-hello/lib/gconv":     "../../def-glibc/lib/gconv",
+		"abc-hello/lib/dangling":  "../../ghi-missing/lib/libm.so",
+		"loop/self":               "../loop",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out := filepath.Join(dir, "out")
+	if err := CopyTree(filepath.Join(root, "abc-hello/lib"), out, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{
+		"libhello.so":     "hello",
+		"libc.so.6":       "libc",
+		"gconv/UTF-16.so": "utf16",
+	} {
+		p := filepath.Join(out, name)
+		info, err := os.Lstat(p)
+		if err != nil || !info.Mode().IsRegular() {
+			t.Errorf("%s = %v, %v, expected a regular file", name, info, err)
+			continue
+		}
+		if data, _ := os.ReadFile(p); string(data) != expected {
+			t.Errorf("%s = %q, expected %q", name, data, expected)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(out, "dangling")); !os.IsNotExist(err) {
+		t.Errorf("dangling symlink was copied: %v", err)
+	}
+
+	// A missing directory is an empty tree
+	empty := filepath.Join(dir, "empty")
+	if err := CopyTree(filepath.Join(root, "abc-hello/share"), empty, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := os.ReadDir(empty); err != nil || len(entries) != 0 {
+		t.Errorf("CopyTree(missing) = %v, %v, expected an empty directory", entries, err)
+	}
+
+	if err := CopyTree(filepath.Join(root, "loop"), filepath.Join(dir, "loop"), io.Discard); err == nil {
+		t.Errorf("CopyTree(loop) succeeded, expected a symlink cycle error")
+	}
+}
@@ -3,15 +3,17 @@ package nixbazel
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
 
+	"github.com/ulikunitz/xz"
 	"zombiezen.com/go/nix/nar"
 )
 
@@ -21,6 +23,31 @@ type Fetcher struct {
 	client   *http.Client
 	// Cache for resolved narinfos to avoid re-fetching during resolve
 	narInfoCache map[string]*NarInfo
+	// Manifests recorded during resolve, keyed by NarHash. Nil disables recording.
+	manifests Manifests
+	// ELF patch applied to unpacked store paths. Nil disables patching.
+	elfPatch *ElfPatch
+	// Relocation applied to unpacked store paths. Nil disables relocation.
+	relocation *Relocation
+	// Text rewriting applied to unpacked store paths. Nil disables it.
+	textRewrite       *TextRewrite
+	textRewriteReport string
+	// Canonical makes unpacked trees read-only with mtime 1, like the Nix store
+	canonical bool
+	// Hardlink identical read-only files after unpacking
+	dedup bool
+	// Local Nix store to take store paths from. Nil always downloads.
+	localStore *LocalStore
+	// Hydra instance packages are resolved with
+	hydraURL string
+	// Evaluation IDs by jobset, when every package is resolved from one
+	// evaluation per jobset. Nil takes each job's latest build.
+	hydraEvals map[string]int64
+	// Package IDs resolved from Hydra in this run, which the evaluation
+	// picked for a jobset must have built.
+	hydraJobs []string
+	// Progress messages and warnings. Defaults to os.Stdout.
+	progress io.Writer
 }
 
 func NewFetcher(cacheURL, outDir string) *Fetcher {
@@ -29,9 +56,22 @@ func NewFetcher(cacheURL, outDir string) *Fetcher {
 		outDir:       outDir,
 		client:       http.DefaultClient,
 		narInfoCache: make(map[string]*NarInfo),
+		hydraURL:     defaultHydraURL,
+		progress:     os.Stdout,
 	}
 }
 
+// SetProgress sends progress messages and warnings to w instead of
+// os.Stdout, e.g. io.Discard to silence them.
+func (f *Fetcher) SetProgress(w io.Writer) {
+	f.progress = w
+}
+
+// SetElfPatch makes Unpack patch every ELF file it unpacks.
+func (f *Fetcher) SetElfPatch(patch ElfPatch) {
+	f.elfPatch = &patch
+}
+
 // FetchAllFromLock downloads and unpacks all packages in the lockfile
 func (f *Fetcher) FetchAllFromLock(lock *Lockfile) error {
 	// Collect all unique store paths
@@ -42,12 +82,16 @@ func (f *Fetcher) FetchAllFromLock(lock *Lockfile) error {
 			URL:         node.URL,
 			StorePath:   storePath,
 			References:  node.References,
+			NarHash:     node.NarHash,
+			FileHash:    node.FileHash,
 			Compression: "xz",
 		}
 	}
 
-	fmt.Printf("Fetching %d unique store paths...\n", len(uniquePaths))
-	os.Stdout.Sync()
+	fmt.Fprintf(f.progress, "Fetching %d unique store paths...\n", len(uniquePaths))
+	if file, ok := f.progress.(*os.File); ok {
+		file.Sync()
+	}
 
 	// Download and unpack
 	for _, info := range uniquePaths {
@@ -57,6 +101,16 @@ func (f *Fetcher) FetchAllFromLock(lock *Lockfile) error {
 
 	}
 
+	if f.dedup {
+		storePaths := make([]string, 0, len(uniquePaths))
+		for storePath := range uniquePaths {
+			storePaths = append(storePaths, storePath)
+		}
+		if err := f.dedupStorePaths(storePaths); err != nil {
+			return err
+		}
+	}
+
 	return f.generateBuildFiles(*lock, uniquePaths, "")
 }
 
@@ -77,7 +131,7 @@ func (f *Fetcher) FetchFromLock(lock *Lockfile, repoName string) error {
 		}
 		node, ok := lock.Packages[path]
 		if !ok {
-			fmt.Printf("Warning: package %s not found in lockfile packages\n", path)
+			fmt.Fprintf(f.progress, "Warning: package %s not found in lockfile packages\n", path)
 			return
 		}
 		closure[path] = node
@@ -92,6 +146,8 @@ func (f *Fetcher) FetchFromLock(lock *Lockfile, repoName string) error {
 			URL:         node.URL,
 			StorePath:   path,
 			References:  node.References,
+			NarHash:     node.NarHash,
+			FileHash:    node.FileHash,
 			Compression: "xz",
 		}
 		if err := f.downloadAndUnpack(context.Background(), info); err != nil {
@@ -116,7 +172,7 @@ func (f *Fetcher) Fetch(ctx context.Context, storePathOrHash string) error {
 	// Check if already fetched
 	// TODO: Better check
 
-	fmt.Printf("Fetching info for %s...\n", hash)
+	fmt.Fprintf(f.progress, "Fetching info for %s...\n", hash)
 	narInfo, err := f.getNarInfo(ctx, hash)
 	if err != nil {
 		return fmt.Errorf("failed to get narinfo for %s: %w", hash, err)
@@ -200,13 +256,29 @@ func (f *Fetcher) downloadAndUnpack(ctx context.Context, info *NarInfo) error {
 	storeName := filepath.Base(info.StorePath)
 	destDir := filepath.Join(f.outDir, storeName)
 
+	local, err := f.fromLocalStore(info.StorePath, info.NarHash)
+	if err != nil {
+		return err
+	}
+	if local {
+		if f.canonical && !f.localStore.Symlink {
+			if err := CanonicalizeTree(destDir); err != nil {
+				return fmt.Errorf("failed to canonicalize %s: %w", destDir, err)
+			}
+		}
+		return nil
+	}
+
 	// Force unpack: remove destination if it exists
-	if err := os.RemoveAll(destDir); err != nil {
+	if err := removeTree(destDir); err != nil {
 		return fmt.Errorf("failed to clean destination %s: %w", destDir, err)
 	}
 
-	fmt.Printf("Downloading %s...\n", info.URL)
-	url := fmt.Sprintf("%s/%s", f.cacheURL, info.URL)
+	if info.URL == "" {
+		return fmt.Errorf("%s is not available on any substituter; take it from a local store with --local-store", info.StorePath)
+	}
+	fmt.Fprintf(f.progress, "Downloading %s...\n", info.URL)
+	url := f.narURL(info.URL)
 
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
@@ -223,29 +295,74 @@ func (f *Fetcher) downloadAndUnpack(ctx context.Context, info *NarInfo) error {
 		return fmt.Errorf("download failed: %d", resp.StatusCode)
 	}
 
+	// Verify the download against the hashes we expect, if known
+	fileVerifier, err := newHashVerifier(info.FileHash)
+	if err != nil {
+		return fmt.Errorf("bad FileHash for %s: %w", info.StorePath, err)
+	}
+	narVerifier, err := newHashVerifier(info.NarHash)
+	if err != nil {
+		return fmt.Errorf("bad NarHash for %s: %w", info.StorePath, err)
+	}
+
 	// Handle compression
-	var r io.Reader = resp.Body
-	if info.Compression == "xz" {
-		// Use external xz command for now
-		cmd := exec.Command("xz", "-d", "-c")
-		cmd.Stdin = resp.Body
-		pipe, err := cmd.StdoutPipe()
-		if err != nil {
-			return err
-		}
-		if err := cmd.Start(); err != nil {
-			return err
-		}
-		r = pipe
+	r, wait, err := decompress(io.TeeReader(resp.Body, fileVerifier), info.Compression)
+	if err != nil {
+		return err
 	}
 
 	// Unpack NAR
-	fmt.Printf("Unpacking to %s...\n", destDir)
-	return f.unpackNar(r, destDir)
+	fmt.Fprintf(f.progress, "Unpacking to %s...\n", destDir)
+	narStream := io.TeeReader(r, narVerifier)
+	if err := f.unpackNar(narStream, destDir); err != nil {
+		return err
+	}
+	// Read to the end so the hashes cover everything
+	if _, err := io.Copy(io.Discard, narStream); err != nil {
+		return err
+	}
+	if err := wait(); err != nil {
+		return err
+	}
+	if err := fileVerifier.verify(info.URL); err != nil {
+		return err
+	}
+	if err := narVerifier.verify("NAR of " + info.StorePath); err != nil {
+		return err
+	}
+	if f.canonical {
+		return CanonicalizeTree(destDir)
+	}
+	return nil
+}
+
+// decompress wraps r according to a narinfo Compression value. The returned
+// wait function must be called once the stream has been consumed.
+func decompress(r io.Reader, compression string) (io.Reader, func() error, error) {
+	switch compression {
+	case "", "none":
+		return r, func() error { return nil }, nil
+	case "xz":
+		// In Go, so Bazel actions without PATH can unpack
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read xz stream: %w", err)
+		}
+		return xr, func() error { return nil }, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported compression %q", compression)
+	}
 }
 
+// unpackNar writes the NAR read from r to destDir. Entry paths are validated
+// and existing symlinks below destDir are never followed, so a malicious NAR
+// (or a symlink left by a previous unpack) cannot write outside destDir.
 func (f *Fetcher) unpackNar(r io.Reader, destDir string) error {
 	narReader := nar.NewReader(r)
+	// Directories created by this NAR, so children are known to have a parent
+	dirs := make(map[string]bool)
+	prev := ""
+	first := true
 
 	for {
 		hdr, err := narReader.Next()
@@ -256,16 +373,38 @@ func (f *Fetcher) unpackNar(r io.Reader, destDir string) error {
 			return err
 		}
 
-		path := filepath.Join(destDir, hdr.Path)
+		if err := validateNarPath(hdr.Path); err != nil {
+			return err
+		}
+		if first {
+			if hdr.Path != "" {
+				return fmt.Errorf("nar: first entry is %q, expected the root", hdr.Path)
+			}
+		} else {
+			if !narPathLess(prev, hdr.Path) {
+				return fmt.Errorf("nar: entry %q is not ordered after %q", hdr.Path, prev)
+			}
+			if parent := narParent(hdr.Path); !dirs[parent] {
+				return fmt.Errorf("nar: entry %q has no parent directory", hdr.Path)
+			}
+		}
+		first = false
+		prev = hdr.Path
+
+		path, err := removeForUnpack(destDir, hdr.Path, hdr.Mode.IsDir())
+		if err != nil {
+			return err
+		}
 
-		if hdr.Mode.IsDir() {
-			if err := os.MkdirAll(path, 0755); err != nil {
+		switch {
+		case hdr.Mode.IsDir():
+			if err := os.Mkdir(path, 0755); err != nil && !os.IsExist(err) {
 				return err
 			}
-		} else if hdr.Mode.IsRegular() {
-			// Remove if exists
-			os.Remove(path)
-			file, err := os.Create(path)
+			dirs[hdr.Path] = true
+		case hdr.Mode.IsRegular():
+			// O_EXCL fails rather than following a symlink created in between
+			file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
 			if err != nil {
 				return err
 			}
@@ -273,22 +412,35 @@ func (f *Fetcher) unpackNar(r io.Reader, destDir string) error {
 				file.Close()
 				return err
 			}
-			file.Close()
-			if hdr.Mode&0111 != 0 {
-				os.Chmod(path, 0755)
+			if err := file.Close(); err != nil {
+				return err
+			}
+			// Explicit so the result does not depend on the umask
+			if err := os.Chmod(path, fileMode(hdr.Mode, f.canonical)); err != nil {
+				return err
+			}
+		case hdr.Mode.Type() == fs.ModeSymlink:
+			if hdr.LinkTarget == "" || strings.IndexByte(hdr.LinkTarget, 0) >= 0 {
+				return fmt.Errorf("nar: invalid symlink target %q for %q", hdr.LinkTarget, hdr.Path)
 			}
-		} else if hdr.Mode&fs.ModeSymlink != 0 {
-			// Remove if exists
-			os.Remove(path)
 			if err := os.Symlink(hdr.LinkTarget, path); err != nil {
 				return err
 			}
+		default:
+			return fmt.Errorf("nar: unsupported file type %v for %q", hdr.Mode.Type(), hdr.Path)
 		}
 	}
 	return nil
 }
 
 func (f *Fetcher) Unpack(archivePath, storePath string) error {
+	return f.unpack(UnpackRequest{Archive: archivePath, StorePath: storePath})
+}
+
+// unpack is Unpack for a request, which may carry the expected NarHash of the
+// store path and its reference closure.
+func (f *Fetcher) unpack(req UnpackRequest) error {
+	archivePath, storePath, narHash := req.Archive, req.StorePath, req.NarHash
 	// We unpack to f.outDir (repo root).
 	// The NAR contains the directory structure (storePathBase/...).
 	// So binaries will be in f.outDir/storePathBase/bin.
@@ -296,57 +448,126 @@ func (f *Fetcher) Unpack(archivePath, storePath string) error {
 	storeBase := filepath.Base(storePath)
 	actualStoreDir := filepath.Join(f.outDir, storeBase)
 
-	if err := os.MkdirAll(actualStoreDir, 0755); err != nil {
+	local, err := f.fromLocalStore(storePath, narHash)
+	if err != nil {
 		return err
 	}
+	if local && f.localStore.Symlink {
+		// Post-processing would modify the local store
+		return nil
+	}
+	if !local {
+		if err := f.unpackArchive(archivePath, actualStoreDir); err != nil {
+			return err
+		}
+	}
 
-	fmt.Printf("Unpacking %s to %s...\n", archivePath, actualStoreDir)
-
-	var r io.Reader
-
-	if strings.HasPrefix(archivePath, "http://") || strings.HasPrefix(archivePath, "https://") {
-		// Download from URL
-		resp, err := http.Get(archivePath)
+	if f.elfPatch != nil {
+		patched, err := PatchELFTree(actualStoreDir, *f.elfPatch, f.progress)
 		if err != nil {
-			return fmt.Errorf("failed to download %s: %w", archivePath, err)
+			return fmt.Errorf("failed to patch ELF files: %w", err)
 		}
-		defer resp.Body.Close()
-		if resp.StatusCode != http.StatusOK {
-			return fmt.Errorf("download failed: %d", resp.StatusCode)
+		fmt.Fprintf(f.progress, "Patched %d ELF files in %s\n", patched, actualStoreDir)
+	}
+	if f.relocation != nil {
+		relocation := *f.relocation
+		if req.closure != nil {
+			relocation.References = append(slices.Clone(relocation.References), req.closure...)
 		}
-		r = resp.Body
-	} else {
-		// Open local file
-		file, err := os.Open(archivePath)
+		relocated, err := RelocateTree(f.outDir, storePath, relocation, f.progress)
 		if err != nil {
-			return err
+			return fmt.Errorf("failed to relocate ELF files: %w", err)
+		}
+		fmt.Fprintf(f.progress, "Relocated %d ELF files in %s\n", relocated, actualStoreDir)
+	}
+	if f.textRewrite != nil {
+		report, err := RewriteTextTree(f.outDir, storePath, *f.textRewrite)
+		if err != nil {
+			return fmt.Errorf("failed to rewrite text files: %w", err)
+		}
+		reportPath := f.textRewriteReport
+		if reportPath == "" {
+			reportPath = actualStoreDir + ".rewrites.json"
+		}
+		if err := WriteRewriteReport(reportPath, report); err != nil {
+			return fmt.Errorf("failed to write rewrite report: %w", err)
+		}
+		fmt.Fprintf(f.progress, "Rewrote %d text files in %s (report: %s)\n", len(report.Files), actualStoreDir, reportPath)
+	}
+	if f.canonical {
+		if err := CanonicalizeTree(actualStoreDir); err != nil {
+			return fmt.Errorf("failed to canonicalize %s: %w", actualStoreDir, err)
 		}
-		defer file.Close()
-		r = file
 	}
 
-	// Assume xz
-	cmd := exec.Command("xz", "-d", "-c")
-	cmd.Stdin = r
-	pipe, err := cmd.StdoutPipe()
+	return nil
+}
+
+// unpackArchive unpacks the xz-compressed NAR at archivePath into destDir.
+func (f *Fetcher) unpackArchive(archivePath, destDir string) error {
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(f.progress, "Unpacking %s to %s...\n", archivePath, destDir)
+
+	archive, err := openArchive(archivePath)
 	if err != nil {
 		return err
 	}
-	if err := cmd.Start(); err != nil {
+	defer archive.Close()
+
+	// Assume xz
+	r, wait, err := decompress(archive, "xz")
+	if err != nil {
 		return err
 	}
 
-	if err := f.unpackNar(pipe, actualStoreDir); err != nil {
+	if err := f.unpackNar(r, destDir); err != nil {
 		return err
 	}
 
-	if err := cmd.Wait(); err != nil {
+	if err := wait(); err != nil {
 		return fmt.Errorf("xz failed: %w", err)
 	}
-
 	return nil
 }
 
+// narURL is the download URL of a lockfile URL, which is relative to the
+// fetcher's cache unless it was found on another substituter.
+func (f *Fetcher) narURL(url string) string {
+	if strings.Contains(url, "://") {
+		return url
+	}
+	return fmt.Sprintf("%s/%s", f.cacheURL, url)
+}
+
+// openArchive opens a local NAR archive or downloads it if given a URL.
+func openArchive(archivePath string) (io.ReadCloser, error) {
+	if strings.HasPrefix(archivePath, "http://") || strings.HasPrefix(archivePath, "https://") {
+		// Download from URL
+		resp, err := http.Get(archivePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download %s: %w", archivePath, err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("download failed: %d", resp.StatusCode)
+		}
+		return resp.Body, nil
+	}
+	// Open local file
+	return os.Open(archivePath)
+}
+
+// hydraJobName adjusts packageId to the job naming conventions of jobset.
+func hydraJobName(jobset, packageId string) string {
+	if strings.HasPrefix(jobset, "nixpkgs/") {
+		return strings.TrimPrefix(packageId, "nixpkgs.")
+	}
+	return packageId
+}
+
 func (f *Fetcher) resolveHydra(ctx context.Context, packageId, channel string) (string, error) {
 	// Try multiple jobsets
 	jobsets := []string{
@@ -360,62 +581,196 @@ func (f *Fetcher) resolveHydra(ctx context.Context, packageId, channel string) (
 
 	var lastErr error
 	for _, jobset := range jobsets {
-		// Adjust packageId based on jobset conventions
-		jobName := packageId
-		if strings.HasPrefix(jobset, "nixpkgs/") {
-			jobName = strings.TrimPrefix(packageId, "nixpkgs.")
-		}
-
-		url := fmt.Sprintf("https://hydra.nixos.org/job/%s/%s/latest", jobset, jobName)
-		fmt.Printf("Resolving %s via Hydra (%s)...\n", packageId, url)
+		jobName := hydraJobName(jobset, packageId)
 
-		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-		if err != nil {
-			return "", err
+		url := fmt.Sprintf("%s/job/%s/%s/latest", f.hydraURL, jobset, jobName)
+		if f.hydraEvals != nil {
+			evalID, err := f.hydraLatestEval(ctx, jobset, jobName)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			url = fmt.Sprintf("%s/eval/%d/job/%s", f.hydraURL, evalID, jobName)
 		}
-		req.Header.Set("Accept", "application/json")
-
-		resp, err := f.client.Do(req)
+		fmt.Fprintf(f.progress, "Resolving %s via Hydra (%s)...\n", packageId, url)
+		storePath, err := f.hydraBuildOutput(ctx, url)
 		if err != nil {
 			lastErr = err
 			continue
 		}
-		defer resp.Body.Close()
+		fmt.Fprintf(f.progress, "Resolved to: %s\n", storePath)
+		return storePath, nil
+	}
 
-		if resp.StatusCode != http.StatusOK {
-			lastErr = fmt.Errorf("hydra request failed: %d", resp.StatusCode)
-			continue
-		}
+	return "", fmt.Errorf("failed to resolve %s in any jobset: %v", packageId, lastErr)
+}
 
-		var result struct {
-			BuildOutputs struct {
-				Out struct {
-					Path string `json:"path"`
-				} `json:"out"`
-			} `json:"buildoutputs"`
+// maxHydraEvals bounds how many evaluations hydraLatestEval steps back
+// through looking for one where every requested job is built.
+const maxHydraEvals = 20
+
+// errHydraNotBuilt is returned for Hydra builds that are missing, unfinished
+// or failed.
+var errHydraNotBuilt = errors.New("not built")
+
+// hydraLatestEval returns the ID of the latest evaluation of jobset in which
+// jobName and every other requested job it contains built successfully,
+// asking Hydra only the first time so later packages come from the same one.
+func (f *Fetcher) hydraLatestEval(ctx context.Context, jobset, jobName string) (int64, error) {
+	if id, ok := f.hydraEvals[jobset]; ok {
+		return id, nil
+	}
+	jobs := []string{jobName}
+	for _, packageId := range f.hydraJobs {
+		if job := hydraJobName(jobset, packageId); job != jobName {
+			jobs = append(jobs, job)
 		}
+	}
 
-		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-			lastErr = fmt.Errorf("failed to decode hydra response: %w", err)
-			continue
+	evalsURL := fmt.Sprintf("%s/jobset/%s/evals", f.hydraURL, jobset)
+	checked := 0
+	for evalsURL != "" && checked < maxHydraEvals {
+		var page struct {
+			Evals []struct {
+				ID int64 `json:"id"`
+			} `json:"evals"`
+			Next string `json:"next"`
+		}
+		if err := f.hydraGet(ctx, evalsURL, &page); err != nil {
+			return 0, fmt.Errorf("failed to list hydra evaluations: %w", err)
+		}
+		for _, eval := range page.Evals {
+			if checked++; checked > maxHydraEvals {
+				break
+			}
+			built, err := f.hydraEvalBuilt(ctx, eval.ID, jobs)
+			if err != nil {
+				return 0, err
+			}
+			if built {
+				fmt.Fprintf(f.progress, "Using evaluation %d of %s\n", eval.ID, jobset)
+				f.hydraEvals[jobset] = eval.ID
+				return eval.ID, nil
+			}
+		}
+		evalsURL = ""
+		if page.Next != "" {
+			evalsURL = fmt.Sprintf("%s/jobset/%s/evals%s", f.hydraURL, jobset, page.Next)
 		}
+	}
+	return 0, fmt.Errorf("none of the latest %d evaluations of %s built %s", maxHydraEvals, jobset, jobName)
+}
 
-		if result.BuildOutputs.Out.Path == "" {
-			lastErr = fmt.Errorf("no output path found in hydra response")
-			continue
+// hydraEvalBuilt reports whether every job of jobs that evaluation id has
+// built successfully. jobs[0] must be part of the evaluation; the others may
+// be missing, as they can come from another jobset.
+func (f *Fetcher) hydraEvalBuilt(ctx context.Context, id int64, jobs []string) (bool, error) {
+	for i, job := range jobs {
+		url := fmt.Sprintf("%s/eval/%d/job/%s", f.hydraURL, id, job)
+		_, err := f.hydraBuildOutput(ctx, url)
+		var status *hydraStatusError
+		notFound := errors.As(err, &status) && status.StatusCode == http.StatusNotFound
+		switch {
+		case notFound && i > 0:
+			// Not part of this jobset
+		case notFound || errors.Is(err, errHydraNotBuilt):
+			fmt.Fprintf(f.progress, "Skipping evaluation %d: %s: %v\n", id, job, err)
+			return false, nil
+		case err != nil:
+			return false, err
 		}
+	}
+	return true, nil
+}
+
+// hydraStatusError is a Hydra response other than 200 OK.
+type hydraStatusError struct {
+	StatusCode int
+}
+
+func (e *hydraStatusError) Error() string {
+	return fmt.Sprintf("hydra request failed: %d", e.StatusCode)
+}
 
-		fmt.Printf("Resolved to: %s\n", result.BuildOutputs.Out.Path)
-		return result.BuildOutputs.Out.Path, nil
+// hydraGet decodes the JSON Hydra returns for url into v.
+func (f *Fetcher) hydraGet(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
 	}
+	req.Header.Set("Accept", "application/json")
 
-	return "", fmt.Errorf("failed to resolve %s in any jobset: %v", packageId, lastErr)
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &hydraStatusError{StatusCode: resp.StatusCode}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode hydra response: %w", err)
+	}
+	return nil
+}
+
+// hydraBuildOutput returns the "out" path of the Hydra build at url (or
+// redirected to from url), which must have finished successfully.
+func (f *Fetcher) hydraBuildOutput(ctx context.Context, url string) (string, error) {
+	var result struct {
+		ID           int64 `json:"id"`
+		Finished     *int  `json:"finished"`
+		BuildStatus  *int  `json:"buildstatus"`
+		BuildOutputs struct {
+			Out struct {
+				Path string `json:"path"`
+			} `json:"out"`
+		} `json:"buildoutputs"`
+	}
+	if err := f.hydraGet(ctx, url, &result); err != nil {
+		return "", err
+	}
+
+	// Hydra reports buildstatus 0 for success and null until the build ends
+	switch {
+	case result.Finished != nil && (*result.Finished == 0 || result.BuildStatus == nil):
+		return "", fmt.Errorf("build %d is unfinished: %w", result.ID, errHydraNotBuilt)
+	case result.BuildStatus != nil && *result.BuildStatus != 0:
+		return "", fmt.Errorf("build %d failed with status %d: %w", result.ID, *result.BuildStatus, errHydraNotBuilt)
+	}
+	if result.BuildOutputs.Out.Path == "" {
+		return "", fmt.Errorf("no output path found in hydra response")
+	}
+	return result.BuildOutputs.Out.Path, nil
 }
 
+// resolveClosure adds the store path with the given hash part and its
+// references to closure and returns its narinfo.
 func (f *Fetcher) resolveClosure(ctx context.Context, hash string, closure map[string]ClosureNode) (*NarInfo, error) {
-	// Check cache
-	if _, ok := closure[hash]; ok {
-		return f.narInfoCache[hash], nil
+	// Index the paths already in the closure once, not on every visit
+	byHash := make(map[string]string, len(closure))
+	for storePath := range closure {
+		byHash[extractHash(storePath)] = storePath
+	}
+	return f.resolveClosureIndexed(ctx, hash, closure, byHash)
+}
+
+// resolveClosureIndexed is resolveClosure with byHash mapping the hash part
+// of every path in closure to the path. It adds the paths it resolves to both.
+func (f *Fetcher) resolveClosureIndexed(ctx context.Context, hash string, closure map[string]ClosureNode, byHash map[string]string) (*NarInfo, error) {
+	// Paths already in the closure (from an existing lockfile or path info)
+	// are not fetched again
+	if storePath, ok := byHash[hash]; ok {
+		node := closure[storePath]
+		return &NarInfo{
+			URL:         node.URL,
+			Compression: "xz",
+			References:  node.References,
+			StorePath:   storePath,
+			NarHash:     node.NarHash,
+			NarSize:     node.NarSize,
+		}, nil
 	}
 
 	info, err := f.getNarInfo(ctx, hash)
@@ -424,16 +779,31 @@ func (f *Fetcher) resolveClosure(ctx context.Context, hash string, closure map[s
 	}
 	f.narInfoCache[hash] = info
 
+	narHash, err := hashToHex(info.NarHash)
+	if err != nil {
+		return nil, fmt.Errorf("bad NarHash for %s: %w", info.StorePath, err)
+	}
+	fileHash, err := hashToHex(info.FileHash)
+	if err != nil {
+		return nil, fmt.Errorf("bad FileHash for %s: %w", info.StorePath, err)
+	}
 	node := ClosureNode{
 		URL:        info.URL,
 		Hash:       hash,
 		References: info.References,
-		NarHash:    convertHashToHex(info.NarHash),
+		NarHash:    narHash,
 		NarSize:    info.NarSize,
-		FileHash:   convertHashToHex(info.FileHash),
+		FileHash:   fileHash,
 		FileSize:   info.FileSize,
 	}
 	closure[info.StorePath] = node
+	byHash[hash] = info.StorePath
+
+	if f.manifests != nil {
+		if err := f.recordManifest(ctx, hash, info, node.NarHash); err != nil {
+			return nil, err
+		}
+	}
 
 	// Recurse
 	for _, ref := range info.References {
@@ -442,11 +812,11 @@ func (f *Fetcher) resolveClosure(ctx context.Context, hash string, closure map[s
 			continue
 		}
 		// Check if we already visited this store path (to avoid infinite recursion/re-work)
-		if _, ok := closure[ref]; ok {
+		if _, ok := closure[nixStoreDir+"/"+ref]; ok {
 			continue
 		}
 
-		if _, err := f.resolveClosure(ctx, refHash, closure); err != nil {
+		if _, err := f.resolveClosureIndexed(ctx, refHash, closure, byHash); err != nil {
 			return nil, err
 		}
 	}
@@ -0,0 +1,200 @@
+package nixbazel
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Graph is the reference graph of a lockfile's packages.
+type Graph struct {
+	Nodes []GraphNode `json:"nodes"`
+}
+
+// GraphNode is a store path and the store paths it refers to.
+type GraphNode struct {
+	StorePath    string   `json:"storePath"`
+	Name         string   `json:"name"`
+	Version      string   `json:"version,omitempty"`
+	NarSize      int64    `json:"narSize"`
+	FileSize     int64    `json:"fileSize"`
+	Repositories []string `json:"repositories,omitempty"` // Repositories with this store path
+	References   []string `json:"references"`
+}
+
+// BuildGraph returns the graph of every package in lock or, if repo is not
+// empty, of the closure of that repository. Self-references are left out.
+// With reduce, edges implied by longer paths are dropped (the transitive
+// reduction), which makes large closures readable. Nodes are sorted by
+// store path.
+func BuildGraph(lock *Lockfile, repo string, reduce bool) (*Graph, error) {
+	storePaths := make([]string, 0, len(lock.Packages))
+	if repo != "" {
+		repoLock, ok := lock.Repositories[repo]
+		if !ok {
+			return nil, fmt.Errorf("repository %q not found in lockfile", repo)
+		}
+		storePaths = append(storePaths, repoLock.StorePath)
+		storePaths = append(storePaths, getTransitiveClosure(repoLock.StorePath, lock.Packages)...)
+	} else {
+		for storePath := range lock.Packages {
+			storePaths = append(storePaths, storePath)
+		}
+	}
+	sort.Strings(storePaths)
+
+	repos := make(map[string][]string)
+	for name, repoLock := range lock.Repositories {
+		repos[repoLock.StorePath] = append(repos[repoLock.StorePath], name)
+	}
+	edges := make(map[string][]string)
+	for _, storePath := range storePaths {
+		edges[storePath] = referencePaths(storePath, lock.Packages[storePath])
+	}
+	if reduce {
+		edges = transitiveReduction(edges)
+	}
+
+	graph := &Graph{Nodes: make([]GraphNode, 0, len(storePaths))}
+	for _, storePath := range storePaths {
+		node := lock.Packages[storePath]
+		name, version := parseStoreName(storePath)
+		names := repos[storePath]
+		sort.Strings(names)
+		graph.Nodes = append(graph.Nodes, GraphNode{
+			StorePath:    storePath,
+			Name:         name,
+			Version:      version,
+			NarSize:      node.NarSize,
+			FileSize:     node.FileSize,
+			Repositories: names,
+			References:   edges[storePath],
+		})
+	}
+	return graph, nil
+}
+
+// transitiveReduction drops every edge u -> v of the (acyclic) reference
+// graph for which v can also be reached through another reference of u.
+func transitiveReduction(edges map[string][]string) map[string][]string {
+	reach := make(map[string]map[string]bool)
+	var reachable func(string) map[string]bool
+	reachable = func(u string) map[string]bool {
+		if r, ok := reach[u]; ok {
+			return r
+		}
+		r := make(map[string]bool)
+		reach[u] = r // Guards against cycles
+		for _, v := range edges[u] {
+			r[v] = true
+			for w := range reachable(v) {
+				r[w] = true
+			}
+		}
+		return r
+	}
+
+	reduced := make(map[string][]string, len(edges))
+	for u, refs := range edges {
+		kept := []string{}
+		for _, v := range refs {
+			implied := false
+			for _, w := range refs {
+				if w != v && reachable(w)[v] {
+					implied = true
+					break
+				}
+			}
+			if !implied {
+				kept = append(kept, v)
+			}
+		}
+		reduced[u] = kept
+	}
+	return reduced
+}
+
+// label is a node's name, version and size for people.
+func (n GraphNode) label() string {
+	label := n.Name
+	if n.Version != "" {
+		label += " " + n.Version
+	}
+	return label + "\n" + FormatSize(n.NarSize)
+}
+
+// WriteDOT writes the graph in Graphviz DOT syntax. Repository store paths
+// are drawn bold.
+func (g *Graph) WriteDOT(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("digraph nix_deps {\n")
+	b.WriteString("  rankdir=LR;\n  node [shape=box];\n")
+	for _, n := range g.Nodes {
+		attrs := ""
+		if len(n.Repositories) > 0 {
+			attrs = ", style=bold"
+		}
+		fmt.Fprintf(&b, "  %s [label=%s%s];\n", dotQuote(path.Base(n.StorePath)), dotQuote(n.label()), attrs)
+	}
+	for _, n := range g.Nodes {
+		for _, ref := range n.References {
+			fmt.Fprintf(&b, "  %s -> %s;\n", dotQuote(path.Base(n.StorePath)), dotQuote(path.Base(ref)))
+		}
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// dotQuote quotes s as a DOT string.
+func dotQuote(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+	return `"` + s + `"`
+}
+
+// WriteGraphML writes the graph as GraphML, with the label, store path,
+// sizes and repositories of each node as data keys.
+func (g *Graph) WriteGraphML(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString(xml.Header)
+	b.WriteString(`<graphml xmlns="http://graphml.graphdrawing.org/xmlns">` + "\n")
+	for _, key := range []struct{ id, typ string }{
+		{"label", "string"},
+		{"storePath", "string"},
+		{"narSize", "long"},
+		{"fileSize", "long"},
+		{"repositories", "string"},
+	} {
+		fmt.Fprintf(&b, `  <key id="%s" for="node" attr.name="%s" attr.type="%s"/>`+"\n", key.id, key.id, key.typ)
+	}
+	b.WriteString(`  <graph id="nix_deps" edgedefault="directed">` + "\n")
+	for _, n := range g.Nodes {
+		fmt.Fprintf(&b, `    <node id="%s">`+"\n", xmlEscape(path.Base(n.StorePath)))
+		fmt.Fprintf(&b, `      <data key="label">%s</data>`+"\n", xmlEscape(n.label()))
+		fmt.Fprintf(&b, `      <data key="storePath">%s</data>`+"\n", xmlEscape(n.StorePath))
+		fmt.Fprintf(&b, `      <data key="narSize">%d</data>`+"\n", n.NarSize)
+		fmt.Fprintf(&b, `      <data key="fileSize">%d</data>`+"\n", n.FileSize)
+		if len(n.Repositories) > 0 {
+			fmt.Fprintf(&b, `      <data key="repositories">%s</data>`+"\n", xmlEscape(strings.Join(n.Repositories, " ")))
+		}
+		b.WriteString("    </node>\n")
+	}
+	for _, n := range g.Nodes {
+		for _, ref := range n.References {
+			fmt.Fprintf(&b, `    <edge source="%s" target="%s"/>`+"\n", xmlEscape(path.Base(n.StorePath)), xmlEscape(path.Base(ref)))
+		}
+	}
+	b.WriteString("  </graph>\n</graphml>\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// xmlEscape escapes s for XML text and attribute values.
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
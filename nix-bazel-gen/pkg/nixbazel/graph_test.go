@@ -0,0 +1,100 @@
+package nixbazel
+
+import (
+	"bytes"
+	"encoding/xml"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBuildGraph(t *testing.T) {
+	lock := testGraphLockfile()
+	references := func(graph *Graph) map[string][]string {
+		refs := make(map[string][]string)
+		for _, n := range graph.Nodes {
+			refs[n.StorePath] = n.References
+		}
+		return refs
+	}
+
+	graph, err := BuildGraph(lock, "imagemagick", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{
+		testMagickPath: {testRsvgPath, testLibcPath},
+		testRsvgPath:   {testPangoPath, testLLVMPath},
+		testPangoPath:  {testLLVMPath, testLibcPath},
+		testLLVMPath:   {testLibcPath},
+		testLibcPath:   {},
+	}
+	if got := references(graph); !reflect.DeepEqual(got, expected) {
+		t.Errorf("BuildGraph(imagemagick) references = %q, expected %q", got, expected)
+	}
+	if n := graph.Nodes[0]; n.StorePath != testMagickPath || n.Name != "imagemagick" || n.Version != "7.1.1" || !reflect.DeepEqual(n.Repositories, []string{"imagemagick"}) {
+		t.Errorf("first node = %+v, expected imagemagick 7.1.1", n)
+	}
+
+	graph, err = BuildGraph(lock, "imagemagick", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = map[string][]string{
+		testMagickPath: {testRsvgPath},
+		testRsvgPath:   {testPangoPath},
+		testPangoPath:  {testLLVMPath},
+		testLLVMPath:   {testLibcPath},
+		testLibcPath:   {},
+	}
+	if got := references(graph); !reflect.DeepEqual(got, expected) {
+		t.Errorf("reduced BuildGraph(imagemagick) references = %q, expected %q", got, expected)
+	}
+
+	if graph, err := BuildGraph(lock, "", false); err != nil || len(graph.Nodes) != len(lock.Packages) {
+		t.Errorf("BuildGraph() = %d nodes (%v), expected %d", len(graph.Nodes), err, len(lock.Packages))
+	}
+	if _, err := BuildGraph(lock, "missing", false); err == nil {
+		t.Error("BuildGraph(missing) succeeded, expected an error")
+	}
+}
+
+func TestGraphOutput(t *testing.T) {
+	graph, err := BuildGraph(testGraphLockfile(), "zlib", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dot bytes.Buffer
+	if err := graph.WriteDOT(&dot); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`  "gggggggggggggggggggggggggggggggg-zlib-1.3.1" [label="zlib 1.3.1\n10 B", style=bold];`,
+		`  "gggggggggggggggggggggggggggggggg-zlib-1.3.1" -> "ffffffffffffffffffffffffffffffff-glibc-2.40-66";`,
+	} {
+		if !strings.Contains(dot.String(), line+"\n") {
+			t.Errorf("DOT output %q does not contain %q", dot.String(), line)
+		}
+	}
+
+	var graphML bytes.Buffer
+	if err := graph.WriteGraphML(&graphML); err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Nodes []struct {
+			ID string `xml:"id,attr"`
+		} `xml:"graph>node"`
+		Edges []struct {
+			Source string `xml:"source,attr"`
+			Target string `xml:"target,attr"`
+		} `xml:"graph>edge"`
+	}
+	if err := xml.Unmarshal(graphML.Bytes(), &doc); err != nil {
+		t.Fatalf("GraphML output is not XML: %v", err)
+	}
+	if len(doc.Nodes) != 2 || len(doc.Edges) != 1 || doc.Edges[0].Target != "ffffffffffffffffffffffffffffffff-glibc-2.40-66" {
+		t.Errorf("GraphML output = %+v, expected 2 nodes and an edge to glibc", doc)
+	}
+}
@@ -0,0 +1,101 @@
+package nixbazel
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"zombiezen.com/go/nix"
+)
+
+// Hash is a NarHash or FileHash in any of the formats used by Nix, binary
+// caches and lockfiles.
+type Hash struct {
+	nix.Hash
+}
+
+// ParseHash parses "<type>:<nixbase32|hex|base64>" (narinfo files, the Nix
+// database), SRI "<type>-<base64>" (nix path-info) or the bare hex of
+// lockfiles, whose type follows from its length. Only sha256 and sha512 are
+// accepted.
+func ParseHash(s string) (Hash, error) {
+	if s == "" {
+		return Hash{}, fmt.Errorf("empty hash")
+	}
+	if !strings.ContainsAny(s, ":-") {
+		raw, err := hex.DecodeString(s)
+		if err != nil {
+			return Hash{}, fmt.Errorf("invalid hash %q: not hex and no type prefix", s)
+		}
+		switch len(raw) {
+		case nix.SHA256.Size():
+			return Hash{nix.NewHash(nix.SHA256, raw)}, nil
+		case nix.SHA512.Size():
+			return Hash{nix.NewHash(nix.SHA512, raw)}, nil
+		default:
+			return Hash{}, fmt.Errorf("invalid hash %q: %d bytes is neither sha256 nor sha512", s, len(raw))
+		}
+	}
+	h, err := nix.ParseHash(s)
+	if err != nil {
+		return Hash{}, fmt.Errorf("invalid hash %q: %w", s, err)
+	}
+	if h.Type() != nix.SHA256 && h.Type() != nix.SHA512 {
+		return Hash{}, fmt.Errorf("unsupported hash type %v in %q", h.Type(), s)
+	}
+	return Hash{h}, nil
+}
+
+// Hex is the form stored in lockfiles: the digest in hex, without a type.
+func (h Hash) Hex() string {
+	return h.RawBase16()
+}
+
+// hashToHex converts a hash in any format accepted by ParseHash to the hex
+// stored in lockfiles.
+func hashToHex(s string) (string, error) {
+	h, err := ParseHash(s)
+	if err != nil {
+		return "", err
+	}
+	return h.Hex(), nil
+}
+
+// hashVerifier hashes the data written to it with the algorithm of an
+// expected hash. A nil verifier accepts anything.
+type hashVerifier struct {
+	expected Hash
+	hasher   *nix.Hasher
+}
+
+// newHashVerifier returns a verifier for expected, or nil if expected is
+// empty.
+func newHashVerifier(expected string) (*hashVerifier, error) {
+	if expected == "" {
+		return nil, nil
+	}
+	h, err := ParseHash(expected)
+	if err != nil {
+		return nil, err
+	}
+	return &hashVerifier{expected: h, hasher: nix.NewHasher(h.Type())}, nil
+}
+
+func (v *hashVerifier) Write(p []byte) (int, error) {
+	if v != nil {
+		v.hasher.Write(p)
+	}
+	return len(p), nil
+}
+
+// verify compares the hash of the data written so far with the expected
+// hash. what names the data in the error.
+func (v *hashVerifier) verify(what string) error {
+	if v == nil {
+		return nil
+	}
+	if actual := v.hasher.SumHash(); !actual.Equal(v.expected.Hash) {
+		return fmt.Errorf("%s hash mismatch: got %s, expected %s", what, actual.RawBase16(), v.expected.Hex())
+	}
+	return nil
+}
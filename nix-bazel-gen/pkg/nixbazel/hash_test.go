@@ -0,0 +1,100 @@
+package nixbazel
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testSha512Hex = "9b71d224bd62f3785d96d46ad3ea3d73319bfbc2890caadae2dff72519673ca72323c3d99ba5c11d7c7acc6e14b8c5da0c4663475c2e5c3adef46f73bcdec043"
+
+func TestHashToHex(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"sha256:0gkxy2qfdi81lxzqbsdl2w5mdg0666s24inpa90ilvkb53ssmn3s", "7ad8aaf5286b6e1a4152d74622b43106bc560b17b4e9857fa701c5e6b0f07d3e"},
+		{"sha256:1fd9f9qbrlckn0yapnybfv4y9bwwsvq473ckp71ccvvspr5602fy", "de09604abe7a6fc6c2b9938d43f0d69cafe4c976cbdbab3cb093d1bc7072a9b9"},
+		{"sha256:7ad8aaf5286b6e1a4152d74622b43106bc560b17b4e9857fa701c5e6b0f07d3e", "7ad8aaf5286b6e1a4152d74622b43106bc560b17b4e9857fa701c5e6b0f07d3e"},
+		{"sha256:etiq9ShrbhpBUtdGIrQxBrxWCxe06YV/pwHF5rDwfT4=", "7ad8aaf5286b6e1a4152d74622b43106bc560b17b4e9857fa701c5e6b0f07d3e"},
+		{"sha256-etiq9ShrbhpBUtdGIrQxBrxWCxe06YV/pwHF5rDwfT4=", "7ad8aaf5286b6e1a4152d74622b43106bc560b17b4e9857fa701c5e6b0f07d3e"},
+		{"7ad8aaf5286b6e1a4152d74622b43106bc560b17b4e9857fa701c5e6b0f07d3e", "7ad8aaf5286b6e1a4152d74622b43106bc560b17b4e9857fa701c5e6b0f07d3e"},
+		{"sha512-m3HSJL1i83hdltRq0+o9czGb+8KJDKra4t/3JRlnPKcjI8PZm6XBHXx6zG4UuMXaDEZjR1wuXDre9G9zvN7AQw==", testSha512Hex},
+		{"sha512:" + testSha512Hex, testSha512Hex},
+		{testSha512Hex, testSha512Hex},
+	}
+
+	for _, test := range tests {
+		result, err := hashToHex(test.input)
+		if err != nil || result != test.expected {
+			t.Errorf("hashToHex(%q) = %q, %v, expected %q", test.input, result, err, test.expected)
+		}
+	}
+}
+
+func TestHashToHexErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"invalid",
+		"sha256-etiq9Shr",
+		"sha256:etiq9Shr",
+		"md5:d41d8cd98f00b204e9800998ecf8427e",
+		"sha1:da39a3ee5e6b4b0d3255bfef95601890afd80709",
+		"7ad8aaf5",
+	}
+
+	for _, test := range tests {
+		if result, err := hashToHex(test); err == nil {
+			t.Errorf("hashToHex(%q) = %q, expected an error", test, result)
+		}
+	}
+}
+
+func TestLockfileHashes(t *testing.T) {
+	dir := t.TempDir()
+	lockFile := filepath.Join(dir, "nix_deps.lock.json")
+	write := func(packages string) {
+		t.Helper()
+		if err := os.WriteFile(lockFile, []byte(`{"repositories": {}, "packages": {`+packages+`}}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lock := &Lockfile{
+		Repositories: map[string]RepositoryLock{},
+		Packages: map[string]ClosureNode{
+			testHelloPath: {URL: "nar/hello.nar.xz", NarHash: testHelloHash, FileHash: testSha512Hex},
+			testGlibcPath: {NarHash: testGlibcHash, LocalOnly: true},
+		},
+	}
+	if err := WriteLockfile(lockFile, lock); err != nil {
+		t.Fatal(err)
+	}
+	lock, err := LoadLockfile(lockFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if integrity := lock.Packages[testHelloPath].FileIntegrity; !strings.HasPrefix(integrity, "sha512-m3HSJL1i") {
+		t.Errorf("fileIntegrity = %q, expected the SRI of the sha512 file hash", integrity)
+	}
+	if integrity := lock.Packages[testGlibcPath].FileIntegrity; integrity != "" {
+		t.Errorf("fileIntegrity without a file hash = %q, expected none", integrity)
+	}
+
+	// nix_package passes the hashes to Bazel as they are, so anything but
+	// the hex written by WriteLockfile is an error
+	for _, packages := range []string{
+		`"` + testHelloPath + `": {"url": "nar/hello.nar.xz", "narHash": "` + testHelloHash + `", "fileHash": ""}`,
+		`"` + testHelloPath + `": {"narHash": "md5:d41d8cd98f00b204e9800998ecf8427e"}`,
+		`"` + testHelloPath + `": {"narHash": "sha256-etiq9ShrbhpBUtdGIrQxBrxWCxe06YV/pwHF5rDwfT4="}`,
+		`"` + testHelloPath + `": {"narHash": "` + strings.ToUpper(testHelloHash) + `"}`,
+		`"` + testHelloPath + `": {"url": "nar/hello.nar.xz", "narHash": "` + testHelloHash + `", "fileHash": "sha512:` + testSha512Hex + `"}`,
+		`"` + testHelloPath + `": {"url": "nar/hello.nar.xz", "narHash": "` + testHelloHash + `", "fileHash": "` + testSha512Hex + `"}`,
+	} {
+		write(packages)
+		if _, err := LoadLockfile(lockFile); err == nil {
+			t.Errorf("LoadLockfile accepted %s", packages)
+		}
+	}
+}
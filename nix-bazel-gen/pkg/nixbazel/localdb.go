@@ -0,0 +1,196 @@
+package nixbazel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+)
+
+// defaultNixDB is where Nix keeps the database of valid store paths.
+const defaultNixDB = "/nix/var/nix/db/db.sqlite"
+
+// nixbase32Alphabet is the alphabet of store path hashes.
+const nixbase32Alphabet = "0123456789abcdfghijklmnpqrsvwxyz"
+
+// LocalDB reads store path metadata from a local Nix database, so paths
+// built with a local "nix build" can be locked without a binary cache.
+type LocalDB struct {
+	Path string // Defaults to /nix/var/nix/db/db.sqlite
+}
+
+// localDBRow is one (path, reference) pair of a closure query.
+type localDBRow struct {
+	Path      string  `json:"path"`
+	Hash      string  `json:"hash"`
+	NarSize   int64   `json:"narSize"`
+	Reference *string `json:"reference"`
+}
+
+// query runs sql on the database with the sqlite3 command, opened read-only
+// so a running Nix daemon is not disturbed.
+func (db LocalDB) query(sql string) ([]localDBRow, error) {
+	dbPath := db.Path
+	if dbPath == "" {
+		dbPath = defaultNixDB
+	}
+	cmd := exec.Command("sqlite3", "-readonly", "-json", dbPath, sql)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to query %s: %w: %s", dbPath, err, strings.TrimSpace(stderr.String()))
+	}
+	// sqlite3 prints nothing, not [], when there are no rows
+	if len(bytes.TrimSpace(out)) == 0 {
+		return nil, nil
+	}
+	var rows []localDBRow
+	if err := json.Unmarshal(out, &rows); err != nil {
+		return nil, fmt.Errorf("failed to parse sqlite3 output: %w", err)
+	}
+	return rows, nil
+}
+
+// Closure returns the store path with the given hash part and the nodes of
+// its closure, keyed by store path. The store path is empty if the database
+// has no valid path with that hash. URLs and file hashes are left empty:
+// they only exist on a binary cache.
+func (db LocalDB) Closure(hash string) (string, map[string]ClosureNode, error) {
+	if len(hash) != storePathHashLen || strings.Trim(hash, nixbase32Alphabet) != "" {
+		return "", nil, fmt.Errorf("invalid store path hash %q", hash)
+	}
+	rows, err := db.query(fmt.Sprintf(`
+WITH RECURSIVE closure(id) AS (
+  SELECT id FROM ValidPaths WHERE path LIKE '%s/%s-%%'
+  UNION
+  SELECT Refs.reference FROM Refs JOIN closure ON Refs.referrer = closure.id
+)
+SELECT v.path AS path, v.hash AS hash, v.narSize AS narSize, r.path AS reference
+FROM closure
+JOIN ValidPaths v ON v.id = closure.id
+LEFT JOIN Refs ON Refs.referrer = v.id
+LEFT JOIN ValidPaths r ON r.id = Refs.reference
+ORDER BY v.path, r.path;`, nixStoreDir, hash))
+	if err != nil {
+		return "", nil, err
+	}
+
+	root := ""
+	nodes := make(map[string]ClosureNode)
+	for _, row := range rows {
+		node, ok := nodes[row.Path]
+		if !ok {
+			narHash, err := hashToHex(row.Hash)
+			if err != nil {
+				return "", nil, fmt.Errorf("bad NarHash for %s: %w", row.Path, err)
+			}
+			node = ClosureNode{
+				Hash:       extractHash(row.Path),
+				NarHash:    narHash,
+				NarSize:    row.NarSize,
+				References: []string{},
+			}
+		}
+		if row.Reference != nil {
+			// References are basenames, as in narinfo files
+			node.References = append(node.References, path.Base(*row.Reference))
+		}
+		nodes[row.Path] = node
+		if node.Hash == hash {
+			root = row.Path
+		}
+	}
+	return root, nodes, nil
+}
+
+// resolveLocalClosure adds the closure of the store path with the given hash
+// part from db to closure and returns the store path, or "" if db does not
+// have it. New paths are looked up on substituters (see mergeNodes).
+func (f *Fetcher) resolveLocalClosure(ctx context.Context, db LocalDB, hash string, closure map[string]ClosureNode, substituters []string) (string, error) {
+	storePath, nodes, err := db.Closure(hash)
+	if err != nil || storePath == "" {
+		return "", err
+	}
+	f.mergeNodes(ctx, nodes, closure, substituters)
+	return storePath, nil
+}
+
+// mergeNodes adds nodes to closure. Nodes without a URL are looked up on
+// substituters (default: cache.nixos.org); paths none of them has are
+// marked LocalOnly and warned about. Paths already in closure with a URL are
+// kept.
+func (f *Fetcher) mergeNodes(ctx context.Context, nodes, closure map[string]ClosureNode, substituters []string) {
+	if len(substituters) == 0 {
+		substituters = []string{defaultCacheURL}
+	}
+	storePaths := make([]string, 0, len(nodes))
+	for p := range nodes {
+		storePaths = append(storePaths, p)
+	}
+	sort.Strings(storePaths)
+	for _, p := range storePaths {
+		// Paths pushed since the last resolve get their URL now
+		if existing, ok := closure[p]; ok && !existing.LocalOnly {
+			continue
+		}
+		node := nodes[p]
+		if node.URL == "" && !f.substitute(ctx, substituters, p, &node) {
+			fmt.Fprintf(f.progress, "Warning: %s is not available on any substituter\n", p)
+			node.LocalOnly = true
+		}
+		closure[p] = node
+	}
+}
+
+// substitute fills in the URL and file hash of node from the first
+// substituter that has storePath with the same NarHash. URLs on substituters
+// other than the fetcher's cache are made absolute.
+func (f *Fetcher) substitute(ctx context.Context, substituters []string, storePath string, node *ClosureNode) bool {
+	for _, substituter := range substituters {
+		cache := NewFetcher(substituter, "")
+		cache.client = f.client
+		cache.progress = f.progress
+		info, err := cache.getNarInfo(ctx, node.Hash)
+		if err != nil {
+			continue
+		}
+		narHash, err := hashToHex(info.NarHash)
+		if err != nil || info.StorePath != storePath || narHash != node.NarHash {
+			fmt.Fprintf(f.progress, "Warning: %s on %s has NarHash %q, expected %s\n", storePath, substituter, info.NarHash, node.NarHash)
+			continue
+		}
+		fileHash, err := hashToHex(info.FileHash)
+		if err != nil {
+			fmt.Fprintf(f.progress, "Warning: %s on %s: bad FileHash: %v\n", storePath, substituter, err)
+			continue
+		}
+		node.URL = info.URL
+		if cache.cacheURL != f.cacheURL {
+			node.URL = cache.cacheURL + "/" + info.URL
+		}
+		node.FileHash = fileHash
+		node.FileSize = info.FileSize
+		return true
+	}
+	return false
+}
+
+// manifestFromStore builds the manifest of a store path that only exists in
+// the local store by serialising it to a NAR.
+func manifestFromStore(storePath string) (*Manifest, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := PackNar(pw, storePath, "none")
+		pw.CloseWithError(err)
+	}()
+	m, err := manifestFromNar(storePath, pr)
+	// Drain the rest so the writer finishes
+	io.Copy(io.Discard, pr)
+	return m, err
+}
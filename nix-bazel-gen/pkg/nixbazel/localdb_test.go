@@ -0,0 +1,102 @@
+package nixbazel
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const (
+	testHelloPath = "/nix/store/0a0mn0ljd2r5ygi8w5jdd9g7hdnkvbs8-hello-2.12"
+	testGlibcPath = "/nix/store/1b1mn0ljd2r5ygi8w5jdd9g7hdnkvbs8-glibc-2.40"
+	testHelloHash = "7ad8aaf5286b6e1a4152d74622b43106bc560b17b4e9857fa701c5e6b0f07d3e"
+	testGlibcHash = "de09604abe7a6fc6c2b9938d43f0d69cafe4c976cbdbab3cb093d1bc7072a9b9"
+)
+
+// writeTestNixDB creates a database with the parts of the Nix schema that
+// LocalDB reads: hello refers to glibc, glibc to itself.
+func writeTestNixDB(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skip("sqlite3 not available")
+	}
+	db := filepath.Join(t.TempDir(), "db.sqlite")
+	cmd := exec.Command("sqlite3", db, `
+CREATE TABLE ValidPaths (id integer primary key autoincrement not null, path text unique not null, hash text not null, registrationTime integer not null, deriver text, narSize integer, ultimate integer, sigs text, ca text);
+CREATE TABLE Refs (referrer integer not null, reference integer not null, primary key (referrer, reference));
+INSERT INTO ValidPaths (id, path, hash, registrationTime, narSize) VALUES
+  (1, '`+testGlibcPath+`', 'sha256:`+testGlibcHash+`', 0, 2000),
+  (2, '`+testHelloPath+`', 'sha256:`+testHelloHash+`', 0, 1000),
+  (3, '/nix/store/2c2mn0ljd2r5ygi8w5jdd9g7hdnkvbs8-unrelated', 'sha256:`+testGlibcHash+`', 0, 10);
+INSERT INTO Refs VALUES (1, 1), (2, 1);`)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("sqlite3: %v: %s", err, out)
+	}
+	return db
+}
+
+func TestLocalDBClosure(t *testing.T) {
+	db := LocalDB{Path: writeTestNixDB(t)}
+	root, nodes, err := db.Closure(extractHash(testHelloPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root != testHelloPath {
+		t.Errorf("root = %q, expected %q", root, testHelloPath)
+	}
+	expected := map[string]ClosureNode{
+		testHelloPath: {Hash: extractHash(testHelloPath), NarHash: testHelloHash, NarSize: 1000, References: []string{filepath.Base(testGlibcPath)}},
+		testGlibcPath: {Hash: extractHash(testGlibcPath), NarHash: testGlibcHash, NarSize: 2000, References: []string{filepath.Base(testGlibcPath)}},
+	}
+	if !reflect.DeepEqual(nodes, expected) {
+		t.Errorf("nodes = %+v, expected %+v", nodes, expected)
+	}
+
+	root, _, err = db.Closure("3d3mn0ljd2r5ygi8w5jdd9g7hdnkvbs8")
+	if err != nil || root != "" {
+		t.Errorf("Closure of a missing path = %q, %v, expected no path", root, err)
+	}
+	if _, _, err := db.Closure("'; DROP TABLE Refs; --"); err == nil {
+		t.Errorf("Closure accepted an invalid hash")
+	}
+}
+
+func TestResolveLocalClosure(t *testing.T) {
+	// The substituter only has glibc
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/"+extractHash(testGlibcPath)+".narinfo" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("StorePath: " + testGlibcPath + "\n" +
+			"URL: nar/glibc.nar.xz\n" +
+			"Compression: xz\n" +
+			"FileHash: sha256:0gkxy2qfdi81lxzqbsdl2w5mdg0666s24inpa90ilvkb53ssmn3s\n" +
+			"FileSize: 500\n" +
+			"NarHash: sha256:1fd9f9qbrlckn0yapnybfv4y9bwwsvq473ckp71ccvvspr5602fy\n" +
+			"NarSize: 2000\n"))
+	}))
+	defer server.Close()
+
+	f := NewFetcher(server.URL, "")
+	db := LocalDB{Path: writeTestNixDB(t)}
+	closure := make(map[string]ClosureNode)
+	storePath, err := f.resolveLocalClosure(context.Background(), db, extractHash(testHelloPath), closure, []string{server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storePath != testHelloPath {
+		t.Errorf("store path = %q, expected %q", storePath, testHelloPath)
+	}
+	if hello := closure[testHelloPath]; !hello.LocalOnly || hello.URL != "" {
+		t.Errorf("hello = %+v, expected a local-only path", hello)
+	}
+	glibc := closure[testGlibcPath]
+	if glibc.LocalOnly || glibc.URL != "nar/glibc.nar.xz" || glibc.FileHash != testHelloHash || glibc.FileSize != 500 {
+		t.Errorf("glibc = %+v, expected it on the substituter", glibc)
+	}
+}
@@ -0,0 +1,134 @@
+package nixbazel
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// LocalStore is an existing Nix store used as a source of store paths
+// before downloading them from the cache.
+type LocalStore struct {
+	Dir string // Defaults to /nix/store
+	// Symlink links store paths into the output directory instead of
+	// copying them. Symlinked paths are not patched, relocated, rewritten or
+	// canonicalised, since that would modify the local store.
+	Symlink bool
+	// Verify repacks a local path and compares its NarHash with the lockfile
+	// before using it.
+	Verify bool
+}
+
+// SetLocalStore makes the fetcher take store paths from a local Nix store
+// when they exist there, falling back to the cache otherwise.
+func (f *Fetcher) SetLocalStore(ls LocalStore) {
+	if ls.Dir == "" {
+		ls.Dir = nixStoreDir
+	}
+	f.localStore = &ls
+}
+
+// fromLocalStore places storePath in f.outDir from the local store. It
+// reports false if there is no usable local copy. narHash, if known, is the
+// expected hash in hex or "sha256:<nixbase32>" form.
+func (f *Fetcher) fromLocalStore(storePath, narHash string) (bool, error) {
+	if f.localStore == nil {
+		return false, nil
+	}
+	src := filepath.Join(f.localStore.Dir, filepath.Base(storePath))
+	if _, err := os.Lstat(src); err != nil {
+		return false, nil
+	}
+
+	if f.localStore.Verify {
+		if narHash == "" {
+			fmt.Fprintf(f.progress, "Not using local %s: no NarHash to verify it against\n", src)
+			return false, nil
+		}
+		verifier, err := newHashVerifier(narHash)
+		if err != nil {
+			return false, fmt.Errorf("bad NarHash for %s: %w", storePath, err)
+		}
+		if _, err := packNar(io.Discard, src, "none", verifier); err != nil {
+			fmt.Fprintf(f.progress, "Not using local %s: %v\n", src, err)
+			return false, nil
+		}
+		if err := verifier.verify("NAR"); err != nil {
+			fmt.Fprintf(f.progress, "Not using local %s: %v\n", src, err)
+			return false, nil
+		}
+	}
+
+	dest := filepath.Join(f.outDir, filepath.Base(storePath))
+	if err := removeTree(dest); err != nil {
+		return false, fmt.Errorf("failed to clean destination %s: %w", dest, err)
+	}
+	if err := os.MkdirAll(f.outDir, 0755); err != nil {
+		return false, err
+	}
+	if f.localStore.Symlink {
+		fmt.Fprintf(f.progress, "Linking %s from local store\n", dest)
+		return true, os.Symlink(src, dest)
+	}
+	fmt.Fprintf(f.progress, "Copying %s from local store\n", dest)
+	if err := copyTree(src, dest); err != nil {
+		return false, fmt.Errorf("failed to copy %s: %w", src, err)
+	}
+	return true, nil
+}
+
+// copyTree copies a store path, keeping symlinks as they are and only the
+// executable bit of file modes, as a NAR would.
+func copyTree(src, dest string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+
+		switch {
+		case d.IsDir():
+			return os.Mkdir(target, 0755)
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case d.Type().IsRegular():
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			return copyFile(path, target, fileMode(info.Mode(), false))
+		default:
+			return fmt.Errorf("unsupported file type %v for %s", d.Type(), path)
+		}
+	})
+}
+
+func copyFile(src, dest string, mode fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chmod(dest, mode)
+}
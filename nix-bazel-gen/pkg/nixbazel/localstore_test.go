@@ -0,0 +1,77 @@
+package nixbazel
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalStore(t *testing.T) {
+	dir := t.TempDir()
+	store := filepath.Join(dir, "store")
+	local := filepath.Join(store, "abc-hello")
+	if err := os.MkdirAll(filepath.Join(local, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(local, "bin/hello"), []byte("local\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/nix/store/def-glibc/lib", filepath.Join(local, "lib")); err != nil {
+		t.Fatal(err)
+	}
+	pack, err := PackNar(io.Discard, local, "none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	narHash := pack.NarHash.RawBase16()
+
+	archive := writeTestArchive(t, dir, "hello.nar.xz", []testNarEntry{
+		{path: "", mode: fs.ModeDir},
+		{path: "bin", mode: fs.ModeDir},
+		{path: "bin/hello", mode: 0755, content: "archive\n"},
+	})
+
+	tests := []struct {
+		name     string
+		ls       LocalStore
+		narHash  string
+		expected string // Contents of bin/hello
+		symlink  bool
+	}{
+		{"copy", LocalStore{Dir: store}, "", "local\n", false},
+		{"symlink", LocalStore{Dir: store, Symlink: true}, "", "local\n", true},
+		{"verified", LocalStore{Dir: store, Verify: true}, narHash, "local\n", false},
+		{"mismatch", LocalStore{Dir: store, Verify: true}, "00" + narHash[2:], "archive\n", false},
+		{"missing", LocalStore{Dir: filepath.Join(dir, "empty")}, "", "archive\n", false},
+	}
+	for _, test := range tests {
+		root := filepath.Join(dir, test.name)
+		f := NewFetcher("", root)
+		f.SetLocalStore(test.ls)
+		if err := f.unpack(UnpackRequest{Archive: archive, StorePath: "/nix/store/abc-hello", NarHash: test.narHash}); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		data, err := os.ReadFile(filepath.Join(root, "abc-hello/bin/hello"))
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if string(data) != test.expected {
+			t.Errorf("%s: bin/hello = %q, expected %q", test.name, data, test.expected)
+		}
+		info, err := os.Lstat(filepath.Join(root, "abc-hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if symlink := info.Mode()&fs.ModeSymlink != 0; symlink != test.symlink {
+			t.Errorf("%s: abc-hello is a symlink = %v, expected %v", test.name, symlink, test.symlink)
+		}
+		if test.expected == "local\n" && !test.symlink {
+			if target, err := os.Readlink(filepath.Join(root, "abc-hello/lib")); err != nil || target != "/nix/store/def-glibc/lib" {
+				t.Errorf("%s: lib -> %q, %v, expected /nix/store/def-glibc/lib", test.name, target, err)
+			}
+		}
+	}
+}
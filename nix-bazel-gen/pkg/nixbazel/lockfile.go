@@ -0,0 +1,89 @@
+package nixbazel
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"zombiezen.com/go/nix"
+)
+
+// LoadLockfile reads a lockfile and checks the hashes of its packages.
+// Hashes written in another format (e.g. SRI by hand) are converted to hex;
+// a missing or malformed hash is an error rather than an empty string.
+func LoadLockfile(path string) (*Lockfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lockfile: %w", err)
+	}
+	var lock Lockfile
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, fmt.Errorf("failed to parse lockfile: %w", err)
+	}
+	for storePath, node := range lock.Packages {
+		if err := validateNodeHashes(node); err != nil {
+			return nil, fmt.Errorf("lockfile %s: package %s: %w", path, storePath, err)
+		}
+	}
+	return &lock, nil
+}
+
+// validateNodeHashes checks that the hashes of node are the lowercase hex
+// written by WriteLockfile, which nix_package hands to Bazel unchanged, and
+// that a file hash other than sha256 has its fileIntegrity. Nodes without a
+// URL (only in a local store) may have no file hash.
+func validateNodeHashes(node ClosureNode) error {
+	if _, err := parseHexHash(node.NarHash); err != nil {
+		return fmt.Errorf("bad narHash: %w", err)
+	}
+	if node.FileHash == "" && node.URL == "" {
+		return nil
+	}
+	h, err := parseHexHash(node.FileHash)
+	if err != nil {
+		return fmt.Errorf("bad fileHash: %w", err)
+	}
+	if h.Type() != nix.SHA256 && node.FileIntegrity == "" {
+		return fmt.Errorf("fileHash is %v but there is no fileIntegrity", h.Type())
+	}
+	return nil
+}
+
+// parseHexHash parses a hash in the hex form of lockfiles.
+func parseHexHash(s string) (Hash, error) {
+	h, err := ParseHash(s)
+	if err != nil {
+		return Hash{}, err
+	}
+	if s != h.Hex() {
+		return Hash{}, fmt.Errorf("hash %q is not lowercase hex", s)
+	}
+	return h, nil
+}
+
+// WriteLockfile writes lock to path. Packages with a sha512 file hash also
+// get a fileIntegrity (SRI), since Bazel's download only takes hex for
+// sha256.
+func WriteLockfile(path string, lock *Lockfile) error {
+	for storePath, node := range lock.Packages {
+		node.FileIntegrity = ""
+		if node.FileHash != "" {
+			h, err := ParseHash(node.FileHash)
+			if err != nil {
+				return fmt.Errorf("package %s: bad fileHash: %w", storePath, err)
+			}
+			if h.Type() != nix.SHA256 {
+				node.FileIntegrity = h.SRI()
+			}
+		}
+		lock.Packages[storePath] = node
+	}
+	data, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal lockfile: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write lockfile: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+package nixbazel
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/ulikunitz/xz"
+	"zombiezen.com/go/nix/nar"
+)
+
+// Entry types recorded in a Manifest.
+const (
+	EntryRegular   = "regular"
+	EntryDirectory = "directory"
+	EntrySymlink   = "symlink"
+)
+
+// ManifestEntry describes a single file system object inside a store path.
+type ManifestEntry struct {
+	Path       string `json:"path"` // Relative to the store path, "" for the root
+	Type       string `json:"type"`
+	Executable bool   `json:"executable,omitempty"`
+	Size       int64  `json:"size,omitempty"`
+	Target     string `json:"target,omitempty"` // Symlink target
+}
+
+// Manifest lists the contents of a single NAR.
+type Manifest struct {
+	StorePath string          `json:"storePath"`
+	Entries   []ManifestEntry `json:"entries"`
+	// PkgConfig holds the contents of the package's pkg-config files, keyed
+	// by path.
+	PkgConfig map[string]string `json:"pkgConfig,omitempty"`
+}
+
+// maxPkgConfigSize bounds the pkg-config files we keep in a manifest.
+const maxPkgConfigSize = 64 * 1024
+
+// isPkgConfigPath reports whether p is in one of pkg-config's default search
+// directories.
+func isPkgConfigPath(p string) bool {
+	dir, name := path.Split(p)
+	return (dir == "lib/pkgconfig/" || dir == "share/pkgconfig/") && strings.HasSuffix(name, ".pc")
+}
+
+// needsPkgConfig reports whether the manifest lists pkg-config files whose
+// contents have not been recorded.
+func (m *Manifest) needsPkgConfig() bool {
+	for _, e := range m.Entries {
+		if e.Type == EntryRegular && e.Size <= maxPkgConfigSize && isPkgConfigPath(e.Path) {
+			if _, ok := m.PkgConfig[e.Path]; !ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Manifests represents the nix_deps.manifest.json sidecar, keyed by NarHash
+// (hex, as stored in the lockfile).
+type Manifests map[string]*Manifest
+
+// ManifestPath returns the sidecar path that belongs to lockFile:
+// "x.lock.json" and "x.json" both become "x.manifest.json". _manifest_path
+// in nix_package.bzl must follow the same rule.
+func ManifestPath(lockFile string) string {
+	if strings.HasSuffix(lockFile, ".lock.json") {
+		return strings.TrimSuffix(lockFile, ".lock.json") + ".manifest.json"
+	}
+	return strings.TrimSuffix(lockFile, ".json") + ".manifest.json"
+}
+
+// LoadManifests reads a manifest sidecar. A missing file yields an empty set.
+func LoadManifests(path string) (Manifests, error) {
+	manifests := make(Manifests)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return manifests, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifests: %w", err)
+	}
+	if err := json.Unmarshal(data, &manifests); err != nil {
+		return nil, fmt.Errorf("failed to parse manifests: %w", err)
+	}
+	return manifests, nil
+}
+
+// WriteManifests writes the manifest sidecar.
+func WriteManifests(path string, manifests Manifests) error {
+	data, err := json.MarshalIndent(manifests, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifests: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write manifests: %w", err)
+	}
+	return nil
+}
+
+// Lookup returns the entry at path, or nil if the manifest does not contain it.
+func (m *Manifest) Lookup(path string) *ManifestEntry {
+	i := sort.Search(len(m.Entries), func(i int) bool { return m.Entries[i].Path >= path })
+	if i < len(m.Entries) && m.Entries[i].Path == path {
+		return &m.Entries[i]
+	}
+	return nil
+}
+
+// Dir returns the direct children of the directory at path.
+func (m *Manifest) Dir(path string) []ManifestEntry {
+	prefix := path + "/"
+	if path == "" {
+		prefix = ""
+	}
+	var children []ManifestEntry
+	for _, e := range m.Entries {
+		if e.Path == "" || !strings.HasPrefix(e.Path, prefix) {
+			continue
+		}
+		if !strings.Contains(strings.TrimPrefix(e.Path, prefix), "/") {
+			children = append(children, e)
+		}
+	}
+	return children
+}
+
+func manifestEntryFromHeader(hdr *nar.Header) ManifestEntry {
+	e := ManifestEntry{Path: hdr.Path}
+	switch {
+	case hdr.Mode.IsDir():
+		e.Type = EntryDirectory
+	case hdr.Mode&fs.ModeSymlink != 0:
+		e.Type = EntrySymlink
+		e.Target = hdr.LinkTarget
+	default:
+		e.Type = EntryRegular
+		e.Executable = hdr.Mode&0111 != 0
+		e.Size = hdr.Size
+	}
+	return e
+}
+
+func manifestFromListing(storePath string, ls *nar.Listing) *Manifest {
+	m := &Manifest{StorePath: storePath}
+	var walk func(node *nar.ListingNode)
+	walk = func(node *nar.ListingNode) {
+		m.Entries = append(m.Entries, manifestEntryFromHeader(&node.Header))
+		for _, child := range node.Entries {
+			walk(child)
+		}
+	}
+	walk(&ls.Root)
+	sort.Slice(m.Entries, func(i, j int) bool { return m.Entries[i].Path < m.Entries[j].Path })
+	return m
+}
+
+func manifestFromNar(storePath string, r io.Reader) (*Manifest, error) {
+	m := &Manifest{StorePath: storePath}
+	narReader := nar.NewReader(r)
+	for {
+		hdr, err := narReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		m.Entries = append(m.Entries, manifestEntryFromHeader(hdr))
+
+		if hdr.Mode.IsRegular() && hdr.Size <= maxPkgConfigSize && isPkgConfigPath(hdr.Path) {
+			data, err := io.ReadAll(narReader)
+			if err != nil {
+				return nil, err
+			}
+			if m.PkgConfig == nil {
+				m.PkgConfig = make(map[string]string)
+			}
+			m.PkgConfig[hdr.Path] = string(data)
+		}
+	}
+	sort.Slice(m.Entries, func(i, j int) bool { return m.Entries[i].Path < m.Entries[j].Path })
+	return m, nil
+}
+
+// recordManifest stores the manifest for a resolved store path unless one is
+// already known for its NarHash.
+func (f *Fetcher) recordManifest(ctx context.Context, hash string, info *NarInfo, narHash string) error {
+	if m, ok := f.manifests[narHash]; ok && !m.needsPkgConfig() {
+		return nil
+	}
+	fmt.Fprintf(f.progress, "Recording manifest for %s...\n", info.StorePath)
+	m, err := f.fetchManifest(ctx, hash, info)
+	if err != nil {
+		return fmt.Errorf("failed to record manifest for %s: %w", info.StorePath, err)
+	}
+	f.manifests[narHash] = m
+	return nil
+}
+
+// fetchManifest builds the manifest for a store path, preferring the cache's
+// .ls listing and falling back to streaming the NAR once. The NAR is also
+// streamed when the listing shows pkg-config files, whose contents we keep.
+func (f *Fetcher) fetchManifest(ctx context.Context, hash string, info *NarInfo) (*Manifest, error) {
+	if info.URL == "" {
+		// Only in the local store (see LocalDB)
+		return manifestFromStore(info.StorePath)
+	}
+	m, err := f.fetchListing(ctx, hash, info.StorePath)
+	if err == nil && !m.needsPkgConfig() {
+		return m, nil
+	}
+	if err != nil {
+		fmt.Fprintf(f.progress, "Listing unavailable for %s (%v), streaming NAR...\n", hash, err)
+	}
+
+	url := f.narURL(info.URL)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download failed: %d", resp.StatusCode)
+	}
+
+	r, wait, err := decompress(resp.Body, info.Compression)
+	if err != nil {
+		return nil, err
+	}
+	m, err = manifestFromNar(info.StorePath, r)
+	if err != nil {
+		return nil, err
+	}
+	if err := wait(); err != nil {
+		return nil, fmt.Errorf("decompression failed: %w", err)
+	}
+	return m, nil
+}
+
+func (f *Fetcher) fetchListing(ctx context.Context, hash, storePath string) (*Manifest, error) {
+	url := fmt.Sprintf("%s/%s%s", f.cacheURL, hash, nar.ListingExtension)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	// Listings are stored compressed with Nix's ls-compression, brotli on
+	// cache.nixos.org, and served with the matching Content-Encoding
+	var body io.Reader = resp.Body
+	switch enc := resp.Header.Get("Content-Encoding"); enc {
+	case "", "identity":
+	case "br":
+		body = brotli.NewReader(resp.Body)
+	case "gzip":
+		if body, err = gzip.NewReader(resp.Body); err != nil {
+			return nil, fmt.Errorf("failed to decode listing: %w", err)
+		}
+	case "xz":
+		if body, err = xz.NewReader(resp.Body); err != nil {
+			return nil, fmt.Errorf("failed to decode listing: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", enc)
+	}
+
+	var ls nar.Listing
+	if err := json.NewDecoder(body).Decode(&ls); err != nil {
+		return nil, fmt.Errorf("failed to decode listing: %w", err)
+	}
+	return manifestFromListing(storePath, &ls), nil
+}
@@ -0,0 +1,145 @@
+package nixbazel
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/ulikunitz/xz"
+	"zombiezen.com/go/nix/nar"
+)
+
+// testNarEntry describes a file for buildTestNar.
+type testNarEntry struct {
+	path    string
+	mode    fs.FileMode
+	content string
+	target  string
+}
+
+// buildTestNar serialises entries (in NAR order) into an in-memory NAR.
+func buildTestNar(t testing.TB, entries []testNarEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := nar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &nar.Header{
+			Path:       e.path,
+			Mode:       e.mode,
+			Size:       int64(len(e.content)),
+			LinkTarget: e.target,
+		}
+		if err := w.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader(%q): %v", e.path, err)
+		}
+		if e.mode.IsRegular() {
+			if _, err := w.Write([]byte(e.content)); err != nil {
+				t.Fatalf("Write(%q): %v", e.path, err)
+			}
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestManifestFromNar(t *testing.T) {
+	data := buildTestNar(t, []testNarEntry{
+		{path: "", mode: fs.ModeDir},
+		{path: "bin", mode: fs.ModeDir},
+		{path: "bin/hello", mode: 0555, content: "#!/bin/sh\n"},
+		{path: "bin/hi", mode: fs.ModeSymlink, target: "hello"},
+		{path: "share", mode: fs.ModeDir},
+		{path: "share/doc.txt", mode: 0444, content: "docs"},
+	})
+
+	m, err := manifestFromNar("/nix/store/x34bh6s6ighg7lb74nkjbx3nx52zj0j9-hello", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Entries) != 6 {
+		t.Fatalf("got %d entries, expected 6", len(m.Entries))
+	}
+
+	hello := m.Lookup("bin/hello")
+	if hello == nil || hello.Type != EntryRegular || !hello.Executable || hello.Size != 10 {
+		t.Errorf("Lookup(bin/hello) = %+v", hello)
+	}
+	hi := m.Lookup("bin/hi")
+	if hi == nil || hi.Type != EntrySymlink || hi.Target != "hello" {
+		t.Errorf("Lookup(bin/hi) = %+v", hi)
+	}
+	if doc := m.Lookup("share/doc.txt"); doc == nil || doc.Executable {
+		t.Errorf("Lookup(share/doc.txt) = %+v", doc)
+	}
+	if m.Lookup("missing") != nil {
+		t.Errorf("Lookup(missing) should be nil")
+	}
+
+	if got := len(m.Dir("bin")); got != 2 {
+		t.Errorf("Dir(bin) has %d entries, expected 2", got)
+	}
+	if got := len(m.Dir("")); got != 2 {
+		t.Errorf("Dir(\"\") has %d entries, expected 2", got)
+	}
+}
+
+func TestManifestPath(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"nix_deps.lock.json", "nix_deps.manifest.json"},
+		{"/ws/other.json", "/ws/other.manifest.json"},
+		{"/ws/deps.lock", "/ws/deps.lock.manifest.json"},
+	}
+
+	for _, test := range tests {
+		result := ManifestPath(test.input)
+		if result != test.expected {
+			t.Errorf("ManifestPath(%q) = %q, expected %q", test.input, result, test.expected)
+		}
+	}
+}
+
+func TestFetchListingEncoded(t *testing.T) {
+	const listing = `{"version":1,"root":{"type":"directory","entries":{"bin":{"type":"directory","entries":{"hello":{"type":"regular","size":10,"executable":true,"narOffset":400}}}}}}`
+	encoders := map[string]func(io.Writer) io.WriteCloser{
+		"br": func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) },
+		"xz": func(w io.Writer) io.WriteCloser {
+			xw, err := xz.NewWriter(w)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return xw
+		},
+		"identity": func(w io.Writer) io.WriteCloser { return nopWriteCloser{w} },
+	}
+
+	for encoding, encoder := range encoders {
+		var body bytes.Buffer
+		w := encoder(&body)
+		w.Write([]byte(listing))
+		w.Close()
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", encoding)
+			w.Write(body.Bytes())
+		}))
+
+		m, err := NewFetcher(server.URL, "").fetchListing(context.Background(), extractHash(testHelloPath), testHelloPath)
+		server.Close()
+		if err != nil {
+			t.Errorf("fetchListing(%s) failed: %v", encoding, err)
+			continue
+		}
+		if hello := m.Lookup("bin/hello"); hello == nil || !hello.Executable || hello.Size != 10 {
+			t.Errorf("fetchListing(%s): Lookup(bin/hello) = %+v", encoding, hello)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package nixbazel
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MirrorReport summarises a Mirror run.
+type MirrorReport struct {
+	Copied    []string `json:"copied"`
+	Skipped   []string `json:"skipped"`   // Already in the destination
+	LocalOnly []string `json:"localOnly"` // Not on any cache, see LocalDB
+	Bytes     int64    `json:"bytes"`     // Compressed NAR bytes copied
+}
+
+// Mirror copies the narinfo and NAR of every package in lock from the cache
+// it was locked from to dest (an http(s):// or file:// cache), so builds can
+// use dest as their only substituter. narinfos are copied unchanged, keeping
+// their signatures. Up to jobs paths are copied at once.
+func (f *Fetcher) Mirror(ctx context.Context, lock *Lockfile, dest string, jobs int) (*MirrorReport, error) {
+	if jobs < 1 {
+		jobs = 1
+	}
+	destCache := NewFetcher(dest, "")
+	destCache.client = f.client
+	destCache.progress = f.progress
+
+	report := &MirrorReport{Copied: []string{}, Skipped: []string{}, LocalOnly: []string{}}
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	sem := make(chan struct{}, jobs)
+	for storePath, node := range lock.Packages {
+		if node.LocalOnly || node.URL == "" {
+			report.LocalOnly = append(report.LocalOnly, storePath)
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(storePath string, node ClosureNode) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			copied, err := f.mirrorPath(ctx, destCache, storePath, node)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err != nil:
+				once.Do(func() { firstErr = fmt.Errorf("failed to mirror %s: %w", storePath, err) })
+			case copied:
+				report.Copied = append(report.Copied, storePath)
+				report.Bytes += node.FileSize
+			default:
+				report.Skipped = append(report.Skipped, storePath)
+			}
+		}(storePath, node)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	sort.Strings(report.Copied)
+	sort.Strings(report.Skipped)
+	sort.Strings(report.LocalOnly)
+	return report, nil
+}
+
+// mirrorPath copies one store path to destCache unless its narinfo is
+// already there. The NAR is checked against node.FileHash before it is
+// written to destCache, and goes before the narinfo, so the narinfo never
+// points at a missing or corrupt file.
+func (f *Fetcher) mirrorPath(ctx context.Context, destCache *Fetcher, storePath string, node ClosureNode) (bool, error) {
+	narInfoKey := node.Hash + ".narinfo"
+	if destCache.hasCacheFile(ctx, narInfoKey) {
+		return false, nil
+	}
+
+	source := f
+	narKey := node.URL
+	if strings.Contains(node.URL, "://") {
+		// Locked from another substituter, whose NARs live under nar/
+		base, rest, ok := strings.Cut(node.URL, "/nar/")
+		if !ok {
+			return false, fmt.Errorf("cannot tell the cache of %s", node.URL)
+		}
+		source = NewFetcher(base, "")
+		source.client = f.client
+		source.progress = f.progress
+		narKey = "nar/" + rest
+	}
+
+	narInfo, err := source.getCacheFile(ctx, narInfoKey)
+	if err != nil {
+		return false, err
+	}
+	defer narInfo.Body.Close()
+	narInfoData, err := io.ReadAll(narInfo.Body)
+	if err != nil {
+		return false, err
+	}
+
+	fmt.Fprintf(f.progress, "Mirroring %s...\n", storePath)
+	nar, err := source.getCacheFile(ctx, narKey)
+	if err != nil {
+		return false, err
+	}
+	defer nar.Body.Close()
+	verifier, err := newHashVerifier(node.FileHash)
+	if err != nil {
+		return false, err
+	}
+
+	// Download to a temporary file and check it before anything is
+	// published, so a corrupt NAR never reaches dest, not even briefly
+	tmp, err := os.CreateTemp("", "nix-bazel-mirror-*.nar")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	size, err := io.Copy(io.MultiWriter(tmp, verifier), nar.Body)
+	if err != nil {
+		return false, fmt.Errorf("failed to download %s: %w", narKey, err)
+	}
+	if err := verifier.verify(narKey); err != nil {
+		return false, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	if err := destCache.putCacheFile(ctx, narKey, tmp, size); err != nil {
+		return false, err
+	}
+	if err := destCache.putCacheFile(ctx, narInfoKey, bytes.NewReader(narInfoData), int64(len(narInfoData))); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// getCacheFile requests key from the binary cache at f.cacheURL. The caller
+// closes the body.
+func (f *Fetcher) getCacheFile(ctx context.Context, key string) (*http.Response, error) {
+	url := f.cacheURL + "/" + key
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to download %s: status %s", url, resp.Status)
+	}
+	return resp, nil
+}
+
+// hasCacheFile reports whether the binary cache at f.cacheURL has key.
+func (f *Fetcher) hasCacheFile(ctx context.Context, key string) bool {
+	if dir, ok := strings.CutPrefix(f.cacheURL, "file://"); ok {
+		_, err := os.Stat(filepath.Join(dir, filepath.FromSlash(key)))
+		return err == nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, f.cacheURL+"/"+key, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
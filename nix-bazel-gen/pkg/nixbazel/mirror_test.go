@@ -0,0 +1,107 @@
+package nixbazel
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMirror(t *testing.T) {
+	nar := []byte("not really a NAR")
+	sum := sha256.Sum256(nar)
+	narInfo := "StorePath: " + testHelloPath + "\nURL: nar/hello.nar.xz\n"
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		switch r.URL.Path {
+		case "/" + extractHash(testHelloPath) + ".narinfo":
+			w.Write([]byte(narInfo))
+		case "/nar/hello.nar.xz":
+			w.Write(nar)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	lock := &Lockfile{Packages: map[string]ClosureNode{
+		testHelloPath: {
+			URL:      "nar/hello.nar.xz",
+			Hash:     extractHash(testHelloPath),
+			FileHash: hex.EncodeToString(sum[:]),
+			FileSize: int64(len(nar)),
+		},
+		testGlibcPath: {Hash: extractHash(testGlibcPath), LocalOnly: true},
+	}}
+	dest := t.TempDir()
+	f := NewFetcher(server.URL, "")
+
+	report, err := f.Mirror(context.Background(), lock, "file://"+dest, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &MirrorReport{
+		Copied:    []string{testHelloPath},
+		Skipped:   []string{},
+		LocalOnly: []string{testGlibcPath},
+		Bytes:     int64(len(nar)),
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("Mirror() = %+v, expected %+v", report, expected)
+	}
+	if data, err := os.ReadFile(filepath.Join(dest, extractHash(testHelloPath)+".narinfo")); err != nil || string(data) != narInfo {
+		t.Errorf("mirrored narinfo = %q (%v), expected %q", data, err, narInfo)
+	}
+	if data, err := os.ReadFile(filepath.Join(dest, "nar", "hello.nar.xz")); err != nil || string(data) != string(nar) {
+		t.Errorf("mirrored NAR = %q (%v), expected %q", data, err, nar)
+	}
+
+	// A second run finds the narinfo and downloads nothing
+	requests.Store(0)
+	report, err = f.Mirror(context.Background(), lock, "file://"+dest, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Copied) != 0 || len(report.Skipped) != 1 || requests.Load() != 0 {
+		t.Errorf("second Mirror() = %+v with %d requests, expected one skipped path and no requests", report, requests.Load())
+	}
+
+	// A NAR that does not match its FileHash is not published
+	node := lock.Packages[testHelloPath]
+	node.FileHash = strings.Repeat("0", 64)
+	lock.Packages[testHelloPath] = node
+	other := t.TempDir()
+	if _, err := f.Mirror(context.Background(), lock, "file://"+other, 1); err == nil {
+		t.Error("Mirror() with a bad FileHash succeeded, expected an error")
+	}
+	if _, err := os.Stat(filepath.Join(other, extractHash(testHelloPath)+".narinfo")); err == nil {
+		t.Error("narinfo was mirrored for a NAR with a bad FileHash")
+	}
+	if _, err := os.Stat(filepath.Join(other, "nar", "hello.nar.xz")); err == nil {
+		t.Error("NAR with a bad FileHash was published")
+	}
+
+	// Nor is it uploaded to an HTTP cache
+	var puts atomic.Int32
+	httpDest := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			puts.Add(1)
+		}
+		http.NotFound(w, r)
+	}))
+	defer httpDest.Close()
+	if _, err := f.Mirror(context.Background(), lock, httpDest.URL, 1); err == nil {
+		t.Error("Mirror() to HTTP with a bad FileHash succeeded, expected an error")
+	}
+	if puts.Load() != 0 {
+		t.Errorf("%d PUT requests for a NAR with a bad FileHash, expected none", puts.Load())
+	}
+}
@@ -0,0 +1,147 @@
+package nixbazel
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/ulikunitz/xz"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/nix/nar"
+)
+
+// NarPack describes a NAR produced by PackNar.
+type NarPack struct {
+	NarHash     nix.Hash // sha256 of the uncompressed NAR
+	NarSize     int64
+	Compression string
+	FileHash    nix.Hash // sha256 of the compressed NAR, as written to w
+	FileSize    int64
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// PackNar serialises the file or directory at path into a NAR, compresses it
+// ("none" or "xz") and writes it to w.
+func PackNar(w io.Writer, path, compression string) (*NarPack, error) {
+	return packNar(w, path, compression)
+}
+
+// packNar is PackNar with extra writers that see the uncompressed NAR, such
+// as reference scanners.
+func packNar(w io.Writer, path, compression string, narWriters ...io.Writer) (*NarPack, error) {
+	fileHasher := nix.NewHasher(nix.SHA256)
+	fileSize := new(countingWriter)
+	compressed, err := compress(io.MultiWriter(w, fileHasher, fileSize), compression)
+	if err != nil {
+		return nil, err
+	}
+
+	narHasher := nix.NewHasher(nix.SHA256)
+	narSize := new(countingWriter)
+	writers := append([]io.Writer{compressed, narHasher, narSize}, narWriters...)
+	dumpErr := nar.DumpPath(io.MultiWriter(writers...), path)
+	if err := compressed.Close(); err != nil && dumpErr == nil {
+		dumpErr = fmt.Errorf("failed to finish %s stream: %w", compression, err)
+	}
+	if dumpErr != nil {
+		return nil, fmt.Errorf("failed to pack %s: %w", path, dumpErr)
+	}
+
+	if compression == "" {
+		compression = "none"
+	}
+	return &NarPack{
+		NarHash:     narHasher.SumHash(),
+		NarSize:     narSize.n,
+		Compression: compression,
+		FileHash:    fileHasher.SumHash(),
+		FileSize:    fileSize.n,
+	}, nil
+}
+
+// nopWriteCloser adds a no-op Close to a writer.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// compress is the inverse of decompress: writes to the returned writer are
+// compressed into w, and closing it flushes the stream.
+func compress(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case "", "none":
+		return nopWriteCloser{w}, nil
+	case "xz":
+		// In Go, so packing needs no xz on PATH
+		xw, err := xz.NewWriter(w)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start xz stream: %w", err)
+		}
+		return xw, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", compression)
+	}
+}
+
+// NarHashMismatch is a store path whose unpacked tree does not serialise to
+// the NarHash recorded in the lockfile.
+type NarHashMismatch struct {
+	StorePath string `json:"storePath"`
+	Expected  string `json:"expected"`
+	Actual    string `json:"actual"`
+	Error     string `json:"error,omitempty"`
+}
+
+// VerifyTrees repacks every package of lockFile unpacked below root and
+// compares the result with its NarHash. Packages that are not unpacked are
+// skipped. Trees modified after unpacking (patched, relocated, rewritten
+// symlinks) are expected to mismatch; modes set by canonicalisation are not
+// part of the NAR and do not matter.
+func VerifyTrees(lockFile, root string) ([]NarHashMismatch, int, error) {
+	lock, err := LoadLockfile(lockFile)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	storePaths := make([]string, 0, len(lock.Packages))
+	for storePath := range lock.Packages {
+		storePaths = append(storePaths, storePath)
+	}
+	sort.Strings(storePaths)
+
+	var mismatches []NarHashMismatch
+	verified := 0
+	for _, storePath := range storePaths {
+		node := lock.Packages[storePath]
+		dir := filepath.Join(root, path.Base(storePath))
+		if _, err := os.Lstat(dir); os.IsNotExist(err) {
+			continue
+		}
+		verifier, err := newHashVerifier(node.NarHash)
+		if err != nil {
+			return nil, 0, err
+		}
+		if _, err := packNar(io.Discard, dir, "none", verifier); err != nil {
+			mismatches = append(mismatches, NarHashMismatch{StorePath: storePath, Expected: node.NarHash, Error: err.Error()})
+			continue
+		}
+		verified++
+		if actual := verifier.hasher.SumHash(); !actual.Equal(verifier.expected.Hash) {
+			mismatches = append(mismatches, NarHashMismatch{StorePath: storePath, Expected: node.NarHash, Actual: actual.RawBase16()})
+		}
+	}
+	return mismatches, verified, nil
+}
@@ -0,0 +1,78 @@
+package nixbazel
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"zombiezen.com/go/nix"
+)
+
+func TestPackNarRoundTrip(t *testing.T) {
+	entries := []testNarEntry{
+		{path: "", mode: fs.ModeDir},
+		{path: "bin", mode: fs.ModeDir},
+		{path: "bin/hello", mode: 0755, content: "#!/bin/sh\necho hello\n"},
+		{path: "lib", mode: fs.ModeSymlink, target: "../other/lib"},
+		{path: "share", mode: fs.ModeDir},
+		{path: "share/doc", mode: 0644, content: "doc"},
+	}
+	original := buildTestNar(t, entries)
+
+	dir := t.TempDir()
+	out := filepath.Join(dir, "abc-hello")
+	if err := NewFetcher("", dir).unpackNar(bytes.NewReader(original), out); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	pack, err := PackNar(&buf, out, "none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), original) {
+		t.Fatal("repacked NAR differs from the original")
+	}
+	hasher := nix.NewHasher(nix.SHA256)
+	hasher.Write(original)
+	if !pack.NarHash.Equal(hasher.SumHash()) || pack.NarSize != int64(len(original)) {
+		t.Errorf("NarHash, NarSize = %v, %d, expected %v, %d", pack.NarHash, pack.NarSize, hasher.SumHash(), len(original))
+	}
+	if !pack.FileHash.Equal(pack.NarHash) || pack.FileSize != pack.NarSize {
+		t.Errorf("uncompressed FileHash, FileSize = %v, %d", pack.FileHash, pack.FileSize)
+	}
+
+	// Lockfile hashes are hex, which VerifyTrees compares against
+	lockFile := filepath.Join(dir, "lock.json")
+	lock := `{"packages": {"/nix/store/abc-hello": {"narHash": "` + pack.NarHash.RawBase16() + `"}}}`
+	if err := os.WriteFile(lockFile, []byte(lock), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mismatches, verified, err := VerifyTrees(lockFile, dir)
+	if err != nil || verified != 1 || len(mismatches) != 0 {
+		t.Errorf("VerifyTrees = %v, %d, %v", mismatches, verified, err)
+	}
+
+	var xz bytes.Buffer
+	compressed, err := PackNar(&xz, out, "xz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !compressed.NarHash.Equal(pack.NarHash) || compressed.FileSize != int64(xz.Len()) {
+		t.Errorf("xz pack = %+v", compressed)
+	}
+	r, _, err := decompress(&xz, "xz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hasher = nix.NewHasher(nix.SHA256)
+	if _, err := io.Copy(hasher, r); err != nil {
+		t.Fatal(err)
+	}
+	if got := hasher.SumHash(); !got.Equal(pack.NarHash) {
+		t.Errorf("decompressed NarHash = %v, expected %v", got, pack.NarHash)
+	}
+}
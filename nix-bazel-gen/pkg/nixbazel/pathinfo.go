@@ -0,0 +1,102 @@
+package nixbazel
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+)
+
+// PathInfo is one store path in the output of "nix path-info --json".
+type PathInfo struct {
+	Path       string   `json:"path"` // Only in the array format of Nix < 2.19
+	NarHash    string   `json:"narHash"`
+	NarSize    int64    `json:"narSize"`
+	References []string `json:"references"`
+	// Set when querying a binary cache (nix path-info --store <url>)
+	URL          string `json:"url"`
+	Compression  string `json:"compression"`
+	DownloadHash string `json:"downloadHash"`
+	DownloadSize int64  `json:"downloadSize"`
+}
+
+// LoadPathInfo reads the output of "nix path-info --json --recursive" and
+// converts it to lockfile nodes keyed by store path. Both the array format
+// and the object format keyed by path (Nix 2.19 and later) are accepted.
+func LoadPathInfo(file string) (map[string]ClosureNode, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read path info: %w", err)
+	}
+	nodes, err := parsePathInfo(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", file, err)
+	}
+	return nodes, nil
+}
+
+func parsePathInfo(data []byte) (map[string]ClosureNode, error) {
+	infos := make(map[string]*PathInfo)
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		var list []*PathInfo
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, err
+		}
+		for _, info := range list {
+			infos[info.Path] = info
+		}
+	} else if err := json.Unmarshal(data, &infos); err != nil {
+		return nil, err
+	}
+
+	nodes := make(map[string]ClosureNode, len(infos))
+	for storePath, info := range infos {
+		if info == nil {
+			// Nix reports paths that are not valid as null
+			return nil, fmt.Errorf("%s is not a valid store path", storePath)
+		}
+		node, err := pathInfoNode(storePath, info)
+		if err != nil {
+			return nil, err
+		}
+		nodes[storePath] = node
+	}
+	return nodes, nil
+}
+
+// pathInfoNode converts the path info of storePath to a lockfile node.
+func pathInfoNode(storePath string, info *PathInfo) (ClosureNode, error) {
+	hash := extractHash(storePath)
+	if hash == "" {
+		return ClosureNode{}, fmt.Errorf("invalid store path %q", storePath)
+	}
+	narHash, err := hashToHex(info.NarHash)
+	if err != nil {
+		return ClosureNode{}, fmt.Errorf("bad NarHash for %s: %w", storePath, err)
+	}
+	if info.URL != "" && info.Compression != "" && info.Compression != "xz" {
+		return ClosureNode{}, fmt.Errorf("unsupported compression %q for %s", info.Compression, storePath)
+	}
+
+	node := ClosureNode{
+		URL:        info.URL,
+		Hash:       hash,
+		NarHash:    narHash,
+		NarSize:    info.NarSize,
+		References: []string{},
+	}
+	if info.URL != "" {
+		if node.FileHash, err = hashToHex(info.DownloadHash); err != nil {
+			return ClosureNode{}, fmt.Errorf("bad download hash for %s: %w", storePath, err)
+		}
+		node.FileSize = info.DownloadSize
+	}
+	// References are basenames, as in narinfo files
+	for _, ref := range info.References {
+		node.References = append(node.References, path.Base(ref))
+	}
+	sort.Strings(node.References)
+	return node, nil
+}
@@ -0,0 +1,83 @@
+package nixbazel
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParsePathInfo(t *testing.T) {
+	expected := map[string]ClosureNode{
+		testHelloPath: {
+			URL:        "nar/hello.nar.xz",
+			Hash:       extractHash(testHelloPath),
+			NarHash:    testHelloHash,
+			NarSize:    1000,
+			FileHash:   testGlibcHash,
+			FileSize:   500,
+			References: []string{filepath.Base(testHelloPath), filepath.Base(testGlibcPath)},
+		},
+		testGlibcPath: {
+			Hash:       extractHash(testGlibcPath),
+			NarHash:    testGlibcHash,
+			NarSize:    2000,
+			References: []string{},
+		},
+	}
+
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"array", `[
+  {"path": "` + testHelloPath + `", "narHash": "sha256:0gkxy2qfdi81lxzqbsdl2w5mdg0666s24inpa90ilvkb53ssmn3s", "narSize": 1000,
+   "references": ["` + testHelloPath + `", "` + testGlibcPath + `"],
+   "url": "nar/hello.nar.xz", "compression": "xz", "downloadHash": "sha256:1fd9f9qbrlckn0yapnybfv4y9bwwsvq473ckp71ccvvspr5602fy", "downloadSize": 500},
+  {"path": "` + testGlibcPath + `", "narHash": "sha256:1fd9f9qbrlckn0yapnybfv4y9bwwsvq473ckp71ccvvspr5602fy", "narSize": 2000, "references": []}
+]`},
+		{"object", `{
+  "` + testHelloPath + `": {"narHash": "sha256-etiq9ShrbhpBUtdGIrQxBrxWCxe06YV/pwHF5rDwfT4=", "narSize": 1000,
+    "references": ["` + testGlibcPath + `", "` + testHelloPath + `"],
+    "url": "nar/hello.nar.xz", "compression": "xz", "downloadHash": "sha256-3glgSr56b8bCuZONQ/DWnK/kyXbL26s8sJPRvHByqbk=", "downloadSize": 500},
+  "` + testGlibcPath + `": {"narHash": "sha256-3glgSr56b8bCuZONQ/DWnK/kyXbL26s8sJPRvHByqbk=", "narSize": 2000, "references": []}
+}`},
+	}
+	for _, test := range tests {
+		nodes, err := parsePathInfo([]byte(test.data))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(nodes, expected) {
+			t.Errorf("%s: nodes = %+v, expected %+v", test.name, nodes, expected)
+		}
+	}
+
+	invalid := []string{
+		`{"` + testHelloPath + `": null}`,
+		`{"` + testHelloPath + `": {"narHash": "md5:abc"}}`,
+		`{"` + testHelloPath + `": {"narHash": "sha256-etiq9ShrbhpBUtdGIrQxBrxWCxe06YV/pwHF5rDwfT4=", "url": "nar/x.nar.zst", "compression": "zstd", "downloadHash": "sha256-etiq9ShrbhpBUtdGIrQxBrxWCxe06YV/pwHF5rDwfT4="}}`,
+	}
+	for _, data := range invalid {
+		if _, err := parsePathInfo([]byte(data)); err == nil {
+			t.Errorf("parsePathInfo(%q) succeeded, expected an error", data)
+		}
+	}
+}
+
+func TestResolveClosureReusesLockedPaths(t *testing.T) {
+	closure := map[string]ClosureNode{
+		testHelloPath: {URL: "nar/hello.nar.xz", Hash: extractHash(testHelloPath), References: []string{filepath.Base(testGlibcPath)}},
+		testGlibcPath: {URL: "nar/glibc.nar.xz", Hash: extractHash(testGlibcPath)},
+	}
+	// Any request would fail
+	f := NewFetcher("http://127.0.0.1:0", "")
+	info, err := f.resolveClosure(context.Background(), extractHash(testHelloPath), closure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.StorePath != testHelloPath || info.URL != "nar/hello.nar.xz" {
+		t.Errorf("resolveClosure = %+v, expected the locked %s", info, testHelloPath)
+	}
+}
@@ -0,0 +1,306 @@
+package nixbazel
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// pkgConfig is a parsed pkg-config (.pc) file.
+type pkgConfig struct {
+	Name            string
+	Version         string
+	Variables       map[string]string
+	Requires        []string // Module names, version constraints stripped
+	RequiresPrivate []string
+	Cflags          []string
+	Libs            []string
+	LibsPrivate     []string
+}
+
+// parsePkgConfig parses a .pc file located at pcPath (an absolute store
+// path, used for the builtin ${pcfiledir} variable) and expands all
+// variable references.
+func parsePkgConfig(pcPath, data string) (*pkgConfig, error) {
+	pc := &pkgConfig{
+		Variables: map[string]string{"pcfiledir": path.Dir(pcPath)},
+	}
+
+	for _, line := range joinContinuationLines(data) {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		// The first '=' or ':' decides between a variable and a keyword
+		sep := strings.IndexAny(line, "=:")
+		if sep <= 0 {
+			return nil, fmt.Errorf("%s: malformed line %q", pcPath, line)
+		}
+		key := strings.TrimSpace(line[:sep])
+		value, err := pc.expand(strings.TrimSpace(line[sep+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", pcPath, err)
+		}
+
+		if line[sep] == '=' {
+			pc.Variables[key] = value
+			continue
+		}
+		switch key {
+		case "Name":
+			pc.Name = value
+		case "Version":
+			pc.Version = value
+		case "Requires":
+			pc.Requires = parsePkgConfigRequires(value)
+		case "Requires.private":
+			pc.RequiresPrivate = parsePkgConfigRequires(value)
+		case "Cflags", "CFlags":
+			if pc.Cflags, err = splitShellWords(value); err != nil {
+				return nil, fmt.Errorf("%s: Cflags: %w", pcPath, err)
+			}
+		case "Libs":
+			if pc.Libs, err = splitShellWords(value); err != nil {
+				return nil, fmt.Errorf("%s: Libs: %w", pcPath, err)
+			}
+		case "Libs.private":
+			if pc.LibsPrivate, err = splitShellWords(value); err != nil {
+				return nil, fmt.Errorf("%s: Libs.private: %w", pcPath, err)
+			}
+		}
+	}
+	return pc, nil
+}
+
+// joinContinuationLines splits data into lines, joining lines that end in a
+// backslash.
+func joinContinuationLines(data string) []string {
+	var lines []string
+	var current strings.Builder
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if strings.HasSuffix(line, "\\") {
+			current.WriteString(strings.TrimSuffix(line, "\\"))
+			continue
+		}
+		current.WriteString(line)
+		lines = append(lines, current.String())
+		current.Reset()
+	}
+	if current.Len() > 0 {
+		lines = append(lines, current.String())
+	}
+	return lines
+}
+
+// expand substitutes ${var} references with previously defined variables.
+func (pc *pkgConfig) expand(s string) (string, error) {
+	var out strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			out.WriteString(s)
+			return out.String(), nil
+		}
+		// "$$" escapes a literal dollar sign
+		if i > 0 && s[i-1] == '$' {
+			out.WriteString(s[:i])
+			out.WriteString("{")
+			s = s[i+2:]
+			continue
+		}
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated variable reference in %q", s)
+		}
+		name := s[i+2 : i+end]
+		value, ok := pc.Variables[name]
+		if !ok {
+			return "", fmt.Errorf("undefined variable %q", name)
+		}
+		out.WriteString(s[:i])
+		out.WriteString(value)
+		s = s[i+end+1:]
+	}
+}
+
+// parsePkgConfigRequires returns the module names from a Requires field such
+// as "glib-2.0 >= 2.50, zlib". Like pkg-config, it accepts operators without
+// surrounding spaces, as in "glib-2.0>=2.50".
+func parsePkgConfigRequires(value string) []string {
+	var spaced strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if !strings.ContainsRune("<>=!", rune(c)) {
+			spaced.WriteByte(c)
+			continue
+		}
+		spaced.WriteByte(' ')
+		spaced.WriteByte(c)
+		if i+1 < len(value) && value[i+1] == '=' {
+			i++
+			spaced.WriteByte('=')
+		}
+		spaced.WriteByte(' ')
+	}
+
+	var names []string
+	fields := strings.FieldsFunc(spaced.String(), func(r rune) bool { return r == ',' || r == ' ' || r == '\t' })
+	for i := 0; i < len(fields); i++ {
+		switch fields[i] {
+		case "<", "<=", "=", "!=", ">=", ">":
+			i++ // Skip the version
+			continue
+		}
+		names = append(names, fields[i])
+	}
+	return names
+}
+
+// splitShellWords splits s like a POSIX shell would, honouring quotes and
+// backslash escapes.
+func splitShellWords(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' && i+1 < len(s) {
+				i++
+				word.WriteByte(s[i])
+			} else {
+				word.WriteByte(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+		case c == '\\' && i+1 < len(s):
+			i++
+			word.WriteByte(s[i])
+			inWord = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in %q", s)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// ccFlags are the Bazel attributes derived from pkg-config flags.
+type ccFlags struct {
+	includes []string // Package-relative include directories
+	defines  []string
+	linkopts []string
+	libs     []string // -l names
+	// Include directories inside other store paths, which are exported by
+	// the owning package's target
+	external []string
+}
+
+// storeRelative splits an absolute path inside the Nix store into the store
+// path and the path relative to it.
+func storeRelative(p string) (string, string, bool) {
+	rest, ok := strings.CutPrefix(path.Clean(p), nixStoreDir+"/")
+	if !ok {
+		return "", "", false
+	}
+	base, sub, _ := strings.Cut(rest, "/")
+	return nixStoreDir + "/" + base, sub, true
+}
+
+// translatePkgConfigFlags maps Cflags and Libs onto Bazel attributes for the
+// package at storePath. Include directories inside storePath become includes
+// and those in other store paths (such as glib's lib/glib-2.0/include) are
+// returned as external, to be exported by the owning packages. Library
+// search paths are dropped because Bazel places the cc_import libraries
+// itself, and any other flag mentioning the Nix store is skipped because it
+// could not work outside of /nix/store. Only includes, defines and linkopts
+// reach the dependents of a cc_library, so -pthread becomes its define and
+// linkopt and other compiler flags are skipped.
+func translatePkgConfigFlags(storePath string, cflags, libs []string) (ccFlags, []string) {
+	var flags ccFlags
+	var skipped []string
+
+	for i := 0; i < len(cflags); i++ {
+		flag := cflags[i]
+		var dir string
+		switch {
+		case flag == "-I" || flag == "-isystem" || flag == "-iquote":
+			if i+1 < len(cflags) {
+				i++
+				dir = cflags[i]
+			}
+		case strings.HasPrefix(flag, "-isystem"):
+			dir = strings.TrimPrefix(flag, "-isystem")
+		case strings.HasPrefix(flag, "-iquote"):
+			dir = strings.TrimPrefix(flag, "-iquote")
+		case strings.HasPrefix(flag, "-I"):
+			dir = strings.TrimPrefix(flag, "-I")
+		case strings.HasPrefix(flag, "-D"):
+			flags.defines = append(flags.defines, strings.TrimPrefix(flag, "-D"))
+			continue
+		case flag == "-pthread":
+			flags.defines = appendUnique(flags.defines, "_REENTRANT")
+			flags.linkopts = appendUnique(flags.linkopts, flag)
+			continue
+		default:
+			skipped = append(skipped, flag)
+			continue
+		}
+
+		owner, sub, ok := storeRelative(dir)
+		if !ok {
+			skipped = append(skipped, "-I"+dir)
+			continue
+		}
+		switch {
+		case sub == "":
+			skipped = append(skipped, "-I"+dir)
+		case owner != storePath:
+			flags.external = appendUnique(flags.external, path.Join(owner, sub))
+		case sub != "include":
+			flags.includes = append(flags.includes, sub)
+		}
+	}
+
+	for i := 0; i < len(libs); i++ {
+		flag := libs[i]
+		switch {
+		case flag == "-L":
+			i++
+		case strings.HasPrefix(flag, "-L"):
+		case strings.HasPrefix(flag, "-Wl,-rpath") || flag == "-rpath":
+			if flag == "-rpath" {
+				i++
+			}
+		case strings.HasPrefix(flag, "-l"):
+			flags.libs = append(flags.libs, strings.TrimPrefix(flag, "-l"))
+		case strings.Contains(flag, nixStoreDir+"/"):
+			skipped = append(skipped, flag)
+		default:
+			flags.linkopts = appendUnique(flags.linkopts, flag)
+		}
+	}
+	return flags, skipped
+}
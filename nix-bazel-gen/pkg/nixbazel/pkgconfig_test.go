@@ -0,0 +1,98 @@
+package nixbazel
+
+import (
+	"reflect"
+	"testing"
+)
+
+const testZlibPC = `prefix=/nix/store/01ddsmlfxa22al7yxasdj8rvm72b275m-zlib-1.3.1-dev
+exec_prefix=${prefix}
+libdir=/nix/store/00xpncfcvafhr6vx9q05hkhazm70zw5g-zlib-1.3.1/lib
+sharedlibdir=${libdir}
+includedir=${prefix}/include
+
+Name: zlib
+Description: zlib compression library
+Version: 1.3.1
+
+Requires: glib-2.0 >= 2.50, \
+  libffi
+Libs: -L${libdir} -L${sharedlibdir} -lz -lm -pthread
+Cflags: -I${includedir} -I${includedir}/zlib -I${libdir}/zlib/include -DZLIB_CONST "-DNAME=\"z lib\"" -fno-strict-aliasing -pthread
+`
+
+func TestParsePkgConfig(t *testing.T) {
+	pc, err := parsePkgConfig("/nix/store/01ddsmlfxa22al7yxasdj8rvm72b275m-zlib-1.3.1-dev/lib/pkgconfig/zlib.pc", testZlibPC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pc.Name != "zlib" || pc.Version != "1.3.1" {
+		t.Errorf("Name, Version = %q, %q", pc.Name, pc.Version)
+	}
+	if got, want := pc.Requires, []string{"glib-2.0", "libffi"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Requires = %q, expected %q", got, want)
+	}
+	if got, want := pc.Variables["pcfiledir"], "/nix/store/01ddsmlfxa22al7yxasdj8rvm72b275m-zlib-1.3.1-dev/lib/pkgconfig"; got != want {
+		t.Errorf("pcfiledir = %q, expected %q", got, want)
+	}
+	wantCflags := []string{
+		"-I/nix/store/01ddsmlfxa22al7yxasdj8rvm72b275m-zlib-1.3.1-dev/include",
+		"-I/nix/store/01ddsmlfxa22al7yxasdj8rvm72b275m-zlib-1.3.1-dev/include/zlib",
+		"-I/nix/store/00xpncfcvafhr6vx9q05hkhazm70zw5g-zlib-1.3.1/lib/zlib/include",
+		"-DZLIB_CONST",
+		`-DNAME="z lib"`,
+		"-fno-strict-aliasing",
+		"-pthread",
+	}
+	if !reflect.DeepEqual(pc.Cflags, wantCflags) {
+		t.Errorf("Cflags = %q, expected %q", pc.Cflags, wantCflags)
+	}
+
+	flags, skipped := translatePkgConfigFlags("/nix/store/01ddsmlfxa22al7yxasdj8rvm72b275m-zlib-1.3.1-dev", pc.Cflags, pc.Libs)
+	// copts would not reach dependents of the srcs-less cc_library
+	if got, want := skipped, []string{"-fno-strict-aliasing"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("skipped = %q, expected %q", got, want)
+	}
+	if got, want := flags.includes, []string{"include/zlib"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("includes = %q, expected %q", got, want)
+	}
+	// Exported by the other store path's own target
+	if got, want := flags.external, []string{"/nix/store/00xpncfcvafhr6vx9q05hkhazm70zw5g-zlib-1.3.1/lib/zlib/include"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("external = %q, expected %q", got, want)
+	}
+	if got, want := flags.defines, []string{"ZLIB_CONST", `NAME="z lib"`, "_REENTRANT"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("defines = %q, expected %q", got, want)
+	}
+	if got, want := flags.libs, []string{"z", "m"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("libs = %q, expected %q", got, want)
+	}
+	if got, want := flags.linkopts, []string{"-pthread"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("linkopts = %q, expected %q", got, want)
+	}
+}
+
+func TestParsePkgConfigUndefinedVariable(t *testing.T) {
+	if _, err := parsePkgConfig("/nix/store/x/lib/pkgconfig/x.pc", "Cflags: -I${nope}\n"); err == nil {
+		t.Error("expected an error for an undefined variable")
+	}
+}
+
+func TestParsePkgConfigRequires(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{"glib-2.0 >= 2.50, zlib", []string{"glib-2.0", "zlib"}},
+		{"foo>=1.0", []string{"foo"}},
+		{"foo>= 1.0 bar <2", []string{"foo", "bar"}},
+		{"foo=1.0,bar!=2.0", []string{"foo", "bar"}},
+		{"gtk+-3.0", []string{"gtk+-3.0"}},
+		{"", nil},
+	}
+
+	for _, test := range tests {
+		if result := parsePkgConfigRequires(test.input); !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("parsePkgConfigRequires(%q) = %q, expected %q", test.input, result, test.expected)
+		}
+	}
+}
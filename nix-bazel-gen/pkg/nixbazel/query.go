@@ -0,0 +1,314 @@
+package nixbazel
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PackageInfo is a lockfile package with what the lockfile says about its
+// place in the graph, as returned by Query.
+type PackageInfo struct {
+	StorePath    string   `json:"storePath"`
+	Name         string   `json:"name"`
+	Version      string   `json:"version,omitempty"`
+	NarSize      int64    `json:"narSize"`
+	FileSize     int64    `json:"fileSize"`
+	References   []string `json:"references"`   // Store paths it refers to
+	Referrers    []string `json:"referrers"`    // Store paths referring to it
+	Repositories []string `json:"repositories"` // Repositories with it in their closure
+}
+
+// Selector is a parsed query: every term must match.
+type Selector []selectorTerm
+
+// selectorTerm is one "<field><op><value>" condition.
+type selectorTerm struct {
+	field string
+	op    string
+	value string
+	re    *regexp.Regexp // For ~
+	size  int64          // For sizes, compared with every operator but ~
+}
+
+// selectorFields are the fields a selector can test.
+var selectorFields = map[string]bool{
+	"name":      true, // Package name, e.g. glibc
+	"version":   true, // e.g. 2.40-66
+	"path":      true, // Store path basename
+	"size":      true, // NarSize
+	"download":  true, // FileSize
+	"refs":      true, // Any reference (by name or basename)
+	"referrers": true, // Any referrer (by name or basename)
+	"repo":      true, // Any repository whose closure has the path
+}
+
+// selectorOps are the comparison operators, longest first so "!=" is not
+// read as "=".
+var selectorOps = []string{"!=", "<=", ">=", "=", "~", "<", ">"}
+
+// ParseSelector parses a query such as "name=glibc version>=2.40" or
+// "size>50MB". Terms are separated by spaces and all must match. Sizes
+// (with an optional K, M or G suffix, in units of 1024) are compared with
+// every operator but "~". Otherwise "=" and "!=" match shell globs, "~" a
+// regular expression, and "<", "<=", ">", ">=" compare versions like
+// nix-env.
+func ParseSelector(query string) (Selector, error) {
+	var sel Selector
+	for _, term := range strings.Fields(query) {
+		field := strings.TrimLeftFunc(term, func(r rune) bool { return r >= 'a' && r <= 'z' })
+		name := term[:len(term)-len(field)]
+		if !selectorFields[name] {
+			return nil, fmt.Errorf("unknown field in %q", term)
+		}
+		t := selectorTerm{field: name}
+		for _, op := range selectorOps {
+			if value, ok := strings.CutPrefix(field, op); ok {
+				t.op, t.value = op, value
+				break
+			}
+		}
+		switch {
+		case t.op == "":
+			return nil, fmt.Errorf("missing operator in %q", term)
+		case t.op == "~":
+			re, err := regexp.Compile(t.value)
+			if err != nil {
+				return nil, fmt.Errorf("bad regular expression in %q: %w", term, err)
+			}
+			t.re = re
+		case name == "size" || name == "download":
+			size, err := parseSize(t.value)
+			if err != nil {
+				return nil, fmt.Errorf("bad size in %q: %w", term, err)
+			}
+			t.size = size
+		case t.op == "=" || t.op == "!=":
+			if _, err := path.Match(t.value, ""); err != nil {
+				return nil, fmt.Errorf("bad pattern in %q: %w", term, err)
+			}
+		case name != "version":
+			return nil, fmt.Errorf("%s cannot be compared with %s", name, t.op)
+		}
+		sel = append(sel, t)
+	}
+	return sel, nil
+}
+
+// parseSize parses a size such as 50MB, 1.5G or 1024.
+func parseSize(s string) (int64, error) {
+	number := strings.TrimRight(strings.ToUpper(s), "IB")
+	multiplier := 1.0
+	for i, suffix := range []string{"K", "M", "G", "T"} {
+		if n, ok := strings.CutSuffix(number, suffix); ok {
+			number = n
+			multiplier = float64(int64(1) << (10 * (i + 1)))
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(value * multiplier), nil
+}
+
+// compareVersions compares two versions like nix-env: both are split into
+// runs of digits and runs of other characters, dots and dashes only
+// separating them, and compared component by component with componentLess.
+func compareVersions(a, b string) int {
+	for a != "" || b != "" {
+		var x, y string
+		x, a = nextVersionComponent(a)
+		y, b = nextVersionComponent(b)
+		switch {
+		case componentLess(x, y):
+			return -1
+		case componentLess(y, x):
+			return 1
+		}
+	}
+	return 0
+}
+
+// nextVersionComponent splits the first component off v after skipping
+// separators: the longest run of digits, or of characters that are neither
+// digits nor separators.
+func nextVersionComponent(v string) (string, string) {
+	v = strings.TrimLeft(v, ".-")
+	if v == "" {
+		return "", ""
+	}
+	digits := isDigit(v[0])
+	end := 1
+	for end < len(v) && isDigit(v[end]) == digits && v[end] != '.' && v[end] != '-' {
+		end++
+	}
+	return v[:end], v[end:]
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// componentLess orders version components as Nix does: numbers
+// numerically, a missing component before a number, "pre" before anything
+// else, words before numbers (2.3a < 2.3.1) and words bytewise.
+func componentLess(x, y string) bool {
+	xn, xErr := strconv.ParseInt(x, 10, 64)
+	yn, yErr := strconv.ParseInt(y, 10, 64)
+	switch {
+	case xErr == nil && yErr == nil:
+		return xn < yn
+	case x == "" && yErr == nil:
+		return true
+	case x == "pre" && y != "pre":
+		return true
+	case y == "pre":
+		return false
+	case yErr == nil:
+		return true
+	case xErr == nil:
+		return false
+	}
+	return x < y
+}
+
+// matchString reports whether value matches a term of a string field.
+func (t selectorTerm) matchString(value string) bool {
+	switch t.op {
+	case "=":
+		ok, _ := path.Match(t.value, value)
+		return ok
+	case "!=":
+		ok, _ := path.Match(t.value, value)
+		return !ok
+	case "~":
+		return t.re.MatchString(value)
+	}
+	c := compareVersions(value, t.value)
+	switch t.op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	default:
+		return c >= 0
+	}
+}
+
+// matchSize reports whether size matches a term of a size field.
+func (t selectorTerm) matchSize(size int64) bool {
+	switch t.op {
+	case "<":
+		return size < t.size
+	case "<=":
+		return size <= t.size
+	case ">":
+		return size > t.size
+	case ">=":
+		return size >= t.size
+	case "=":
+		return size == t.size
+	case "!=":
+		return size != t.size
+	}
+	return t.matchString(strconv.FormatInt(size, 10))
+}
+
+// matchList reports whether a term of a list field matches: any element for
+// =, ~ and comparisons, no element for !=. Store paths match by package name
+// or basename.
+func (t selectorTerm) matchList(values []string, storePaths bool) bool {
+	positive := t
+	if t.op == "!=" {
+		positive.op = "="
+	}
+	found := false
+	for _, value := range values {
+		candidates := []string{value}
+		if storePaths {
+			name, _ := parseStoreName(value)
+			candidates = []string{name, path.Base(value)}
+		}
+		for _, candidate := range candidates {
+			if positive.matchString(candidate) {
+				found = true
+			}
+		}
+	}
+	return found != (t.op == "!=")
+}
+
+// Matches reports whether p matches every term of sel.
+func (sel Selector) Matches(p PackageInfo) bool {
+	for _, t := range sel {
+		var ok bool
+		switch t.field {
+		case "name":
+			ok = t.matchString(p.Name)
+		case "version":
+			ok = t.matchString(p.Version)
+		case "path":
+			ok = t.matchString(path.Base(p.StorePath))
+		case "size":
+			ok = t.matchSize(p.NarSize)
+		case "download":
+			ok = t.matchSize(p.FileSize)
+		case "refs":
+			ok = t.matchList(p.References, true)
+		case "referrers":
+			ok = t.matchList(p.Referrers, true)
+		case "repo":
+			ok = t.matchList(p.Repositories, false)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Query returns the packages of lock matching sel, sorted by store path.
+func Query(lock *Lockfile, sel Selector) []PackageInfo {
+	referrers := make(map[string][]string)
+	for storePath, node := range lock.Packages {
+		for _, ref := range referencePaths(storePath, node) {
+			referrers[ref] = append(referrers[ref], storePath)
+		}
+	}
+	repos := make(map[string][]string)
+	for name, repo := range lock.Repositories {
+		closure := append([]string{repo.StorePath}, getTransitiveClosure(repo.StorePath, lock.Packages)...)
+		for _, storePath := range closure {
+			repos[storePath] = append(repos[storePath], name)
+		}
+	}
+
+	results := []PackageInfo{}
+	for storePath, node := range lock.Packages {
+		name, version := parseStoreName(storePath)
+		p := PackageInfo{
+			StorePath:    storePath,
+			Name:         name,
+			Version:      version,
+			NarSize:      node.NarSize,
+			FileSize:     node.FileSize,
+			References:   referencePaths(storePath, node),
+			Referrers:    append([]string{}, referrers[storePath]...),
+			Repositories: append([]string{}, repos[storePath]...),
+		}
+		sort.Strings(p.Referrers)
+		sort.Strings(p.Repositories)
+		if sel.Matches(p) {
+			results = append(results, p)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].StorePath < results[j].StorePath })
+	return results
+}
@@ -0,0 +1,78 @@
+package nixbazel
+
+import (
+	"path"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestQuery(t *testing.T) {
+	lock := testGraphLockfile()
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{"", []string{testMagickPath, testRsvgPath, testPangoPath, testLLVMPath, testLibcPath, testZlibPath}},
+		{"name=glibc", []string{testLibcPath}},
+		{"name=lib*", []string{testRsvgPath}},
+		{"name~^(llvm|zlib)$", []string{testLLVMPath, testZlibPath}},
+		{"size>2K", []string{testLLVMPath}},
+		{"size<=200 download>=50", []string{testMagickPath, testRsvgPath}},
+		{"size=3000", []string{testLLVMPath}},
+		{"size!=100 download=150", []string{testPangoPath}},
+		{"version>=2.40 version<3", []string{testRsvgPath, testLibcPath}},
+		{"refs=llvm", []string{testRsvgPath, testPangoPath}},
+		{"referrers=" + path.Base(testLLVMPath), []string{testLibcPath}},
+		{"repo=zlib", []string{testLibcPath, testZlibPath}},
+		{"repo!=zlib name!=llvm", []string{testMagickPath, testRsvgPath, testPangoPath}},
+	}
+	for _, test := range tests {
+		sel, err := ParseSelector(test.query)
+		if err != nil {
+			t.Errorf("ParseSelector(%q) failed: %v", test.query, err)
+			continue
+		}
+		var got []string
+		for _, p := range Query(lock, sel) {
+			got = append(got, p.StorePath)
+		}
+		want := append([]string(nil), test.expected...)
+		sort.Strings(want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Query(%q) = %q, expected %q", test.query, got, want)
+		}
+	}
+}
+
+func TestParseSelectorErrors(t *testing.T) {
+	for _, query := range []string{"color=red", "name", "name<glibc", "size>big", "size=5*", "name~(", "refs>1"} {
+		if _, err := ParseSelector(query); err == nil {
+			t.Errorf("ParseSelector(%q) succeeded, expected an error", query)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"2.40-66", "2.40", 1},
+		{"2.9", "2.40", -1},
+		{"1.3.1", "1.3.1", 0},
+		{"2.40pre", "2.40", -1},
+		{"1.0-dev", "1.0.1", -1},
+		{"2.40pre", "2.39", 1},
+		{"1.1.1w", "1.1.1", 1},
+		{"2.3a", "2.3.1", -1},
+		{"1.2pre1", "1.2pre2", -1},
+		{"1.0alpha", "1.0beta", -1},
+		{"1.0.0", "1.0", 1},
+	}
+	for _, test := range tests {
+		if got := compareVersions(test.a, test.b); got != test.expected {
+			t.Errorf("compareVersions(%q, %q) = %d, expected %d", test.a, test.b, got, test.expected)
+		}
+	}
+}
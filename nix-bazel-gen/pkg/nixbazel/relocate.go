@@ -0,0 +1,120 @@
+package nixbazel
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Relocation rewrites the ELF files of an unpacked store path so they load
+// their libraries from the unpack root, where the closure is laid out as
+// siblings of the store path, instead of from /nix/store.
+type Relocation struct {
+	// InterpreterPrefix replaces /nix/store in PT_INTERP. The kernel does not
+	// expand $ORIGIN for the interpreter, so this is either absolute or
+	// relative to the working directory of the process (the execroot for
+	// Bazel actions).
+	InterpreterPrefix string
+	// References are the store paths of the closure. Their lib directories
+	// are appended to every RUNPATH so transitive libraries are found too.
+	References []string
+}
+
+// SetRelocation makes Unpack relocate every ELF file it unpacks.
+func (f *Fetcher) SetRelocation(r Relocation) {
+	f.relocation = &r
+}
+
+// RelocateTree relocates the ELF files of storePath unpacked below root and
+// returns the number of files changed.
+func RelocateTree(root, storePath string, r Relocation, progress io.Writer) (int, error) {
+	storeDir := filepath.Join(root, path.Base(storePath))
+	patched := 0
+	err := filepath.WalkDir(storeDir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || !isELF(file) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, filepath.Dir(file))
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		ef, err := parseElfFile(data)
+		if err != nil {
+			return nil // Not a usable ELF file, leave it alone
+		}
+
+		patch := ElfPatch{
+			Interpreter: relocateInterpreter(ef.Interpreter(), r.InterpreterPrefix),
+			RunPath:     relocateRunPath(ef.RunPath(), filepath.ToSlash(rel), r.References),
+			SetRunPath:  true,
+		}
+		changed, err := PatchELF(file, patch)
+		if errors.Is(err, ErrNoNoteSegment) {
+			fmt.Fprintf(progress, "Warning: not relocating %v\n", err)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if changed {
+			patched++
+		}
+		return nil
+	})
+	return patched, err
+}
+
+// relocateInterpreter maps a /nix/store interpreter under prefix. Other
+// interpreters are kept.
+func relocateInterpreter(interp, prefix string) string {
+	rest, ok := strings.CutPrefix(interp, nixStoreDir+"/")
+	if !ok || prefix == "" {
+		return ""
+	}
+	return path.Join(prefix, rest)
+}
+
+// relocateRunPath rewrites /nix/store entries of runPath relative to $ORIGIN
+// for a file in dir (relative to the unpack root) and appends the lib
+// directories of references.
+func relocateRunPath(runPath, dir string, references []string) string {
+	up := ""
+	if dir != "." {
+		up = strings.Repeat("../", strings.Count(dir, "/")+1)
+	}
+	origin := func(rest string) string {
+		// Not path.Clean, which would collapse "$ORIGIN/.."
+		return "$ORIGIN/" + up + strings.TrimSuffix(rest, "/")
+	}
+
+	var entries []string
+	seen := make(map[string]bool)
+	add := func(entry string) {
+		if entry != "" && !seen[entry] {
+			seen[entry] = true
+			entries = append(entries, entry)
+		}
+	}
+	for _, entry := range strings.Split(runPath, ":") {
+		if rest, ok := strings.CutPrefix(entry, nixStoreDir+"/"); ok {
+			entry = origin(rest)
+		}
+		add(entry)
+	}
+	for _, ref := range references {
+		add(origin(path.Base(ref) + "/lib"))
+	}
+	return strings.Join(entries, ":")
+}
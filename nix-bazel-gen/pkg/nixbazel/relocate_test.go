@@ -0,0 +1,44 @@
+package nixbazel
+
+import (
+	"testing"
+)
+
+func TestRelocateRunPath(t *testing.T) {
+	const glibc = "/nix/store/xx7cm72qy2c0643cm1ipngd87aqwkcdp-glibc-2.40-66"
+	tests := []struct {
+		runPath  string
+		dir      string
+		refs     []string
+		expected string
+	}{
+		{"", "abc-hello/bin", []string{glibc}, "$ORIGIN/../../xx7cm72qy2c0643cm1ipngd87aqwkcdp-glibc-2.40-66/lib"},
+		{glibc + "/lib:$ORIGIN", "abc-hello/lib", []string{glibc}, "$ORIGIN/../../xx7cm72qy2c0643cm1ipngd87aqwkcdp-glibc-2.40-66/lib:$ORIGIN"},
+		{"/nix/store/def-zlib/lib/", "abc-hello/libexec/x", nil, "$ORIGIN/../../../def-zlib/lib"},
+		{"/usr/lib", "abc-hello/bin", nil, "/usr/lib"},
+	}
+
+	for _, test := range tests {
+		if result := relocateRunPath(test.runPath, test.dir, test.refs); result != test.expected {
+			t.Errorf("relocateRunPath(%q, %q) = %q, expected %q", test.runPath, test.dir, result, test.expected)
+		}
+	}
+}
+
+func TestRelocateInterpreter(t *testing.T) {
+	tests := []struct {
+		interp   string
+		prefix   string
+		expected string
+	}{
+		{"/nix/store/xx7c-glibc/lib/ld-linux-x86-64.so.2", "bazel-out/k8/bin/root", "bazel-out/k8/bin/root/xx7c-glibc/lib/ld-linux-x86-64.so.2"},
+		{"/lib64/ld-linux-x86-64.so.2", "root", ""},
+		{"", "root", ""},
+	}
+
+	for _, test := range tests {
+		if result := relocateInterpreter(test.interp, test.prefix); result != test.expected {
+			t.Errorf("relocateInterpreter(%q, %q) = %q, expected %q", test.interp, test.prefix, result, test.expected)
+		}
+	}
+}
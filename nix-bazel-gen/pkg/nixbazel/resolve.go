@@ -4,10 +4,55 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"sort"
 )
 
-func RunResolve(configFile, lockFile, channel string, doFetch bool) error {
+// ResolveOptions controls RunResolve.
+type ResolveOptions struct {
+	ConfigFile string
+	LockFile   string
+	Channel    string
+	// CacheURL is the binary cache to resolve from. Defaults to
+	// cache.nixos.org.
+	CacheURL string
+	// Fetch downloads packages and generates build files after resolving.
+	Fetch bool
+	// Manifests records the contents of every store path in the manifest
+	// sidecar next to the lockfile.
+	Manifests bool
+	// Dedup makes fetched trees canonical (read-only) and hardlinks
+	// identical files across them.
+	Dedup bool
+	// LocalStore, if set, takes fetched store paths from a local Nix store
+	// when present.
+	LocalStore *LocalStore
+	// LocalDB, if set, resolves store paths from a local Nix database before
+	// asking the binary cache.
+	LocalDB *LocalDB
+	// PathInfo is the output of "nix path-info --json --recursive" to merge
+	// into the lockfile, pinning paths that are not built by Hydra.
+	PathInfo string
+	// Substituters are binary caches checked for paths from LocalDB or
+	// PathInfo that have no URL. Defaults to cache.nixos.org.
+	Substituters []string
+	// Reresolve names repositories to resolve again even though the
+	// lockfile has them, e.g. to fix those found by CheckConsistency.
+	Reresolve []string
+	// SingleEval resolves every Hydra package of this run from the latest
+	// evaluation of its jobset in which all of them built, instead of each
+	// job's latest build, so their closures share glibc and the other
+	// common dependencies.
+	SingleEval bool
+	// Progress receives progress messages and warnings. Defaults to
+	// os.Stdout.
+	Progress io.Writer
+}
+
+func RunResolve(opts ResolveOptions) error {
+	configFile, lockFile, channel := opts.ConfigFile, opts.LockFile, opts.Channel
+
 	// Read config
 	data, err := os.ReadFile(configFile)
 	if err != nil {
@@ -18,12 +63,37 @@ func RunResolve(configFile, lockFile, channel string, doFetch bool) error {
 		return fmt.Errorf("failed to parse config: %w", err)
 	}
 
-	f := NewFetcher(defaultCacheURL, "")
+	cacheURL := opts.CacheURL
+	if cacheURL == "" {
+		cacheURL = defaultCacheURL
+	}
+	f := NewFetcher(cacheURL, "")
+	if opts.Progress != nil {
+		f.SetProgress(opts.Progress)
+	}
+	reresolve := make(map[string]bool)
+	for _, name := range opts.Reresolve {
+		if _, ok := config.Repositories[name]; !ok {
+			return fmt.Errorf("repository %q to re-resolve is not in %s", name, configFile)
+		}
+		reresolve[name] = true
+	}
+
+	manifestFile := ManifestPath(lockFile)
+	if opts.Manifests {
+		if f.manifests, err = LoadManifests(manifestFile); err != nil {
+			return err
+		}
+	}
 
 	// Try to read existing lockfile
 	var existingLock Lockfile
-	if lockData, err := os.ReadFile(lockFile); err == nil {
-		json.Unmarshal(lockData, &existingLock)
+	if _, err := os.Stat(lockFile); err == nil {
+		loaded, err := LoadLockfile(lockFile)
+		if err != nil {
+			return fmt.Errorf("%w (remove it to resolve from scratch)", err)
+		}
+		existingLock = *loaded
 	}
 
 	lock := Lockfile{
@@ -36,12 +106,52 @@ func RunResolve(configFile, lockFile, channel string, doFetch bool) error {
 		lock.Packages = existingLock.Packages
 	}
 
+	if opts.PathInfo != "" {
+		nodes, err := LoadPathInfo(opts.PathInfo)
+		if err != nil {
+			return err
+		}
+		for storePath, node := range nodes {
+			for _, ref := range node.References {
+				if _, ok := nodes[nixStoreDir+"/"+ref]; !ok {
+					fmt.Fprintf(f.progress, "Warning: %s refers to %s, which is not in %s (use nix path-info --recursive)\n", storePath, ref, opts.PathInfo)
+				}
+			}
+			// Newer information replaces what the old lockfile had
+			delete(lock.Packages, storePath)
+		}
+		f.mergeNodes(context.Background(), nodes, lock.Packages, opts.Substituters)
+		fmt.Fprintf(f.progress, "Merged %d store paths from %s\n", len(nodes), opts.PathInfo)
+	}
+
+	if opts.SingleEval {
+		f.hydraEvals = make(map[string]int64)
+		for name, repoConfig := range config.Repositories {
+			if _, cached := existingLock.Repositories[name]; cached && !reresolve[name] {
+				continue
+			}
+			if extractHash(repoConfig.Package) == "" {
+				f.hydraJobs = append(f.hydraJobs, repoConfig.Package)
+			}
+		}
+		sort.Strings(f.hydraJobs)
+	}
+
 	for name, repoConfig := range config.Repositories {
+		if repoConfig.Toolchain != "" && !toolchainKinds[repoConfig.Toolchain] {
+			return fmt.Errorf("repository %s: unknown toolchain kind %q", name, repoConfig.Toolchain)
+		}
+
 		// Check if we can reuse existing resolution
-		if existingRepo, ok := existingLock.Repositories[name]; ok {
+		if existingRepo, ok := existingLock.Repositories[name]; ok && !reresolve[name] {
 			// If package name matches (simple check), reuse
 			// In a real implementation we might want stricter checks
-			fmt.Printf("Using cached resolution for %s\n", name)
+			fmt.Fprintf(f.progress, "Using cached resolution for %s\n", name)
+			// Attributes that do not affect resolution follow the config
+			existingRepo.Entrypoint = repoConfig.Entrypoint
+			existingRepo.Toolchain = repoConfig.Toolchain
+			existingRepo.Files = repoConfig.Files
+			existingRepo.System = packageSystem(repoConfig.Package)
 			lock.Repositories[name] = existingRepo
 
 			// Ensure closure is present in lock.Packages
@@ -49,7 +159,7 @@ func RunResolve(configFile, lockFile, channel string, doFetch bool) error {
 			continue
 		}
 
-		fmt.Printf("Resolving %s (%s)...\n", name, repoConfig.Package)
+		fmt.Fprintf(f.progress, "Resolving %s (%s)...\n", name, repoConfig.Package)
 
 		// 1. Resolve to store path (Hydra or direct hash)
 		hash := extractHash(repoConfig.Package)
@@ -63,7 +173,25 @@ func RunResolve(configFile, lockFile, channel string, doFetch bool) error {
 			hash = extractHash(storePath)
 		}
 
-		// 2. Build closure
+		// 2. Build closure, from the local Nix database if it has the path
+		if opts.LocalDB != nil {
+			localPath, err := f.resolveLocalClosure(context.Background(), *opts.LocalDB, hash, lock.Packages, opts.Substituters)
+			if err != nil {
+				return fmt.Errorf("failed to resolve closure for %s from local database: %w", repoConfig.Package, err)
+			}
+			if localPath != "" {
+				fmt.Fprintf(f.progress, "Resolved %s from local database\n", localPath)
+				lock.Repositories[name] = RepositoryLock{
+					StorePath:  localPath,
+					Entrypoint: repoConfig.Entrypoint,
+					Toolchain:  repoConfig.Toolchain,
+					Files:      repoConfig.Files,
+					System:     packageSystem(repoConfig.Package),
+				}
+				continue
+			}
+		}
+
 		// We pass the global packages map to resolveClosure to populate it directly
 		rootInfo, err := f.resolveClosure(context.Background(), hash, lock.Packages)
 		if err != nil {
@@ -77,24 +205,51 @@ func RunResolve(configFile, lockFile, channel string, doFetch bool) error {
 		lock.Repositories[name] = RepositoryLock{
 			StorePath:  storePath,
 			Entrypoint: repoConfig.Entrypoint,
+			Toolchain:  repoConfig.Toolchain,
+			Files:      repoConfig.Files,
+			System:     packageSystem(repoConfig.Package),
 		}
 	}
 
-	// Write lockfile
-	lockData, err := json.MarshalIndent(lock, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to marshal lockfile: %w", err)
+	if f.manifests != nil {
+		// Backfill manifests for packages reused from the existing lockfile
+		// and drop the ones no longer referenced.
+		used := make(Manifests)
+		for storePath, node := range lock.Packages {
+			info := &NarInfo{
+				URL:         node.URL,
+				StorePath:   storePath,
+				Compression: "xz",
+			}
+			if err := f.recordManifest(context.Background(), node.Hash, info, node.NarHash); err != nil {
+				return err
+			}
+			used[node.NarHash] = f.manifests[node.NarHash]
+		}
+		if err := WriteManifests(manifestFile, used); err != nil {
+			return err
+		}
+		fmt.Fprintf(f.progress, "Generated %s\n", manifestFile)
 	}
-	if err := os.WriteFile(lockFile, lockData, 0644); err != nil {
-		return fmt.Errorf("failed to write lockfile: %w", err)
+
+	// Write lockfile
+	if err := WriteLockfile(lockFile, &lock); err != nil {
+		return err
 	}
-	fmt.Printf("Generated %s\n", lockFile)
+	fmt.Fprintf(f.progress, "Generated %s\n", lockFile)
 
-	if doFetch {
+	if opts.Fetch {
 		// Generate build files
-		fmt.Println("Generating build files...")
+		fmt.Fprintln(f.progress, "Generating build files...")
 		// Use current directory as outDir
 		f.outDir = "."
+		if opts.Dedup {
+			f.SetCanonical(true)
+			f.SetDedup(true)
+		}
+		if opts.LocalStore != nil {
+			f.SetLocalStore(*opts.LocalStore)
+		}
 		if err := f.FetchAllFromLock(&lock); err != nil {
 			return fmt.Errorf("failed to generate build files: %w", err)
 		}
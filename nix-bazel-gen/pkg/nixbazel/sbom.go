@@ -0,0 +1,320 @@
+package nixbazel
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SBOMOptions controls the SBOM documents written by CycloneDX and SPDX.
+type SBOMOptions struct {
+	// CacheURL makes relative NAR URLs absolute for download locations.
+	// Defaults to cache.nixos.org.
+	CacheURL string
+	// Created is the creation time of the documents. Set it (e.g. from
+	// SOURCE_DATE_EPOCH) for reproducible output.
+	Created time.Time
+}
+
+// sbomPackage is one store path of a repository's closure.
+type sbomPackage struct {
+	storePath string
+	name      string
+	version   string
+	node      ClosureNode
+	dependsOn []string // Store paths
+}
+
+// sbomClosure returns the closure of repo, its root first and the rest
+// sorted by store path.
+func sbomClosure(lock *Lockfile, repo string) ([]sbomPackage, error) {
+	repoLock, ok := lock.Repositories[repo]
+	if !ok {
+		return nil, fmt.Errorf("repository %q not found in lockfile", repo)
+	}
+	rest := getTransitiveClosure(repoLock.StorePath, lock.Packages)
+	sort.Strings(rest)
+	var packages []sbomPackage
+	for _, storePath := range append([]string{repoLock.StorePath}, rest...) {
+		node, ok := lock.Packages[storePath]
+		if !ok {
+			return nil, fmt.Errorf("package %s not found in lockfile packages", storePath)
+		}
+		name, version := parseStoreName(storePath)
+		packages = append(packages, sbomPackage{
+			storePath: storePath,
+			name:      name,
+			version:   version,
+			node:      node,
+			dependsOn: referencePaths(storePath, node),
+		})
+	}
+	return packages, nil
+}
+
+// purl is the package URL of a store path, e.g.
+// pkg:nix/glibc@2.40-66?outpath=%2Fnix%2Fstore%2F...-glibc-2.40-66. The
+// store path tells apart builds of the same name and version.
+func (p sbomPackage) purl() string {
+	purl := "pkg:nix/" + url.PathEscape(p.name)
+	if p.version != "" {
+		purl += "@" + url.PathEscape(p.version)
+	}
+	return purl + "?outpath=" + url.QueryEscape(p.storePath)
+}
+
+// hashAlgorithm names the algorithm of a hex NarHash: "SHA-256" or
+// "SHA-512".
+func (p sbomPackage) hashAlgorithm() string {
+	if len(p.node.NarHash) == 2*sha512Size {
+		return "SHA-512"
+	}
+	return "SHA-256"
+}
+
+// sha512Size is the size of a SHA-512 digest in bytes.
+const sha512Size = 64
+
+// downloadURL is where the package's NAR can be downloaded, or "" for
+// local-only paths.
+func (p sbomPackage) downloadURL(cacheURL string) string {
+	switch {
+	case p.node.URL == "" || p.node.LocalOnly:
+		return ""
+	case strings.Contains(p.node.URL, "://"):
+		return p.node.URL
+	default:
+		return strings.TrimRight(cacheURL, "/") + "/" + p.node.URL
+	}
+}
+
+// sbomUUID is a UUID derived from the repository's store path, so the same
+// closure always gets the same serial number and namespace. It is a SHA-256
+// hash rather than the SHA-1 of a version 5 UUID, so it is marked as a
+// version 8 (custom) UUID as defined by RFC 9562.
+func sbomUUID(repo, storePath string) string {
+	sum := sha256.Sum256([]byte(repo + "\x00" + storePath))
+	sum[6] = sum[6]&0x0f | 0x80 // Version 8 (custom)
+	sum[8] = sum[8]&0x3f | 0x80 // RFC 4122 variant
+	h := hex.EncodeToString(sum[:16])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
+
+// CycloneDX types, with the fields we fill in (CycloneDX 1.5).
+type (
+	CycloneDXBOM struct {
+		BOMFormat    string                `json:"bomFormat"`
+		SpecVersion  string                `json:"specVersion"`
+		SerialNumber string                `json:"serialNumber"`
+		Version      int                   `json:"version"`
+		Metadata     CycloneDXMetadata     `json:"metadata"`
+		Components   []CycloneDXComponent  `json:"components"`
+		Dependencies []CycloneDXDependency `json:"dependencies"`
+	}
+	CycloneDXMetadata struct {
+		Timestamp string             `json:"timestamp"`
+		Tools     CycloneDXTools     `json:"tools"`
+		Component CycloneDXComponent `json:"component"`
+	}
+	CycloneDXTools struct {
+		Components []CycloneDXComponent `json:"components"`
+	}
+	CycloneDXComponent struct {
+		Type               string                       `json:"type"`
+		BOMRef             string                       `json:"bom-ref,omitempty"`
+		Name               string                       `json:"name"`
+		Version            string                       `json:"version,omitempty"`
+		PURL               string                       `json:"purl,omitempty"`
+		Hashes             []CycloneDXHash              `json:"hashes,omitempty"`
+		ExternalReferences []CycloneDXExternalReference `json:"externalReferences,omitempty"`
+	}
+	CycloneDXHash struct {
+		Alg     string `json:"alg"`
+		Content string `json:"content"`
+	}
+	CycloneDXExternalReference struct {
+		Type string `json:"type"`
+		URL  string `json:"url"`
+	}
+	CycloneDXDependency struct {
+		Ref       string   `json:"ref"`
+		DependsOn []string `json:"dependsOn"`
+	}
+)
+
+// CycloneDX returns a CycloneDX SBOM of the closure of repo: the
+// repository's store path is the metadata component, every other store path
+// a library component, and references are dependencies.
+func CycloneDX(lock *Lockfile, repo string, opts SBOMOptions) (*CycloneDXBOM, error) {
+	packages, err := sbomClosure(lock, repo)
+	if err != nil {
+		return nil, err
+	}
+	if opts.CacheURL == "" {
+		opts.CacheURL = defaultCacheURL
+	}
+
+	component := func(p sbomPackage, typ string) CycloneDXComponent {
+		c := CycloneDXComponent{
+			Type:    typ,
+			BOMRef:  path.Base(p.storePath),
+			Name:    p.name,
+			Version: p.version,
+			PURL:    p.purl(),
+			Hashes:  []CycloneDXHash{{Alg: p.hashAlgorithm(), Content: p.node.NarHash}},
+		}
+		if u := p.downloadURL(opts.CacheURL); u != "" {
+			c.ExternalReferences = []CycloneDXExternalReference{{Type: "distribution", URL: u}}
+		}
+		return c
+	}
+
+	bom := &CycloneDXBOM{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: "urn:uuid:" + sbomUUID(repo, packages[0].storePath),
+		Version:      1,
+		Metadata: CycloneDXMetadata{
+			Timestamp: opts.Created.UTC().Format(time.RFC3339),
+			Tools:     CycloneDXTools{Components: []CycloneDXComponent{{Type: "application", Name: "nix-bazel"}}},
+			Component: component(packages[0], "application"),
+		},
+		Components:   []CycloneDXComponent{},
+		Dependencies: []CycloneDXDependency{},
+	}
+	for i, p := range packages {
+		if i > 0 {
+			bom.Components = append(bom.Components, component(p, "library"))
+		}
+		dep := CycloneDXDependency{Ref: path.Base(p.storePath), DependsOn: []string{}}
+		for _, ref := range p.dependsOn {
+			dep.DependsOn = append(dep.DependsOn, path.Base(ref))
+		}
+		bom.Dependencies = append(bom.Dependencies, dep)
+	}
+	return bom, nil
+}
+
+// SPDX types, with the fields we fill in (SPDX 2.3).
+type (
+	SPDXDocument struct {
+		SPDXVersion       string             `json:"spdxVersion"`
+		DataLicense       string             `json:"dataLicense"`
+		SPDXID            string             `json:"SPDXID"`
+		Name              string             `json:"name"`
+		DocumentNamespace string             `json:"documentNamespace"`
+		CreationInfo      SPDXCreationInfo   `json:"creationInfo"`
+		Packages          []SPDXPackage      `json:"packages"`
+		Relationships     []SPDXRelationship `json:"relationships"`
+	}
+	SPDXCreationInfo struct {
+		Created  string   `json:"created"`
+		Creators []string `json:"creators"`
+	}
+	SPDXPackage struct {
+		Name             string            `json:"name"`
+		SPDXID           string            `json:"SPDXID"`
+		VersionInfo      string            `json:"versionInfo,omitempty"`
+		DownloadLocation string            `json:"downloadLocation"`
+		FilesAnalyzed    bool              `json:"filesAnalyzed"`
+		Checksums        []SPDXChecksum    `json:"checksums"`
+		ExternalRefs     []SPDXExternalRef `json:"externalRefs"`
+		LicenseConcluded string            `json:"licenseConcluded"`
+		LicenseDeclared  string            `json:"licenseDeclared"`
+		CopyrightText    string            `json:"copyrightText"`
+	}
+	SPDXChecksum struct {
+		Algorithm     string `json:"algorithm"`
+		ChecksumValue string `json:"checksumValue"`
+	}
+	SPDXExternalRef struct {
+		ReferenceCategory string `json:"referenceCategory"`
+		ReferenceType     string `json:"referenceType"`
+		ReferenceLocator  string `json:"referenceLocator"`
+	}
+	SPDXRelationship struct {
+		SPDXElementID      string `json:"spdxElementId"`
+		RelationshipType   string `json:"relationshipType"`
+		RelatedSPDXElement string `json:"relatedSpdxElement"`
+	}
+)
+
+// spdxID returns the SPDX identifier of a store path. Identifiers may only
+// contain letters, digits, "." and "-".
+func spdxID(storePath string) string {
+	id := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '-'
+	}, path.Base(storePath))
+	return "SPDXRef-Package-" + id
+}
+
+// SPDX returns an SPDX SBOM of the closure of repo. The document describes
+// the repository's store path, which depends on its references.
+// Licenses are not in the lockfile and are left as NOASSERTION.
+func SPDX(lock *Lockfile, repo string, opts SBOMOptions) (*SPDXDocument, error) {
+	packages, err := sbomClosure(lock, repo)
+	if err != nil {
+		return nil, err
+	}
+	if opts.CacheURL == "" {
+		opts.CacheURL = defaultCacheURL
+	}
+
+	doc := &SPDXDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              repo,
+		DocumentNamespace: "https://spdx.org/spdxdocs/nix-bazel-" + url.PathEscape(repo) + "-" + sbomUUID(repo, packages[0].storePath),
+		CreationInfo: SPDXCreationInfo{
+			Created:  opts.Created.UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: nix-bazel"},
+		},
+		Packages: []SPDXPackage{},
+		Relationships: []SPDXRelationship{{
+			SPDXElementID:      "SPDXRef-DOCUMENT",
+			RelationshipType:   "DESCRIBES",
+			RelatedSPDXElement: spdxID(packages[0].storePath),
+		}},
+	}
+	for _, p := range packages {
+		download := p.downloadURL(opts.CacheURL)
+		if download == "" {
+			download = "NOASSERTION"
+		}
+		doc.Packages = append(doc.Packages, SPDXPackage{
+			Name:             p.name,
+			SPDXID:           spdxID(p.storePath),
+			VersionInfo:      p.version,
+			DownloadLocation: download,
+			Checksums: []SPDXChecksum{{
+				Algorithm:     strings.ReplaceAll(p.hashAlgorithm(), "-", ""),
+				ChecksumValue: p.node.NarHash,
+			}},
+			ExternalRefs: []SPDXExternalRef{{
+				ReferenceCategory: "PACKAGE-MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator:  p.purl(),
+			}},
+			LicenseConcluded: "NOASSERTION",
+			LicenseDeclared:  "NOASSERTION",
+			CopyrightText:    "NOASSERTION",
+		})
+		for _, ref := range p.dependsOn {
+			doc.Relationships = append(doc.Relationships, SPDXRelationship{
+				SPDXElementID:      spdxID(p.storePath),
+				RelationshipType:   "DEPENDS_ON",
+				RelatedSPDXElement: spdxID(ref),
+			})
+		}
+	}
+	return doc, nil
+}
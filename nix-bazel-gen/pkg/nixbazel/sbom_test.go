@@ -0,0 +1,113 @@
+package nixbazel
+
+import (
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCycloneDX(t *testing.T) {
+	lock := testGraphLockfile()
+	node := lock.Packages[testZlibPath]
+	node.URL = "nar/zlib.nar.xz"
+	lock.Packages[testZlibPath] = node
+	opts := SBOMOptions{CacheURL: "https://cache.example.org/", Created: time.Unix(0, 0)}
+
+	bom, err := CycloneDX(lock, "zlib", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := bom.Metadata.Component
+	expected := CycloneDXComponent{
+		Type:               "application",
+		BOMRef:             path.Base(testZlibPath),
+		Name:               "zlib",
+		Version:            "1.3.1",
+		PURL:               "pkg:nix/zlib@1.3.1?outpath=%2Fnix%2Fstore%2Fgggggggggggggggggggggggggggggggg-zlib-1.3.1",
+		Hashes:             []CycloneDXHash{{Alg: "SHA-256", Content: testHelloHash}},
+		ExternalReferences: []CycloneDXExternalReference{{Type: "distribution", URL: "https://cache.example.org/nar/zlib.nar.xz"}},
+	}
+	if !reflect.DeepEqual(root, expected) {
+		t.Errorf("metadata component = %+v, expected %+v", root, expected)
+	}
+	if bom.Metadata.Timestamp != "1970-01-01T00:00:00Z" {
+		t.Errorf("timestamp = %q, expected the epoch", bom.Metadata.Timestamp)
+	}
+	if len(bom.Components) != 1 || bom.Components[0].Name != "glibc" || bom.Components[0].Type != "library" {
+		t.Errorf("components = %+v, expected glibc", bom.Components)
+	}
+	dependencies := []CycloneDXDependency{
+		{Ref: path.Base(testZlibPath), DependsOn: []string{path.Base(testLibcPath)}},
+		{Ref: path.Base(testLibcPath), DependsOn: []string{}},
+	}
+	if !reflect.DeepEqual(bom.Dependencies, dependencies) {
+		t.Errorf("dependencies = %+v, expected %+v", bom.Dependencies, dependencies)
+	}
+
+	// The serial number only depends on the closure
+	again, err := CycloneDX(lock, "zlib", SBOMOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.SerialNumber != bom.SerialNumber {
+		t.Errorf("serial number changed from %s to %s", bom.SerialNumber, again.SerialNumber)
+	}
+	if _, err := CycloneDX(lock, "missing", opts); err == nil {
+		t.Error("CycloneDX(missing) succeeded, expected an error")
+	}
+}
+
+func TestSPDX(t *testing.T) {
+	doc, err := SPDX(testGraphLockfile(), "imagemagick", SBOMOptions{Created: time.Unix(0, 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Packages) != 5 {
+		t.Fatalf("SPDX(imagemagick) has %d packages, expected 5", len(doc.Packages))
+	}
+	glibc := doc.Packages[len(doc.Packages)-1]
+	if glibc.Name != "glibc" || glibc.VersionInfo != "2.40-66" || glibc.DownloadLocation != "NOASSERTION" ||
+		glibc.Checksums[0] != (SPDXChecksum{Algorithm: "SHA256", ChecksumValue: testHelloHash}) {
+		t.Errorf("glibc package = %+v", glibc)
+	}
+
+	relationships := make(map[SPDXRelationship]bool)
+	for _, r := range doc.Relationships {
+		relationships[r] = true
+	}
+	for _, r := range []SPDXRelationship{
+		{"SPDXRef-DOCUMENT", "DESCRIBES", spdxID(testMagickPath)},
+		{spdxID(testMagickPath), "DEPENDS_ON", spdxID(testRsvgPath)},
+		{spdxID(testLLVMPath), "DEPENDS_ON", spdxID(testLibcPath)},
+	} {
+		if !relationships[r] {
+			t.Errorf("relationships %+v do not include %+v", doc.Relationships, r)
+		}
+	}
+	// glibc's self-reference is not a dependency
+	if r := (SPDXRelationship{spdxID(testLibcPath), "DEPENDS_ON", spdxID(testLibcPath)}); relationships[r] {
+		t.Errorf("relationships include the self-reference %+v", r)
+	}
+}
+
+func TestSPDXID(t *testing.T) {
+	if id := spdxID("/nix/store/00000000000000000000000000000000-gtk+3-3.24_1"); id != "SPDXRef-Package-00000000000000000000000000000000-gtk-3-3.24-1" {
+		t.Errorf("spdxID = %q", id)
+	}
+}
+
+func TestSbomUUID(t *testing.T) {
+	uuid := sbomUUID("hello", testHelloPath)
+	if uuid != sbomUUID("hello", testHelloPath) {
+		t.Errorf("sbomUUID is not deterministic")
+	}
+	if uuid == sbomUUID("world", testHelloPath) {
+		t.Errorf("sbomUUID does not depend on the repository")
+	}
+	// xxxxxxxx-xxxx-8xxx-[89ab]xxx-xxxxxxxxxxxx
+	if len(uuid) != 36 || uuid[14] != '8' || !strings.ContainsRune("89ab", rune(uuid[19])) {
+		t.Errorf("sbomUUID(%q, %q) = %q, expected a version 8 RFC 9562 UUID", "hello", testHelloPath, uuid)
+	}
+}
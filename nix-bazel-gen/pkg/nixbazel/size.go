@@ -0,0 +1,101 @@
+package nixbazel
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ClosureSize is the size of a repository's closure.
+type ClosureSize struct {
+	Repository string `json:"repository"`
+	StorePath  string `json:"storePath"`
+	Paths      int    `json:"paths"`
+	NarSize    int64  `json:"narSize"`
+	FileSize   int64  `json:"fileSize"`
+	// Size of the paths in no other repository's closure, i.e. what
+	// removing the repository would save
+	UniqueNarSize  int64 `json:"uniqueNarSize"`
+	UniqueFileSize int64 `json:"uniqueFileSize"`
+	// The largest paths of the closure by NarSize
+	Largest []PackageSize `json:"largest"`
+}
+
+// PackageSize is the size of one store path of a closure.
+type PackageSize struct {
+	StorePath string `json:"storePath"`
+	NarSize   int64  `json:"narSize"`
+	FileSize  int64  `json:"fileSize"`
+	Unique    bool   `json:"unique"` // Only in this repository's closure
+}
+
+// ClosureSizes returns the closure size of each repository in lock, sorted
+// by name, with its top largest paths. Paths missing from lock.Packages
+// count as empty.
+func ClosureSizes(lock *Lockfile, top int) []ClosureSize {
+	closures := make(map[string][]string)
+	users := make(map[string]int) // store path -> repositories using it
+	for name, repo := range lock.Repositories {
+		closure := append([]string{repo.StorePath}, getTransitiveClosure(repo.StorePath, lock.Packages)...)
+		closures[name] = closure
+		for _, storePath := range closure {
+			users[storePath]++
+		}
+	}
+
+	sizes := make([]ClosureSize, 0, len(closures))
+	for name, closure := range closures {
+		size := ClosureSize{
+			Repository: name,
+			StorePath:  lock.Repositories[name].StorePath,
+			Paths:      len(closure),
+		}
+		packages := make([]PackageSize, 0, len(closure))
+		for _, storePath := range closure {
+			node := lock.Packages[storePath]
+			p := PackageSize{
+				StorePath: storePath,
+				NarSize:   node.NarSize,
+				FileSize:  node.FileSize,
+				Unique:    users[storePath] == 1,
+			}
+			size.NarSize += p.NarSize
+			size.FileSize += p.FileSize
+			if p.Unique {
+				size.UniqueNarSize += p.NarSize
+				size.UniqueFileSize += p.FileSize
+			}
+			packages = append(packages, p)
+		}
+		sort.Slice(packages, func(i, j int) bool {
+			if packages[i].NarSize != packages[j].NarSize {
+				return packages[i].NarSize > packages[j].NarSize
+			}
+			return packages[i].StorePath < packages[j].StorePath
+		})
+		if top >= 0 && len(packages) > top {
+			packages = packages[:top]
+		}
+		size.Largest = packages
+		sizes = append(sizes, size)
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i].Repository < sizes[j].Repository })
+	return sizes
+}
+
+// FormatSize formats a size in bytes for people, e.g. "12.3 MiB".
+func FormatSize(n int64) string {
+	const unit = 1024
+	if n < unit && n > -unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value := float64(n)
+	suffix := ""
+	for _, s := range []string{"KiB", "MiB", "GiB", "TiB"} {
+		value /= unit
+		suffix = s
+		if value < unit && value > -unit {
+			break
+		}
+	}
+	return fmt.Sprintf("%.1f %s", value, suffix)
+}
@@ -0,0 +1,60 @@
+package nixbazel
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestClosureSizes(t *testing.T) {
+	sizes := ClosureSizes(testGraphLockfile(), 2)
+	expected := []ClosureSize{
+		{
+			Repository:     "imagemagick",
+			StorePath:      testMagickPath,
+			Paths:          5,
+			NarSize:        4000,
+			FileSize:       2000,
+			UniqueNarSize:  3600,
+			UniqueFileSize: 1800,
+			Largest: []PackageSize{
+				{StorePath: testLLVMPath, NarSize: 3000, FileSize: 1500, Unique: true},
+				{StorePath: testLibcPath, NarSize: 400, FileSize: 200},
+			},
+		},
+		{
+			Repository:     "zlib",
+			StorePath:      testZlibPath,
+			Paths:          2,
+			NarSize:        410,
+			FileSize:       205,
+			UniqueNarSize:  10,
+			UniqueFileSize: 5,
+			Largest: []PackageSize{
+				{StorePath: testLibcPath, NarSize: 400, FileSize: 200},
+				{StorePath: testZlibPath, NarSize: 10, FileSize: 5, Unique: true},
+			},
+		},
+	}
+	if !reflect.DeepEqual(sizes, expected) {
+		t.Errorf("ClosureSizes() = %+v, expected %+v", sizes, expected)
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		n        int64
+		expected string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1536, "1.5 KiB"},
+		{300 << 20, "300.0 MiB"},
+		{5 << 30, "5.0 GiB"},
+		{-2048, "-2.0 KiB"},
+	}
+	for _, test := range tests {
+		if got := FormatSize(test.n); got != test.expected {
+			t.Errorf("FormatSize(%d) = %q, expected %q", test.n, got, test.expected)
+		}
+	}
+}
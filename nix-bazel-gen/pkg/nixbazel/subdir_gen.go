@@ -0,0 +1,68 @@
+package nixbazel
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// standardSubdirs are the package subdirectories exposed as
+// @nix_deps//:<repo>_<dir> filegroups.
+var standardSubdirs = []string{"bin", "lib", "include", "share", "etc"}
+
+// writeSubdirTargets emits a filegroup per standard subdirectory of a
+// repository's package. With a manifest only the directories the package
+// actually has are emitted; without one, missing directories yield empty
+// trees.
+func writeSubdirTargets(file *os.File, repoName, storeName string, m *Manifest) {
+	for _, dir := range standardSubdirs {
+		if m != nil {
+			e := m.Lookup(dir)
+			if e == nil || e.Type == EntryRegular {
+				continue
+			}
+		}
+		fmt.Fprintf(file, "nix_root_subdir(\n")
+		fmt.Fprintf(file, "    name = \"%s_%s_tree\",\n", repoName, dir)
+		fmt.Fprintf(file, "    root = \"//%s:root\",\n", storeName)
+		fmt.Fprintf(file, "    path = \"%s/%s\",\n", storeName, dir)
+		fmt.Fprintf(file, ")\n\n")
+		fmt.Fprintf(file, "filegroup(\n")
+		fmt.Fprintf(file, "    name = \"%s_%s\",\n", repoName, dir)
+		fmt.Fprintf(file, "    srcs = [\":%s_%s_tree\"],\n", repoName, dir)
+		fmt.Fprintf(file, ")\n\n")
+	}
+}
+
+// extractRequestedFiles extracts the files a repository explicitly asked for
+// from its downloaded NAR into <outDir>/<repo>/, returning their paths
+// relative to outDir for exports_files.
+func (f *Fetcher) extractRequestedFiles(repoName string, repo RepositoryLock, node ClosureNode) ([]string, error) {
+	if len(repo.Files) == 0 {
+		return nil, nil
+	}
+	for _, p := range repo.Files {
+		if !isValidLabelName(p) {
+			return nil, fmt.Errorf("repository %s: invalid file path %q", repoName, p)
+		}
+	}
+
+	archive := filepath.Join(f.outDir, "downloads", node.FileHash)
+	if _, err := os.Stat(archive); err != nil {
+		fmt.Fprintf(f.progress, "Warning: %s not downloaded, not exporting files of %s\n", archive, repoName)
+		return nil, nil
+	}
+
+	extractor := NewFetcher("", filepath.Join(f.outDir, repoName))
+	extractor.progress = f.progress
+	if err := extractor.Extract(archive, repo.StorePath, repo.Files); err != nil {
+		return nil, fmt.Errorf("repository %s: %w", repoName, err)
+	}
+
+	var exported []string
+	for _, p := range repo.Files {
+		exported = append(exported, path.Join(repoName, p))
+	}
+	return exported, nil
+}
@@ -0,0 +1,98 @@
+package nixbazel
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWriteSubdirTargets(t *testing.T) {
+	manifest := &Manifest{StorePath: testHelloPath, Entries: []ManifestEntry{
+		{Path: "", Type: EntryDirectory},
+		{Path: "bin", Type: EntryDirectory},
+		{Path: "bin/hello", Type: EntryRegular, Executable: true},
+		{Path: "etc", Type: EntryRegular},
+		{Path: "lib", Type: EntrySymlink, Target: "lib64"},
+	}}
+	tests := []struct {
+		manifest *Manifest
+		expected []string
+	}{
+		{manifest, []string{"bin", "lib"}},
+		{nil, standardSubdirs},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "BUILD.bazel")
+		file, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeSubdirTargets(file, "hello", "abc-hello", test.manifest)
+		file.Close()
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var expected strings.Builder
+		for _, dir := range test.expected {
+			expected.WriteString(`nix_root_subdir(
+    name = "hello_` + dir + `_tree",
+    root = "//abc-hello:root",
+    path = "abc-hello/` + dir + `",
+)
+
+filegroup(
+    name = "hello_` + dir + `",
+    srcs = [":hello_` + dir + `_tree"],
+)
+
+`)
+		}
+		if string(data) != expected.String() {
+			t.Errorf("writeSubdirTargets(%v) wrote:\n%s\nexpected:\n%s", test.expected, data, expected.String())
+		}
+	}
+}
+
+func TestExtractRequestedFiles(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "downloads"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestArchive(t, filepath.Join(dir, "downloads"), "aa", []testNarEntry{
+		{path: "", mode: fs.ModeDir},
+		{path: "include", mode: fs.ModeDir},
+		{path: "include/zlib.h", mode: 0644, content: "zlib.h"},
+		{path: "lib", mode: fs.ModeDir},
+		{path: "lib/libz.so", mode: fs.ModeSymlink, target: "libz.so.1"},
+		{path: "lib/libz.so.1", mode: 0755, content: "libz"},
+	})
+	f := NewFetcher("", dir)
+	repo := RepositoryLock{StorePath: "/nix/store/abc-zlib", Files: []string{"include/zlib.h", "lib/libz.so"}}
+
+	exported, err := f.extractRequestedFiles("zlib", repo, ClosureNode{FileHash: "aa"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"zlib/include/zlib.h", "zlib/lib/libz.so"}; !reflect.DeepEqual(exported, expected) {
+		t.Errorf("extractRequestedFiles() = %q, expected %q", exported, expected)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "zlib/lib/libz.so")); err != nil || string(data) != "libz" {
+		t.Errorf("zlib/lib/libz.so = %q, %v, expected the library", data, err)
+	}
+
+	// Not downloaded: nothing to export, but not an error
+	if exported, err := f.extractRequestedFiles("zlib", repo, ClosureNode{FileHash: "bb"}); err != nil || exported != nil {
+		t.Errorf("extractRequestedFiles(missing archive) = %q, %v, expected nothing", exported, err)
+	}
+
+	repo.Files = []string{"../etc/passwd"}
+	if _, err := f.extractRequestedFiles("zlib", repo, ClosureNode{FileHash: "aa"}); err == nil {
+		t.Errorf("extractRequestedFiles(../etc/passwd) succeeded, expected an error")
+	}
+}
@@ -0,0 +1,215 @@
+package nixbazel
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// maxTextRewriteSize bounds the files considered by the text rewriting pass.
+const maxTextRewriteSize = 16 << 20
+
+// TextRewrite configures the rewriting of shebangs and embedded store paths
+// in text files.
+type TextRewrite struct {
+	// Placeholder replaces the /nix/store prefix if non-empty. Otherwise
+	// store paths are made relative to the file where something resolves
+	// them against it: $(dirname "$0") in shell scripts and ${pcfiledir} in
+	// pkg-config files. Other files keep their store paths, since a plain
+	// relative path would resolve against the current directory.
+	Placeholder string
+	// Launcher replaces /nix/store interpreters in shebangs, with the
+	// interpreter's base name as its first argument. Defaults to
+	// /usr/bin/env, which looks the interpreter up on PATH.
+	Launcher string
+}
+
+// RewriteReport records the changes made by the text rewriting pass.
+type RewriteReport struct {
+	StorePath string          `json:"storePath"`
+	Files     []RewrittenFile `json:"files"`
+}
+
+// RewrittenFile describes the changes made to one file.
+type RewrittenFile struct {
+	Path         string `json:"path"` // Relative to the store path
+	Shebang      string `json:"shebang,omitempty"`
+	NewShebang   string `json:"newShebang,omitempty"`
+	Replacements int    `json:"replacements"` // Store path prefixes replaced
+}
+
+// SetTextRewrite makes Unpack rewrite text files it unpacks and write a
+// report to reportPath.
+func (f *Fetcher) SetTextRewrite(rw TextRewrite, reportPath string) {
+	f.textRewrite = &rw
+	f.textRewriteReport = reportPath
+}
+
+// RewriteTextTree rewrites the text files of storePath unpacked below root.
+func RewriteTextTree(root, storePath string, rw TextRewrite) (*RewriteReport, error) {
+	storeDir := filepath.Join(root, path.Base(storePath))
+	report := &RewriteReport{StorePath: storePath, Files: []RewrittenFile{}}
+	err := filepath.WalkDir(storeDir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.Size() > maxTextRewriteSize {
+			return nil
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if !isText(data) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+		out, change := rewriteText(data, filepath.ToSlash(rel), rw)
+		if out == nil {
+			return nil
+		}
+		if err := rewriteFile(file, out); err != nil {
+			return err
+		}
+		if rel, err = filepath.Rel(storeDir, file); err != nil {
+			return err
+		}
+		change.Path = filepath.ToSlash(rel)
+		report.Files = append(report.Files, change)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// WriteRewriteReport writes report as JSON to path.
+func WriteRewriteReport(path string, report *RewriteReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// isText reports whether data looks like a text file mentioning the store:
+// no NUL bytes in the first 8KiB, as git and grep decide.
+func isText(data []byte) bool {
+	head := data
+	if len(head) > 8192 {
+		head = head[:8192]
+	}
+	return bytes.IndexByte(head, 0) < 0 && bytes.Contains(data, []byte(nixStoreDir+"/"))
+}
+
+// rewriteText rewrites the shebang and the store paths of the text file
+// file (relative to the unpack root). It returns nil if nothing changed.
+func rewriteText(data []byte, file string, rw TextRewrite) ([]byte, RewrittenFile) {
+	var change RewrittenFile
+	var out []byte
+	body := data
+	shebang := ""
+
+	if bytes.HasPrefix(data, []byte("#!")) {
+		line, rest, _ := bytes.Cut(data, []byte("\n"))
+		shebang = strings.TrimSuffix(string(line), "\r")
+		if newShebang, ok := rewriteShebang(shebang, rw.Launcher); ok {
+			change.Shebang, change.NewShebang = shebang, newShebang
+			out = append(out, newShebang...)
+			if len(line) < len(data) {
+				out = append(out, '\n')
+			}
+			body = rest
+		}
+	}
+
+	if replacement := storePathReplacement(file, shebang, rw); replacement != "" {
+		prefix := []byte(nixStoreDir + "/")
+		change.Replacements = bytes.Count(body, prefix)
+		body = bytes.ReplaceAll(body, prefix, []byte(replacement))
+	}
+	if change.Shebang == "" && change.Replacements == 0 {
+		return nil, change
+	}
+	return append(out, body...), change
+}
+
+// storePathReplacement returns what replaces "/nix/store/" in file, whose
+// first line is shebang, or "" if its store paths are left alone.
+func storePathReplacement(file, shebang string, rw TextRewrite) string {
+	if rw.Placeholder != "" {
+		return rw.Placeholder + "/"
+	}
+	// From the file's directory back up to the unpack root
+	up := strings.Repeat("../", strings.Count(file, "/"))
+	switch {
+	case strings.HasSuffix(file, ".pc"):
+		return "${pcfiledir}/" + up
+	case isShellShebang(shebang):
+		return `$(dirname "$0")/` + up
+	}
+	return ""
+}
+
+// shells are the interpreters whose scripts can use $(dirname "$0").
+var shells = map[string]bool{"sh": true, "bash": true, "dash": true, "ksh": true, "mksh": true, "zsh": true}
+
+// isShellShebang reports whether shebang runs a POSIX shell, directly or
+// through env.
+func isShellShebang(shebang string) bool {
+	fields := strings.Fields(strings.TrimPrefix(shebang, "#!"))
+	if len(fields) == 0 || !strings.HasPrefix(shebang, "#!") {
+		return false
+	}
+	interp := path.Base(fields[0])
+	if interp == "env" {
+		for _, arg := range fields[1:] {
+			if !strings.HasPrefix(arg, "-") {
+				return shells[path.Base(arg)]
+			}
+		}
+		return false
+	}
+	return shells[interp]
+}
+
+// rewriteShebang replaces a /nix/store interpreter with launcher. An
+// interpreter that is itself env keeps its arguments as is.
+func rewriteShebang(shebang, launcher string) (string, bool) {
+	if launcher == "" {
+		launcher = "/usr/bin/env"
+	}
+	fields := strings.Fields(strings.TrimPrefix(shebang, "#!"))
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], nixStoreDir+"/") {
+		return "", false
+	}
+	interp, args := path.Base(fields[0]), fields[1:]
+	if interp == "env" {
+		return "#!" + strings.Join(append([]string{launcher}, args...), " "), true
+	}
+	words := []string{launcher}
+	// Linux passes everything after the interpreter as a single argument,
+	// so env needs -S to split it
+	if len(args) > 0 && path.Base(launcher) == "env" {
+		words = append(words, "-S")
+	}
+	words = append(words, interp)
+	words = append(words, args...)
+	return "#!" + strings.Join(words, " "), true
+}
@@ -0,0 +1,83 @@
+package nixbazel
+
+import (
+	"testing"
+)
+
+func TestRewriteShebang(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"#!/nix/store/abc-bash-5.2/bin/bash", "#!/usr/bin/env bash"},
+		{"#!/nix/store/abc-bash-5.2/bin/bash -e", "#!/usr/bin/env -S bash -e"},
+		{"#! /nix/store/abc-coreutils/bin/env python3", "#!/usr/bin/env python3"},
+		{"#!/bin/sh", ""},
+	}
+
+	for _, test := range tests {
+		result, _ := rewriteShebang(test.input, "")
+		if result != test.expected {
+			t.Errorf("rewriteShebang(%q) = %q, expected %q", test.input, result, test.expected)
+		}
+	}
+}
+
+func TestRewriteText(t *testing.T) {
+	tests := []struct {
+		file     string
+		input    string
+		rw       TextRewrite
+		expected string // Empty if unchanged
+	}{
+		// Shell scripts resolve store paths against their own directory,
+		// wherever they are run from
+		{
+			"def-hello/bin/hello-wrapper",
+			"#!/nix/store/abc-bash/bin/bash\nexec /nix/store/def-hello/bin/hello \"$@\"\n",
+			TextRewrite{},
+			"#!/usr/bin/env bash\nexec $(dirname \"$0\")/../../def-hello/bin/hello \"$@\"\n",
+		},
+		{
+			"def-hello/run",
+			"#!/usr/bin/env sh\n/nix/store/def-hello/bin/hello\n",
+			TextRewrite{},
+			"#!/usr/bin/env sh\n$(dirname \"$0\")/../def-hello/bin/hello\n",
+		},
+		// pkg-config resolves ${pcfiledir} to the directory of the .pc file
+		{
+			"def-zlib/lib/pkgconfig/zlib.pc",
+			"prefix=/nix/store/def-zlib\n",
+			TextRewrite{},
+			"prefix=${pcfiledir}/../../../def-zlib\n",
+		},
+		{
+			"def-zlib/lib/pkgconfig/zlib.pc",
+			"prefix=/nix/store/def-zlib\n",
+			TextRewrite{Placeholder: "@NIX_STORE@"},
+			"prefix=@NIX_STORE@/def-zlib\n",
+		},
+		// Other files would resolve a relative path against the current
+		// directory, so only their shebang changes
+		{
+			"def-py/bin/tool",
+			"#!/nix/store/abc-python3/bin/python3\nsys.path.insert(0, '/nix/store/def-py/lib')\n",
+			TextRewrite{},
+			"#!/usr/bin/env python3\nsys.path.insert(0, '/nix/store/def-py/lib')\n",
+		},
+		{"def-zlib/lib/libz.la", "libdir='/nix/store/def-zlib/lib'\n", TextRewrite{}, ""},
+		{"x/bin/hi", "#!/bin/sh\necho hi\n", TextRewrite{}, ""},
+	}
+
+	for _, test := range tests {
+		out, _ := rewriteText([]byte(test.input), test.file, test.rw)
+		if string(out) != test.expected {
+			t.Errorf("rewriteText(%q, %q) = %q, expected %q", test.file, test.input, out, test.expected)
+		}
+	}
+
+	_, change := rewriteText([]byte("#!/nix/store/abc-bash/bin/bash\nexec /nix/store/def-hello/bin/hello\n"), "def-hello/bin/w", TextRewrite{})
+	if change.Shebang != "#!/nix/store/abc-bash/bin/bash" || change.Replacements != 1 {
+		t.Errorf("change = %+v", change)
+	}
+}
@@ -0,0 +1,282 @@
+package nixbazel
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// toolchainKinds are the values accepted for a repository's toolchain field.
+var toolchainKinds = map[string]bool{
+	"cc":     true,
+	"python": true,
+	"go":     true,
+	"nodejs": true,
+}
+
+// defaultToolchainEntrypoints is used when a toolchain repository has no
+// entrypoint.
+var defaultToolchainEntrypoints = map[string]string{
+	"python": "bin/python3",
+	"go":     "bin/go",
+	"nodejs": "bin/node",
+}
+
+// platformConstraints maps a Nix system to @platforms constraint labels.
+func platformConstraints(system string) []string {
+	cpu, kernel, ok := strings.Cut(system, "-")
+	if !ok {
+		return nil
+	}
+	var constraints []string
+	switch kernel {
+	case "linux":
+		constraints = append(constraints, "@platforms//os:linux")
+	case "darwin":
+		constraints = append(constraints, "@platforms//os:macos")
+	}
+	switch cpu {
+	case "x86_64":
+		constraints = append(constraints, "@platforms//cpu:x86_64")
+	case "aarch64":
+		constraints = append(constraints, "@platforms//cpu:aarch64")
+	case "i686":
+		constraints = append(constraints, "@platforms//cpu:x86_32")
+	}
+	return constraints
+}
+
+// toolWrapperScript runs a binary from the Nix closure of a package inside
+// bwrap, with the package's nix_root tree mounted at /nix/store. cc tool
+// paths must be plain files, so unlike nix_bwrap_run the tree is not found
+// through runfiles: nix_cc_toolchain_config passes its execroot-relative
+// path in NIX_ROOT.
+const toolWrapperScript = `#!/bin/bash
+set -e
+ROOT="${NIX_ROOT:-}"
+if [ -z "$ROOT" ] || [ ! -d "$ROOT" ]; then
+  echo "Error: NIX_ROOT does not point to the Nix root for %[1]s" >&2
+  exit 1
+fi
+
+exec bwrap \
+  --ro-bind / / \
+  --dev /dev \
+  --proc /proc \
+  --bind /tmp /tmp \
+  --bind "$PWD" "$PWD" \
+  --tmpfs /nix \
+  --dir /nix/store \
+  --ro-bind "$ROOT" /nix/store \
+  --chdir "$PWD" \
+  "%[2]s" "$@"
+`
+
+// findInClosure returns the first package in the closure of root whose name
+// matches one of names, in order of preference.
+func findInClosure(root string, packages map[string]ClosureNode, names ...string) string {
+	closure := append([]string{root}, getTransitiveClosure(root, packages)...)
+	sort.Strings(closure[1:])
+	for _, name := range names {
+		for _, storePath := range closure {
+			if pname, _ := parseStoreName(storePath); pname == name {
+				return storePath
+			}
+		}
+	}
+	return ""
+}
+
+// generateToolchains writes the toolchains/ package declaring a toolchain for
+// every repository with a toolchain kind. Users register them with
+// register_toolchains("@nix_deps//toolchains:all").
+func (f *Fetcher) generateToolchains(lock Lockfile) error {
+	var names []string
+	for name, repo := range lock.Repositories {
+		if repo.Toolchain != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+
+	dir := filepath.Join(f.outDir, "toolchains")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	buildFilePath := filepath.Join(dir, "BUILD.bazel")
+	fmt.Fprintf(f.progress, "Generating %s...\n", buildFilePath)
+	file, err := os.Create(buildFilePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fmt.Fprintf(file, "load(\"@bazel_tools//tools/python:toolchain.bzl\", \"py_runtime_pair\")\n")
+	fmt.Fprintf(file, "load(\"@nix_deps//:nix_bwrap.bzl\", \"nix_bwrap_run\")\n")
+	fmt.Fprintf(file, "load(\"@nix_deps//:nix_toolchain.bzl\", \"nix_cc_toolchain_config\", \"nix_go\", \"nix_nodejs\", \"nix_tool_toolchain\")\n\n")
+	fmt.Fprintf(file, "package(default_visibility = [\"//visibility:public\"])\n\n")
+
+	// Bazel has no toolchain types for go and nodejs binaries, so these are
+	// ours; nix_go and nix_nodejs resolve them (@nix_deps//toolchains:go)
+	for _, kind := range []string{"go", "nodejs"} {
+		if slices.ContainsFunc(names, func(name string) bool { return lock.Repositories[name].Toolchain == kind }) {
+			fmt.Fprintf(file, "toolchain_type(name = \"%s_toolchain_type\")\n\n", kind)
+			fmt.Fprintf(file, "nix_%s(name = \"%s\")\n\n", kind, kind)
+		}
+	}
+
+	for _, name := range names {
+		repo := lock.Repositories[name]
+		storeName := path.Base(repo.StorePath)
+		constraints := platformConstraints(repo.System)
+
+		var toolchain, toolchainType string
+		switch repo.Toolchain {
+		case "cc":
+			if err := writeCcToolchain(file, f.progress, dir, name, repo, lock.Packages); err != nil {
+				return err
+			}
+			toolchain = name + "_cc_toolchain"
+			toolchainType = "@bazel_tools//tools/cpp:toolchain_type"
+		case "python":
+			writeInterpreter(file, name, storeName, repo)
+			fmt.Fprintf(file, "py_runtime(\n")
+			fmt.Fprintf(file, "    name = \"%s_py3_runtime\",\n", name)
+			fmt.Fprintf(file, "    interpreter = \":%s_interpreter\",\n", name)
+			fmt.Fprintf(file, "    files = [\"//%s:root\"],\n", storeName)
+			fmt.Fprintf(file, "    python_version = \"PY3\",\n")
+			fmt.Fprintf(file, ")\n\n")
+			fmt.Fprintf(file, "py_runtime_pair(\n")
+			fmt.Fprintf(file, "    name = \"%s_py_runtime_pair\",\n", name)
+			fmt.Fprintf(file, "    py3_runtime = \":%s_py3_runtime\",\n", name)
+			fmt.Fprintf(file, ")\n\n")
+			toolchain = name + "_py_runtime_pair"
+			toolchainType = "@bazel_tools//tools/python:toolchain_type"
+		case "go", "nodejs":
+			writeInterpreter(file, name, storeName, repo)
+			fmt.Fprintf(file, "nix_tool_toolchain(\n")
+			fmt.Fprintf(file, "    name = \"%s_tool\",\n", name)
+			fmt.Fprintf(file, "    tool = \":%s_interpreter\",\n", name)
+			fmt.Fprintf(file, "    root = \"//%s:root\",\n", storeName)
+			fmt.Fprintf(file, ")\n\n")
+			toolchain = name + "_tool"
+			toolchainType = ":" + repo.Toolchain + "_toolchain_type"
+		default:
+			return fmt.Errorf("repository %s: unknown toolchain kind %q", name, repo.Toolchain)
+		}
+
+		fmt.Fprintf(file, "toolchain(\n")
+		fmt.Fprintf(file, "    name = \"%s_toolchain\",\n", name)
+		if len(constraints) > 0 {
+			fmt.Fprintf(file, "    exec_compatible_with = %s,\n", starlarkList(constraints))
+			fmt.Fprintf(file, "    target_compatible_with = %s,\n", starlarkList(constraints))
+		}
+		fmt.Fprintf(file, "    toolchain = \":%s\",\n", toolchain)
+		fmt.Fprintf(file, "    toolchain_type = \"%s\",\n", toolchainType)
+		fmt.Fprintf(file, ")\n\n")
+	}
+	return nil
+}
+
+// writeInterpreter emits a nix_bwrap_run target for the repository's main
+// binary.
+func writeInterpreter(file *os.File, name, storeName string, repo RepositoryLock) {
+	binPath := repo.Entrypoint
+	if binPath == "" {
+		binPath = defaultToolchainEntrypoints[repo.Toolchain]
+	}
+	fmt.Fprintf(file, "nix_bwrap_run(\n")
+	fmt.Fprintf(file, "    name = \"%s_interpreter\",\n", name)
+	fmt.Fprintf(file, "    root = \"//%s:root\",\n", storeName)
+	fmt.Fprintf(file, "    entrypoint = \"//%s:%s\",\n", storeName, storeName)
+	fmt.Fprintf(file, "    bin_path = \"%s\",\n", binPath)
+	fmt.Fprintf(file, ")\n\n")
+}
+
+// writeCcToolchain emits a cc_toolchain for a compiler wrapper package (gcc
+// or clang). The binutils are taken from the compiler's closure.
+func writeCcToolchain(file *os.File, progress io.Writer, dir, name string, repo RepositoryLock, packages map[string]ClosureNode) error {
+	storeName := path.Base(repo.StorePath)
+	pname, _ := parseStoreName(repo.StorePath)
+
+	compiler := "gcc"
+	linkFlags := []string{"-lstdc++", "-lm"}
+	if strings.HasPrefix(pname, "clang") {
+		compiler = "clang"
+	}
+	cc := repo.Entrypoint
+	if cc == "" {
+		cc = "bin/cc"
+	}
+
+	binutils := findInClosure(repo.StorePath, packages, "binutils-wrapper", "binutils")
+	if binutils == "" {
+		fmt.Fprintf(progress, "Warning: no binutils found in the closure of %s, using the compiler package\n", repo.StorePath)
+		binutils = repo.StorePath
+	}
+
+	tools := map[string]string{
+		"gcc":     path.Join(repo.StorePath, cc),
+		"cpp":     path.Join(repo.StorePath, "bin/cpp"),
+		"gcov":    path.Join(repo.StorePath, "bin/gcov"),
+		"ar":      path.Join(binutils, "bin/ar"),
+		"ld":      path.Join(binutils, "bin/ld"),
+		"nm":      path.Join(binutils, "bin/nm"),
+		"objdump": path.Join(binutils, "bin/objdump"),
+		"strip":   path.Join(binutils, "bin/strip"),
+	}
+	toolNames := make([]string, 0, len(tools))
+	for tool := range tools {
+		toolNames = append(toolNames, tool)
+	}
+	sort.Strings(toolNames)
+
+	wrapperDir := filepath.Join(dir, name)
+	if err := os.MkdirAll(wrapperDir, 0755); err != nil {
+		return err
+	}
+	for _, tool := range toolNames {
+		script := fmt.Sprintf(toolWrapperScript, storeName, tools[tool])
+		if err := os.WriteFile(filepath.Join(wrapperDir, tool), []byte(script), 0755); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(file, "filegroup(\n")
+	fmt.Fprintf(file, "    name = \"%s_cc_files\",\n", name)
+	fmt.Fprintf(file, "    srcs = glob([\"%s/**\"]) + [\"//%s:root\"],\n", name, storeName)
+	fmt.Fprintf(file, ")\n\n")
+
+	fmt.Fprintf(file, "nix_cc_toolchain_config(\n")
+	fmt.Fprintf(file, "    name = \"%s_cc_toolchain_config\",\n", name)
+	fmt.Fprintf(file, "    compiler = \"%s\",\n", compiler)
+	if cpu, _, ok := strings.Cut(repo.System, "-"); ok {
+		fmt.Fprintf(file, "    cpu = \"%s\",\n", cpu)
+	}
+	fmt.Fprintf(file, "    link_flags = %s,\n", starlarkList(linkFlags))
+	fmt.Fprintf(file, "    root = \"//%s:root\",\n", storeName)
+	fmt.Fprintf(file, "    tool_paths = {\n")
+	for _, tool := range toolNames {
+		fmt.Fprintf(file, "        \"%s\": \"%s/%s\",\n", tool, name, tool)
+	}
+	fmt.Fprintf(file, "    },\n")
+	fmt.Fprintf(file, "    toolchain_identifier = \"nix_%s\",\n", name)
+	fmt.Fprintf(file, ")\n\n")
+
+	fmt.Fprintf(file, "cc_toolchain(\n")
+	fmt.Fprintf(file, "    name = \"%s_cc_toolchain\",\n", name)
+	for _, attr := range []string{"all_files", "ar_files", "as_files", "compiler_files", "dwp_files", "linker_files", "objcopy_files", "strip_files"} {
+		fmt.Fprintf(file, "    %s = \":%s_cc_files\",\n", attr, name)
+	}
+	fmt.Fprintf(file, "    toolchain_config = \":%s_cc_toolchain_config\",\n", name)
+	fmt.Fprintf(file, ")\n\n")
+	return nil
+}
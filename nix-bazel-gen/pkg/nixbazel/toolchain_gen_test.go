@@ -0,0 +1,197 @@
+package nixbazel
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPackageSystem(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"nixpkgs.gcc.x86_64-linux", "x86_64-linux"},
+		{"nixpkgs.python3.aarch64-darwin", "aarch64-darwin"},
+		{"nixos.tests.x86_64-linux-gnu", ""},
+		{"nixpkgs.hello", ""},
+		{"/nix/store/0a0mn0ljd2r5ygi8w5jdd9g7hdnkvbs8-hello-2.12", ""},
+	}
+
+	for _, test := range tests {
+		if result := packageSystem(test.input); result != test.expected {
+			t.Errorf("packageSystem(%q) = %q, expected %q", test.input, result, test.expected)
+		}
+	}
+}
+
+func TestGenerateToolchains(t *testing.T) {
+	const (
+		python = "/nix/store/0a0mn0ljd2r5ygi8w5jdd9g7hdnkvbs8-python3-3.12.8"
+		goPath = "/nix/store/1b1mn0ljd2r5ygi8w5jdd9g7hdnkvbs8-go-1.23.4"
+	)
+	lock := Lockfile{
+		Repositories: map[string]RepositoryLock{
+			"python3": {StorePath: python, Toolchain: "python", System: "x86_64-linux"},
+			"go":      {StorePath: goPath, Toolchain: "go", Entrypoint: "share/go/bin/go"},
+			"hello":   {StorePath: testHelloPath},
+		},
+	}
+	dir := t.TempDir()
+	if err := NewFetcher("", dir).generateToolchains(lock); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "toolchains", "BUILD.bazel"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `load("@bazel_tools//tools/python:toolchain.bzl", "py_runtime_pair")
+load("@nix_deps//:nix_bwrap.bzl", "nix_bwrap_run")
+load("@nix_deps//:nix_toolchain.bzl", "nix_cc_toolchain_config", "nix_go", "nix_nodejs", "nix_tool_toolchain")
+
+package(default_visibility = ["//visibility:public"])
+
+toolchain_type(name = "go_toolchain_type")
+
+nix_go(name = "go")
+
+nix_bwrap_run(
+    name = "go_interpreter",
+    root = "//1b1mn0ljd2r5ygi8w5jdd9g7hdnkvbs8-go-1.23.4:root",
+    entrypoint = "//1b1mn0ljd2r5ygi8w5jdd9g7hdnkvbs8-go-1.23.4:1b1mn0ljd2r5ygi8w5jdd9g7hdnkvbs8-go-1.23.4",
+    bin_path = "share/go/bin/go",
+)
+
+nix_tool_toolchain(
+    name = "go_tool",
+    tool = ":go_interpreter",
+    root = "//1b1mn0ljd2r5ygi8w5jdd9g7hdnkvbs8-go-1.23.4:root",
+)
+
+toolchain(
+    name = "go_toolchain",
+    toolchain = ":go_tool",
+    toolchain_type = ":go_toolchain_type",
+)
+
+nix_bwrap_run(
+    name = "python3_interpreter",
+    root = "//0a0mn0ljd2r5ygi8w5jdd9g7hdnkvbs8-python3-3.12.8:root",
+    entrypoint = "//0a0mn0ljd2r5ygi8w5jdd9g7hdnkvbs8-python3-3.12.8:0a0mn0ljd2r5ygi8w5jdd9g7hdnkvbs8-python3-3.12.8",
+    bin_path = "bin/python3",
+)
+
+py_runtime(
+    name = "python3_py3_runtime",
+    interpreter = ":python3_interpreter",
+    files = ["//0a0mn0ljd2r5ygi8w5jdd9g7hdnkvbs8-python3-3.12.8:root"],
+    python_version = "PY3",
+)
+
+py_runtime_pair(
+    name = "python3_py_runtime_pair",
+    py3_runtime = ":python3_py3_runtime",
+)
+
+toolchain(
+    name = "python3_toolchain",
+    exec_compatible_with = ["@platforms//os:linux", "@platforms//cpu:x86_64"],
+    target_compatible_with = ["@platforms//os:linux", "@platforms//cpu:x86_64"],
+    toolchain = ":python3_py_runtime_pair",
+    toolchain_type = "@bazel_tools//tools/python:toolchain_type",
+)
+
+`
+	if string(got) != expected {
+		t.Errorf("generateToolchains() wrote:\n%s\nexpected:\n%s", got, expected)
+	}
+}
+
+func TestWriteCcToolchain(t *testing.T) {
+	const (
+		gcc      = "/nix/store/2c2mn0ljd2r5ygi8w5jdd9g7hdnkvbs8-gcc-wrapper-14.3.0"
+		binutils = "/nix/store/3d3mn0ljd2r5ygi8w5jdd9g7hdnkvbs8-binutils-wrapper-2.44"
+	)
+	packages := map[string]ClosureNode{
+		gcc:      {References: []string{filepath.Base(binutils)}},
+		binutils: {References: []string{}},
+	}
+	repo := RepositoryLock{StorePath: gcc, Toolchain: "cc", System: "x86_64-linux"}
+
+	dir := t.TempDir()
+	file, err := os.Create(filepath.Join(dir, "BUILD.bazel"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeCcToolchain(file, io.Discard, dir, "gcc", repo, packages); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	got, err := os.ReadFile(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `filegroup(
+    name = "gcc_cc_files",
+    srcs = glob(["gcc/**"]) + ["//2c2mn0ljd2r5ygi8w5jdd9g7hdnkvbs8-gcc-wrapper-14.3.0:root"],
+)
+
+nix_cc_toolchain_config(
+    name = "gcc_cc_toolchain_config",
+    compiler = "gcc",
+    cpu = "x86_64",
+    link_flags = ["-lstdc++", "-lm"],
+    root = "//2c2mn0ljd2r5ygi8w5jdd9g7hdnkvbs8-gcc-wrapper-14.3.0:root",
+    tool_paths = {
+        "ar": "gcc/ar",
+        "cpp": "gcc/cpp",
+        "gcc": "gcc/gcc",
+        "gcov": "gcc/gcov",
+        "ld": "gcc/ld",
+        "nm": "gcc/nm",
+        "objdump": "gcc/objdump",
+        "strip": "gcc/strip",
+    },
+    toolchain_identifier = "nix_gcc",
+)
+
+cc_toolchain(
+    name = "gcc_cc_toolchain",
+    all_files = ":gcc_cc_files",
+    ar_files = ":gcc_cc_files",
+    as_files = ":gcc_cc_files",
+    compiler_files = ":gcc_cc_files",
+    dwp_files = ":gcc_cc_files",
+    linker_files = ":gcc_cc_files",
+    objcopy_files = ":gcc_cc_files",
+    strip_files = ":gcc_cc_files",
+    toolchain_config = ":gcc_cc_toolchain_config",
+)
+
+`
+	if string(got) != expected {
+		t.Errorf("writeCcToolchain() wrote:\n%s\nexpected:\n%s", got, expected)
+	}
+
+	wrappers := map[string]string{
+		"gcc": gcc + "/bin/cc",
+		"ld":  binutils + "/bin/ld",
+	}
+	for tool, binary := range wrappers {
+		script, err := os.ReadFile(filepath.Join(dir, "gcc", tool))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(script), `"`+binary+`" "$@"`) {
+			t.Errorf("wrapper %s does not run %s:\n%s", tool, binary, script)
+		}
+		// The root comes from the toolchain config, not from bazel-out
+		if !strings.Contains(string(script), `ROOT="${NIX_ROOT:-}"`) || strings.Contains(string(script), "bazel-out") {
+			t.Errorf("wrapper %s does not take the root from NIX_ROOT:\n%s", tool, script)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package nixbazel
 
 const defaultCacheURL = "https://cache.nixos.org"
 
+const defaultHydraURL = "https://hydra.nixos.org"
+
 // Config represents nix_deps.yaml
 type Config struct {
 	Repositories map[string]RepositoryConfig `json:"repositories"`
@@ -10,6 +12,11 @@ type Config struct {
 type RepositoryConfig struct {
 	Package    string `json:"package"`
 	Entrypoint string `json:"entrypoint,omitempty"`
+	// Toolchain registers the package as a Bazel toolchain of this kind
+	// (see toolchainKinds).
+	Toolchain string `json:"toolchain,omitempty"`
+	// Files are paths inside the package to export as individual files.
+	Files []string `json:"files,omitempty"`
 }
 
 // Lockfile represents nix_deps.lock.json
@@ -19,19 +26,30 @@ type Lockfile struct {
 }
 
 type RepositoryLock struct {
-	StorePath  string `json:"storePath"`
-	Entrypoint string `json:"entrypoint,omitempty"`
+	StorePath  string   `json:"storePath"`
+	Entrypoint string   `json:"entrypoint,omitempty"`
+	Toolchain  string   `json:"toolchain,omitempty"`
+	Files      []string `json:"files,omitempty"`
+	// System is the Nix system (e.g. x86_64-linux) taken from the package
+	// identifier, if it names one.
+	System string `json:"system,omitempty"`
 }
 
 type ClosureNode struct {
-	URL        string   `json:"url"`
-	Hash       string   `json:"hash"`
-	Size       int64    `json:"size"`
-	NarHash    string   `json:"narHash"` // Hex encoded SHA256 of uncompressed NAR
-	NarSize    int64    `json:"narSize"`
-	FileHash   string   `json:"fileHash"` // Hex encoded SHA256 of compressed file
-	FileSize   int64    `json:"fileSize"`
-	References []string `json:"references"`
+	URL      string `json:"url"`
+	Hash     string `json:"hash"`
+	Size     int64  `json:"size"`
+	NarHash  string `json:"narHash"` // Hex encoded SHA256 or SHA512 of uncompressed NAR
+	NarSize  int64  `json:"narSize"`
+	FileHash string `json:"fileHash"` // Hex encoded SHA256 or SHA512 of compressed file
+	FileSize int64  `json:"fileSize"`
+	// FileIntegrity is FileHash as SRI, set by WriteLockfile when it is not
+	// sha256.
+	FileIntegrity string   `json:"fileIntegrity,omitempty"`
+	References    []string `json:"references"`
+	// LocalOnly marks paths taken from a local Nix database that no
+	// substituter has, so they cannot be downloaded.
+	LocalOnly bool `json:"localOnly,omitempty"`
 }
 
 type NarInfo struct {
@@ -0,0 +1,347 @@
+package nixbazel
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UnpackRequest is one NAR archive to unpack into a root.
+type UnpackRequest struct {
+	Archive   string `json:"archive"`
+	StorePath string `json:"storePath"`
+	// NarHash (hex), checked against local store paths. Optional.
+	NarHash string `json:"narHash,omitempty"`
+	// References are the direct references of StorePath, as store paths or
+	// names. When set, relocation adds the lib directories of its closure
+	// within the requests instead of the fetcher's global references.
+	References []string `json:"references,omitempty"`
+
+	closure []string
+}
+
+// LoadUnpackRequests reads a JSON array of unpack requests.
+func LoadUnpackRequests(path string) ([]UnpackRequest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var requests []UnpackRequest
+	if err := json.Unmarshal(data, &requests); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	for i, req := range requests {
+		if req.Archive == "" || req.StorePath == "" {
+			return nil, fmt.Errorf("%s: entry %d needs both archive and storePath", path, i)
+		}
+	}
+	return requests, nil
+}
+
+// UnpackAll unpacks every request into f.outDir, running up to jobs unpacks
+// in parallel, and returns the first error encountered.
+func (f *Fetcher) UnpackAll(requests []UnpackRequest, jobs int) error {
+	if jobs < 1 {
+		jobs = 1
+	}
+	if err := os.MkdirAll(f.outDir, 0755); err != nil {
+		return err
+	}
+
+	if f.relocation != nil {
+		requests = withClosures(requests)
+	}
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	sem := make(chan struct{}, jobs)
+	for _, req := range requests {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(req UnpackRequest) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := f.unpack(req); err != nil {
+				once.Do(func() { firstErr = fmt.Errorf("failed to unpack %s: %w", req.StorePath, err) })
+			}
+		}(req)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	if f.dedup {
+		storePaths := make([]string, 0, len(requests))
+		for _, req := range requests {
+			storePaths = append(storePaths, req.StorePath)
+		}
+		return f.dedupStorePaths(storePaths)
+	}
+	return nil
+}
+
+// withClosures returns a copy of requests with the transitive references of
+// every request that lists its own references, following the references of
+// the other requests. Store paths outside the requests end the walk.
+func withClosures(requests []UnpackRequest) []UnpackRequest {
+	refs := make(map[string][]string, len(requests))
+	for _, req := range requests {
+		if req.References != nil {
+			refs[req.StorePath] = req.References
+		}
+	}
+	result := make([]UnpackRequest, len(requests))
+	for i, req := range requests {
+		result[i] = req
+		if req.References == nil {
+			continue
+		}
+		seen := map[string]bool{req.StorePath: true}
+		closure := []string{}
+		queue := []string{req.StorePath}
+		for len(queue) > 0 {
+			current := queue[0]
+			queue = queue[1:]
+			for _, ref := range refs[current] {
+				if !strings.HasPrefix(ref, "/") {
+					ref = nixStoreDir + "/" + ref
+				}
+				if seen[ref] {
+					continue
+				}
+				seen[ref] = true
+				closure = append(closure, ref)
+				queue = append(queue, ref)
+			}
+		}
+		sort.Strings(closure)
+		result[i].closure = closure
+	}
+	return result
+}
+
+// RewriteStoreSymlinks makes every symlink below root that points into
+// /nix/store relative, assuming store paths are unpacked as children of root.
+// It returns the number of symlinks rewritten.
+func RewriteStoreSymlinks(root string) (int, error) {
+	rewritten := 0
+	err := filepath.WalkDir(root, func(link string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type()&fs.ModeSymlink == 0 {
+			return nil
+		}
+		target, err := os.Readlink(link)
+		if err != nil {
+			return err
+		}
+		newTarget, ok, err := relativeStoreTarget(root, link, target)
+		if err != nil || !ok {
+			return err
+		}
+		err = withWritableDir(filepath.Dir(link), func() error {
+			if err := os.Remove(link); err != nil {
+				return err
+			}
+			return os.Symlink(newTarget, link)
+		})
+		if err != nil {
+			return err
+		}
+		rewritten++
+		return nil
+	})
+	return rewritten, err
+}
+
+// relativeStoreTarget maps an absolute /nix/store symlink target of link to
+// the equivalent path relative to the link's directory inside root.
+func relativeStoreTarget(root, link, target string) (string, bool, error) {
+	clean := filepath.Clean(target)
+	rest, ok := strings.CutPrefix(clean, nixStoreDir+"/")
+	if !ok {
+		return "", false, nil
+	}
+	if filepath.Join(root, rest) == filepath.Clean(link) {
+		// A store path linked from a local store, which must stay absolute
+		return "", false, nil
+	}
+	newTarget, err := filepath.Rel(filepath.Dir(link), filepath.Join(root, rest))
+	if err != nil {
+		return "", false, err
+	}
+	return newTarget, true, nil
+}
+
+// validateNarPath rejects NAR entry paths that could escape the directory
+// they are unpacked into: absolute paths, "." or ".." components, empty
+// components and backslashes.
+func validateNarPath(p string) error {
+	if p == "" {
+		return nil
+	}
+	if strings.ContainsAny(p, "\x00\\") {
+		return fmt.Errorf("nar: invalid entry path %q", p)
+	}
+	for _, elem := range strings.Split(p, "/") {
+		if elem == "" || elem == "." || elem == ".." {
+			return fmt.Errorf("nar: invalid entry path %q", p)
+		}
+	}
+	return nil
+}
+
+// narParent returns the parent of a NAR entry path ("" for the root's
+// children).
+func narParent(p string) string {
+	if i := strings.LastIndexByte(p, '/'); i >= 0 {
+		return p[:i]
+	}
+	return ""
+}
+
+// narPathLess reports whether a sorts before b in NAR order: a depth-first
+// walk with directory entries sorted by name. Comparing component by
+// component keeps "a/b" before "a.b" even though '/' > '.'.
+func narPathLess(a, b string) bool {
+	if a == "" {
+		return b != ""
+	}
+	if b == "" {
+		return false
+	}
+	ae, be := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(ae) && i < len(be); i++ {
+		if ae[i] != be[i] {
+			return ae[i] < be[i]
+		}
+	}
+	return len(ae) < len(be)
+}
+
+// removeForUnpack prepares the path of the NAR entry rel below destDir. The
+// parent of every entry but the root must be a real directory, not a
+// symlink; parents are validated in turn as the NAR creates them. An
+// existing entry is removed unless both it and the new entry are directories.
+func removeForUnpack(destDir, rel string, isDir bool) (string, error) {
+	path := filepath.Join(destDir, filepath.FromSlash(rel))
+	if rel != "" {
+		info, err := os.Lstat(filepath.Dir(path))
+		if err != nil {
+			return "", err
+		}
+		if !info.IsDir() {
+			return "", fmt.Errorf("refusing to unpack %s: parent is not a directory", path)
+		}
+	}
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return path, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if isDir && info.IsDir() {
+		return path, nil
+	}
+	return path, os.Remove(path)
+}
+
+// canonicalMtime is the modification time of every file in the Nix store.
+var canonicalMtime = time.Unix(1, 0)
+
+// SetCanonical makes Unpack normalise unpacked trees like the Nix store:
+// files 0444 (0555 if executable), directories 0555 and mtime 1, so the same
+// NAR yields an identical tree on every machine.
+func (f *Fetcher) SetCanonical(canonical bool) {
+	f.canonical = canonical
+}
+
+// fileMode returns the mode of an unpacked regular file.
+func fileMode(mode fs.FileMode, canonical bool) fs.FileMode {
+	executable := mode&0111 != 0
+	switch {
+	case canonical && executable:
+		return 0555
+	case canonical:
+		return 0444
+	case executable:
+		return 0755
+	default:
+		return 0644
+	}
+}
+
+// CanonicalizeTree applies the Nix store modes and mtimes to root. Symlinks
+// keep their own mtime, as the standard library cannot set it without
+// following them.
+func CanonicalizeTree(root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		var mode fs.FileMode
+		switch {
+		case d.IsDir():
+			mode = 0555
+		case d.Type().IsRegular():
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			mode = fileMode(info.Mode(), true)
+		default:
+			return nil
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+		return os.Chtimes(path, canonicalMtime, canonicalMtime)
+	})
+}
+
+// withWritableDir runs fn with dir temporarily writable if it is not, as in
+// a canonical tree, restoring its mode and mtime afterwards.
+func withWritableDir(dir string, fn func() error) error {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm()&0200 != 0 {
+		return fn()
+	}
+	if err := os.Chmod(dir, info.Mode().Perm()|0200); err != nil {
+		return err
+	}
+	fnErr := fn()
+	if err := os.Chmod(dir, info.Mode().Perm()); err != nil && fnErr == nil {
+		fnErr = err
+	}
+	if err := os.Chtimes(dir, info.ModTime(), info.ModTime()); err != nil && fnErr == nil {
+		fnErr = err
+	}
+	return fnErr
+}
+
+// removeTree is os.RemoveAll for trees that may have been made read-only by
+// CanonicalizeTree.
+func removeTree(root string) error {
+	if _, err := os.Lstat(root); os.IsNotExist(err) {
+		return nil
+	}
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			os.Chmod(path, 0755)
+		}
+		return nil
+	})
+	return os.RemoveAll(root)
+}
@@ -0,0 +1,283 @@
+package nixbazel
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ulikunitz/xz"
+)
+
+func TestRelativeStoreTarget(t *testing.T) {
+	tests := []struct {
+		link     string
+		target   string
+		expected string
+		ok       bool
+	}{
+		{"root/abc-hello/bin/hello", "/nix/store/def-glibc/lib/libc.so.6", "../../def-glibc/lib/libc.so.6", true},
+		{"root/abc-hello/lib", "/nix/store/def-glibc/lib/", "../def-glibc/lib", true},
+		{"root/abc-hello/bin/sh", "/nix/store/def-bash", "../../def-bash", true},
+		{"root/abc-hello/bin/sh", "bash", "", false},
+		{"root/abc-hello/etc", "/etc", "", false},
+		{"root/abc-hello/escape", "/nix/store/../etc/passwd", "", false},
+		{"root/abc-hello", "/nix/store/abc-hello", "", false},
+	}
+
+	for _, test := range tests {
+		result, ok, err := relativeStoreTarget("root", test.link, test.target)
+		if err != nil || ok != test.ok || result != test.expected {
+			t.Errorf("relativeStoreTarget(%q, %q) = %q, %v, %v, expected %q, %v", test.link, test.target, result, ok, err, test.expected, test.ok)
+		}
+	}
+}
+
+// writeTestArchive writes an xz-compressed NAR, as Unpack expects.
+func writeTestArchive(t *testing.T, dir, name string, entries []testNarEntry) string {
+	t.Helper()
+	var out bytes.Buffer
+	w, err := xz.NewWriter(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(buildTestNar(t, entries)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, out.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestUnpackAll(t *testing.T) {
+	dir := t.TempDir()
+	hello := writeTestArchive(t, dir, "hello.nar.xz", []testNarEntry{
+		{path: "", mode: fs.ModeDir},
+		{path: "bin", mode: fs.ModeDir},
+		{path: "bin/hello", mode: 0755, content: "#!/bin/sh\n"},
+		{path: "lib", mode: fs.ModeSymlink, target: "/nix/store/def-glibc/lib"},
+	})
+	glibc := writeTestArchive(t, dir, "glibc.nar.xz", []testNarEntry{
+		{path: "", mode: fs.ModeDir},
+		{path: "lib", mode: fs.ModeDir},
+		{path: "lib/libc.so.6", mode: 0644, content: "libc"},
+	})
+
+	root := filepath.Join(dir, "root")
+	f := NewFetcher("", root)
+	err := f.UnpackAll([]UnpackRequest{
+		{Archive: hello, StorePath: "/nix/store/abc-hello"},
+		{Archive: glibc, StorePath: "/nix/store/def-glibc"},
+	}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := RewriteStoreSymlinks(root); err != nil || n != 1 {
+		t.Fatalf("RewriteStoreSymlinks = %d, %v, expected 1 symlink", n, err)
+	}
+	if target, _ := os.Readlink(filepath.Join(root, "abc-hello/lib")); target != "../def-glibc/lib" {
+		t.Errorf("lib -> %q, expected ../def-glibc/lib", target)
+	}
+	if data, err := os.ReadFile(filepath.Join(root, "abc-hello/lib/libc.so.6")); err != nil || string(data) != "libc" {
+		t.Errorf("libc.so.6 through symlink = %q, %v", data, err)
+	}
+}
+
+// Bazel runs nix_root and nix_extract actions without PATH, so unpacking
+// must not need an xz binary.
+func TestUnpackWithoutPath(t *testing.T) {
+	dir := t.TempDir()
+	hello := writeTestArchive(t, dir, "hello.nar.xz", []testNarEntry{
+		{path: "", mode: fs.ModeDir},
+		{path: "bin", mode: fs.ModeDir},
+		{path: "bin/hello", mode: 0755, content: "#!/bin/sh\n"},
+	})
+	t.Setenv("PATH", "")
+
+	root := filepath.Join(dir, "root")
+	f := NewFetcher("", root)
+	if err := f.UnpackAll([]UnpackRequest{{Archive: hello, StorePath: "/nix/store/abc-hello"}}, 1); err != nil {
+		t.Fatalf("UnpackAll without PATH: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(root, "abc-hello/bin/hello")); err != nil || string(data) != "#!/bin/sh\n" {
+		t.Errorf("bin/hello = %q, %v", data, err)
+	}
+}
+
+func TestWithClosures(t *testing.T) {
+	requests := []UnpackRequest{
+		{StorePath: "/nix/store/abc-hello", References: []string{"abc-hello", "def-libidn"}},
+		{StorePath: "/nix/store/def-libidn", References: []string{"/nix/store/ghi-glibc"}},
+		{StorePath: "/nix/store/ghi-glibc", References: []string{}},
+		{StorePath: "/nix/store/jkl-unrelated", References: []string{"ghi-glibc"}},
+		{StorePath: "/nix/store/mno-unknown"},
+	}
+	expected := map[string][]string{
+		"/nix/store/abc-hello":     {"/nix/store/def-libidn", "/nix/store/ghi-glibc"},
+		"/nix/store/def-libidn":    {"/nix/store/ghi-glibc"},
+		"/nix/store/ghi-glibc":     {},
+		"/nix/store/jkl-unrelated": {"/nix/store/ghi-glibc"},
+		"/nix/store/mno-unknown":   nil,
+	}
+
+	for _, req := range withClosures(requests) {
+		if !reflect.DeepEqual(req.closure, expected[req.StorePath]) {
+			t.Errorf("withClosures closure of %q = %q, expected %q", req.StorePath, req.closure, expected[req.StorePath])
+		}
+	}
+}
+
+func TestNarPathLess(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected bool
+	}{
+		{"", "bin", true},
+		{"bin", "", false},
+		{"a/b", "a.b", true},
+		{"a.b", "a/b", false},
+		{"bin", "bin/hello", true},
+		{"bin/hello", "lib", true},
+		{"lib", "lib", false},
+	}
+
+	for _, test := range tests {
+		if result := narPathLess(test.a, test.b); result != test.expected {
+			t.Errorf("narPathLess(%q, %q) = %v, expected %v", test.a, test.b, result, test.expected)
+		}
+	}
+}
+
+func TestValidateNarPath(t *testing.T) {
+	for _, p := range []string{"", "bin", "bin/hello", "lib/.hidden"} {
+		if err := validateNarPath(p); err != nil {
+			t.Errorf("validateNarPath(%q) = %v, expected nil", p, err)
+		}
+	}
+	for _, p := range []string{"/etc/passwd", "..", "bin/../..", "a//b", "./a", "a\\b"} {
+		if err := validateNarPath(p); err == nil {
+			t.Errorf("validateNarPath(%q) = nil, expected an error", p)
+		}
+	}
+}
+
+// unpackIntoTrap unpacks data into out, where "lib" is a pre-existing
+// symlink to an outside directory, and fails if anything was written there.
+func unpackIntoTrap(t *testing.T, data []byte) error {
+	t.Helper()
+	dir := t.TempDir()
+	outside := filepath.Join(dir, "outside")
+	out := filepath.Join(dir, "out")
+	for _, d := range []string{outside, out} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(out, "lib")); err != nil {
+		t.Fatal(err)
+	}
+
+	err := NewFetcher("", out).unpackNar(bytes.NewReader(data), out)
+
+	entries, readErr := os.ReadDir(outside)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("unpack wrote %d entries outside the output directory", len(entries))
+	}
+	return err
+}
+
+func TestUnpackNarDoesNotFollowSymlinks(t *testing.T) {
+	data := buildTestNar(t, []testNarEntry{
+		{path: "", mode: fs.ModeDir},
+		{path: "lib", mode: fs.ModeDir},
+		{path: "lib/evil", mode: 0644, content: "x"},
+	})
+	if err := unpackIntoTrap(t, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func FuzzUnpackNar(f *testing.F) {
+	f.Add(buildTestNar(f, []testNarEntry{
+		{path: "", mode: fs.ModeDir},
+		{path: "bin", mode: fs.ModeDir},
+		{path: "bin/hello", mode: 0755, content: "#!/bin/sh\n"},
+		{path: "lib", mode: fs.ModeSymlink, target: "../outside"},
+	}))
+	f.Add(buildTestNar(f, []testNarEntry{
+		{path: "", mode: fs.ModeDir},
+		{path: "lib", mode: fs.ModeDir},
+		{path: "lib/libc.so", mode: 0644, content: "libc"},
+	}))
+	f.Add(buildTestNar(f, []testNarEntry{
+		{path: "", mode: 0644, content: "just a file"},
+	}))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Errors are expected for most inputs; only escapes are failures
+		unpackIntoTrap(t, data)
+	})
+}
+
+func TestCanonicalUnpack(t *testing.T) {
+	dir := t.TempDir()
+	archive := writeTestArchive(t, dir, "hello.nar.xz", []testNarEntry{
+		{path: "", mode: fs.ModeDir},
+		{path: "bin", mode: fs.ModeDir},
+		{path: "bin/hello", mode: 0755, content: "#!/bin/sh\n"},
+		{path: "lib", mode: fs.ModeSymlink, target: "/nix/store/def-glibc/lib"},
+		{path: "share", mode: fs.ModeDir},
+		{path: "share/doc", mode: 0644, content: "doc"},
+	})
+	root := filepath.Join(dir, "root")
+	t.Cleanup(func() {
+		// Let the test cleanup remove the read-only tree
+		filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err == nil && d.IsDir() {
+				os.Chmod(path, 0755)
+			}
+			return nil
+		})
+	})
+
+	f := NewFetcher("", root)
+	f.SetCanonical(true)
+	if err := f.Unpack(archive, "/nix/store/abc-hello"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RewriteStoreSymlinks(root); err != nil {
+		t.Fatalf("RewriteStoreSymlinks on a canonical tree: %v", err)
+	}
+
+	tests := []struct {
+		path string
+		mode fs.FileMode
+	}{
+		{"abc-hello", fs.ModeDir | 0555},
+		{"abc-hello/bin", fs.ModeDir | 0555},
+		{"abc-hello/bin/hello", 0555},
+		{"abc-hello/share/doc", 0444},
+	}
+	for _, test := range tests {
+		info, err := os.Lstat(filepath.Join(root, test.path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != test.mode {
+			t.Errorf("mode of %s = %v, expected %v", test.path, info.Mode(), test.mode)
+		}
+		if !info.ModTime().Equal(canonicalMtime) {
+			t.Errorf("mtime of %s = %v, expected %v", test.path, info.ModTime(), canonicalMtime)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package nixbazel
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/nix/nixbase32"
+)
+
+// storePathHashLen is the length of the nixbase32 hash part of a store path.
+const storePathHashLen = 32
+
+// UploadOptions describes a directory to publish as a new store path.
+type UploadOptions struct {
+	Path string // File or directory to upload
+	Name string // Store path name, e.g. "mytool-1.0"
+	// LockFile provides the candidate references: every package in it whose
+	// hash part occurs in the NAR becomes a reference. Optional.
+	LockFile    string
+	Compression string // "xz" (default) or "none"
+	SigningKey  *nix.PrivateKey
+}
+
+// refScanner records which candidate store paths occur in the data written
+// to it, like Nix's reference scanner.
+type refScanner struct {
+	candidates map[string]string // Hash part -> store path
+	found      map[string]bool
+	tail       []byte
+}
+
+func newRefScanner(storePaths []string) *refScanner {
+	s := &refScanner{candidates: make(map[string]string), found: make(map[string]bool)}
+	for _, storePath := range storePaths {
+		if base := path.Base(storePath); len(base) > storePathHashLen {
+			s.candidates[base[:storePathHashLen]] = storePath
+		}
+	}
+	return s
+}
+
+func (s *refScanner) Write(p []byte) (int, error) {
+	// Keep the end of the previous write so hashes spanning writes are found
+	buf := append(s.tail, p...)
+	for i := 0; i+storePathHashLen <= len(buf); i++ {
+		if storePath, ok := s.candidates[string(buf[i:i+storePathHashLen])]; ok {
+			s.found[storePath] = true
+		}
+	}
+	keep := min(storePathHashLen-1, len(buf))
+	s.tail = append([]byte(nil), buf[len(buf)-keep:]...)
+	return len(p), nil
+}
+
+// references returns the store paths found, sorted.
+func (s *refScanner) references() []string {
+	refs := make([]string, 0, len(s.found))
+	for storePath := range s.found {
+		refs = append(refs, storePath)
+	}
+	sort.Strings(refs)
+	return refs
+}
+
+// makeStorePath computes a store path the way Nix does: the first 160 bits
+// of sha256("<type>:sha256:<hex hash>:/nix/store:<name>"), folded with XOR
+// and encoded in nixbase32.
+func makeStorePath(typ string, hash nix.Hash, name string) string {
+	fingerprint := fmt.Sprintf("%s:sha256:%s:%s:%s", typ, hash.RawBase16(), nixStoreDir, name)
+	sum := sha256.Sum256([]byte(fingerprint))
+	var compressed [20]byte
+	for i, b := range sum {
+		compressed[i%len(compressed)] ^= b
+	}
+	return nixStoreDir + "/" + nixbase32.EncodeToString(compressed[:]) + "-" + name
+}
+
+// makeSourceStorePath is the store path of a NAR-hashed (recursive sha256)
+// content-addressed object with the given references, as produced by
+// "nix-store --add" or builtins.path.
+func makeSourceStorePath(narHash nix.Hash, name string, references []string) string {
+	typ := "source"
+	for _, ref := range references {
+		typ += ":" + ref
+	}
+	return makeStorePath(typ, narHash, name)
+}
+
+// Upload packs opts.Path into a NAR, computes its content-addressed store
+// path and pushes the NAR and a (signed) narinfo to f.cacheURL, which may be
+// an http(s):// or file:// URL.
+func (f *Fetcher) Upload(ctx context.Context, opts UploadOptions) (*nix.NARInfo, error) {
+	if opts.Compression == "" {
+		opts.Compression = "xz"
+	}
+
+	var candidates []string
+	if opts.LockFile != "" {
+		lock, err := LoadLockfile(opts.LockFile)
+		if err != nil {
+			return nil, err
+		}
+		for storePath := range lock.Packages {
+			candidates = append(candidates, storePath)
+		}
+	}
+
+	// First pass: NarHash and references, which determine the store path
+	scanner := newRefScanner(candidates)
+	pack, err := packNar(io.Discard, opts.Path, "none", scanner)
+	if err != nil {
+		return nil, err
+	}
+	references := scanner.references()
+	storePath := makeSourceStorePath(pack.NarHash, opts.Name, references)
+	parsed, err := nix.ParseStorePath(storePath)
+	if err != nil {
+		return nil, fmt.Errorf("invalid store path name %q: %w", opts.Name, err)
+	}
+	fmt.Fprintf(f.progress, "Uploading %s as %s (%d references)\n", opts.Path, storePath, len(references))
+
+	// Second pass: compress to a temporary file, checking the tree did not
+	// change and does not refer to its own (new) store path
+	tmp, err := os.CreateTemp("", "nix-bazel-upload-*.nar")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	self := newRefScanner([]string{storePath})
+	compressed, err := packNar(tmp, opts.Path, opts.Compression, self)
+	if err != nil {
+		return nil, err
+	}
+	if !compressed.NarHash.Equal(pack.NarHash) {
+		return nil, fmt.Errorf("%s changed during upload", opts.Path)
+	}
+	if len(self.found) > 0 {
+		return nil, fmt.Errorf("%s refers to its own store path %s; self-references are not supported", opts.Path, storePath)
+	}
+
+	info := &nix.NARInfo{
+		StorePath:   parsed,
+		URL:         "nar/" + compressed.FileHash.RawBase32() + narExtension(opts.Compression),
+		Compression: nix.CompressionType(compressed.Compression),
+		FileHash:    compressed.FileHash,
+		FileSize:    compressed.FileSize,
+		NARHash:     compressed.NarHash,
+		NARSize:     compressed.NarSize,
+		CA:          nix.RecursiveFileContentAddress(compressed.NarHash),
+	}
+	for _, ref := range references {
+		info.References = append(info.References, nix.StorePath(ref))
+	}
+	if opts.SigningKey != nil {
+		sig, err := nix.SignNARInfo(opts.SigningKey, info)
+		if err != nil {
+			return nil, fmt.Errorf("failed to sign narinfo: %w", err)
+		}
+		info.AddSignatures(sig)
+	}
+	narInfo, err := info.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+
+	// The NAR goes first so the narinfo never points at a missing file
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if err := f.putCacheFile(ctx, info.URL, tmp, compressed.FileSize); err != nil {
+		return nil, err
+	}
+	narInfoKey := parsed.Digest() + ".narinfo"
+	if err := f.putCacheFile(ctx, narInfoKey, bytes.NewReader(narInfo), int64(len(narInfo))); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// narExtension is the file extension of a NAR compressed with compression.
+func narExtension(compression string) string {
+	switch compression {
+	case "", "none":
+		return ".nar"
+	default:
+		return ".nar." + compression
+	}
+}
+
+// putCacheFile stores r under key in the binary cache at f.cacheURL.
+func (f *Fetcher) putCacheFile(ctx context.Context, key string, r io.Reader, size int64) error {
+	if dir, ok := strings.CutPrefix(f.cacheURL, "file://"); ok {
+		dest := filepath.Join(dir, filepath.FromSlash(key))
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
+		if err := ensureCacheInfo(dir); err != nil {
+			return err
+		}
+		tmp, err := os.CreateTemp(filepath.Dir(dest), ".upload-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		if _, err := io.Copy(tmp, r); err != nil {
+			tmp.Close()
+			return err
+		}
+		if err := tmp.Close(); err != nil {
+			return err
+		}
+		if err := os.Chmod(tmp.Name(), 0644); err != nil {
+			return err
+		}
+		return os.Rename(tmp.Name(), dest)
+	}
+
+	if !strings.HasPrefix(f.cacheURL, "http://") && !strings.HasPrefix(f.cacheURL, "https://") {
+		return fmt.Errorf("unsupported cache URL %q (expected http(s):// or file://)", f.cacheURL)
+	}
+	url := f.cacheURL + "/" + key
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if strings.HasSuffix(key, ".narinfo") {
+		req.Header.Set("Content-Type", "text/x-nix-narinfo")
+	} else {
+		req.Header.Set("Content-Type", "application/x-nix-nar")
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("failed to upload %s: status %s", url, resp.Status)
+	}
+	return nil
+}
+
+// ensureCacheInfo writes nix-cache-info into a new file:// cache, which Nix
+// requires before using it as a substituter.
+func ensureCacheInfo(dir string) error {
+	infoPath := filepath.Join(dir, "nix-cache-info")
+	if _, err := os.Stat(infoPath); err == nil {
+		return nil
+	}
+	return os.WriteFile(infoPath, []byte("StoreDir: "+nixStoreDir+"\nWantMassQuery: 1\nPriority: 40\n"), 0644)
+}
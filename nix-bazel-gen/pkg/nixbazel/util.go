@@ -1,11 +1,9 @@
 package nixbazel
 
 import (
-	"fmt"
 	"path/filepath"
 	"strings"
-
-	"zombiezen.com/go/nix/nixbase32"
+	"unicode"
 )
 
 func extractHash(s string) string {
@@ -17,16 +15,33 @@ func extractHash(s string) string {
 	return ""
 }
 
-func convertHashToHex(narHash string) string {
-	if strings.HasPrefix(narHash, "sha256:") {
-		hashPart := strings.TrimPrefix(narHash, "sha256:")
-		// Try decoding as nixbase32
-		decoded, err := nixbase32.DecodeString(hashPart)
-		if err == nil {
-			return fmt.Sprintf("%x", decoded)
+// parseStoreName splits a store path like /nix/store/<hash>-openssl-3.0.13-dev
+// into its package name ("openssl") and version ("3.0.13-dev"), following
+// Nix's rule that the version starts at the first dash not followed by a
+// letter.
+func parseStoreName(storePath string) (name, version string) {
+	base := filepath.Base(storePath)
+	if hash := extractHash(base); hash != "" {
+		base = strings.TrimPrefix(base, hash+"-")
+	}
+	for i := 0; i+1 < len(base); i++ {
+		if base[i] == '-' && !unicode.IsLetter(rune(base[i+1])) {
+			return base[:i], base[i+1:]
 		}
-		// If not base32, maybe it's already hex? or base64?
-		// For now assume nixbase32 as that's what Hydra returns.
+	}
+	return base, ""
+}
+
+// packageSystem returns the Nix system named by the last component of a
+// package identifier such as nixpkgs.git.x86_64-linux, or "" if there is none.
+func packageSystem(packageID string) string {
+	if extractHash(packageID) != "" {
+		return ""
+	}
+	parts := strings.Split(packageID, ".")
+	system := parts[len(parts)-1]
+	if cpu, os, ok := strings.Cut(system, "-"); ok && cpu != "" && os != "" && !strings.Contains(os, "-") {
+		return system
 	}
 	return ""
 }
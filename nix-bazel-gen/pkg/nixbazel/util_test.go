@@ -23,20 +23,23 @@ func TestExtractHash(t *testing.T) {
 	}
 }
 
-func TestConvertHashToHex(t *testing.T) {
+func TestParseStoreName(t *testing.T) {
 	tests := []struct {
-		input    string
-		expected string
+		input   string
+		name    string
+		version string
 	}{
-		{"sha256:0gkxy2qfdi81lxzqbsdl2w5mdg0666s24inpa90ilvkb53ssmn3s", "7ad8aaf5286b6e1a4152d74622b43106bc560b17b4e9857fa701c5e6b0f07d3e"},
-		{"sha256:1fd9f9qbrlckn0yapnybfv4y9bwwsvq473ckp71ccvvspr5602fy", "de09604abe7a6fc6c2b9938d43f0d69cafe4c976cbdbab3cb093d1bc7072a9b9"},
-		{"invalid", ""},
+		{"/nix/store/x34bh6s6ighg7lb74nkjbx3nx52zj0j9-git-2.51.2", "git", "2.51.2"},
+		{"/nix/store/01ddsmlfxa22al7yxasdj8rvm72b275m-libheif-1.20.2-lib", "libheif", "1.20.2-lib"},
+		{"xx7cm72qy2c0643cm1ipngd87aqwkcdp-glibc-2.40-66", "glibc", "2.40-66"},
+		{"/nix/store/xx7cm72qy2c0643cm1ipngd87aqwkcdp-source", "source", ""},
+		{"/nix/store/xx7cm72qy2c0643cm1ipngd87aqwkcdp-gcc-wrapper-14.3.0", "gcc-wrapper", "14.3.0"},
 	}
 
 	for _, test := range tests {
-		result := convertHashToHex(test.input)
-		if result != test.expected {
-			t.Errorf("convertHashToHex(%q) = %q, expected %q", test.input, result, test.expected)
+		name, version := parseStoreName(test.input)
+		if name != test.name || version != test.version {
+			t.Errorf("parseStoreName(%q) = %q, %q, expected %q, %q", test.input, name, version, test.name, test.version)
 		}
 	}
 }
@@ -0,0 +1,184 @@
+package nixbazel
+
+import (
+	"container/heap"
+	"fmt"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// maxWhyChains bounds the chains returned by WhyDepends with all set: large
+// closures have far too many to read anyway.
+const maxWhyChains = 1000
+
+// WhyDepends explains why target is in the closure of the repository repo,
+// like nix why-depends. It returns reference chains of store paths from the
+// repository's store path to every closure entry matching target (a store
+// path, a store path basename, or a package name such as "llvm"), shortest
+// first. Without all, only one shortest chain per matching entry is
+// returned.
+func WhyDepends(lock *Lockfile, repo, target string, all bool) ([][]string, error) {
+	repoLock, ok := lock.Repositories[repo]
+	if !ok {
+		return nil, fmt.Errorf("repository %q not found in lockfile", repo)
+	}
+	root := repoLock.StorePath
+
+	var chains [][]string
+	if all {
+		chains = allChains(lock.Packages, root, target)
+	} else {
+		chains = shortestChains(lock.Packages, root, target)
+	}
+	if len(chains) == 0 {
+		return nil, fmt.Errorf("%s is not in the closure of %s", target, repo)
+	}
+	return chains, nil
+}
+
+// matchesStorePath reports whether storePath is the store path, basename or
+// package name target.
+func matchesStorePath(storePath, target string) bool {
+	if strings.HasPrefix(target, "/") {
+		return storePath == target
+	}
+	if extractHash(target) != "" {
+		return path.Base(storePath) == target
+	}
+	name, _ := parseStoreName(storePath)
+	return name == target
+}
+
+// referencePaths returns the store paths node refers to, sorted and without
+// self-references.
+func referencePaths(storePath string, node ClosureNode) []string {
+	refs := make([]string, 0, len(node.References))
+	for _, ref := range node.References {
+		if refPath := nixStoreDir + "/" + ref; refPath != storePath {
+			refs = append(refs, refPath)
+		}
+	}
+	sort.Strings(refs)
+	return refs
+}
+
+// shortestChains walks the closure of root breadth first and returns the
+// first chain found to each path matching target.
+func shortestChains(packages map[string]ClosureNode, root, target string) [][]string {
+	parent := map[string]string{root: ""}
+	queue := []string{root}
+	var chains [][]string
+	for len(queue) > 0 {
+		storePath := queue[0]
+		queue = queue[1:]
+		if matchesStorePath(storePath, target) {
+			var chain []string
+			for p := storePath; p != ""; p = parent[p] {
+				chain = append([]string{p}, chain...)
+			}
+			chains = append(chains, chain)
+		}
+		for _, ref := range referencePaths(storePath, packages[storePath]) {
+			if _, seen := parent[ref]; !seen {
+				parent[ref] = storePath
+				queue = append(queue, ref)
+			}
+		}
+	}
+	return chains
+}
+
+// allChains returns the chains from root to paths matching target, shortest
+// first, up to maxWhyChains. It is a best-first search over chain prefixes,
+// ordered by the length of the shortest chain each can be completed to, so
+// only prefixes that lead to target are extended and a truncated result
+// still holds the shortest chains.
+func allChains(packages map[string]ClosureNode, root, target string) [][]string {
+	dist := distancesTo(packages, root, target)
+	if _, ok := dist[root]; !ok {
+		return nil
+	}
+
+	var chains [][]string
+	queue := &chainQueue{{chain: []string{root}, length: 1 + dist[root]}}
+	for queue.Len() > 0 && len(chains) < maxWhyChains {
+		item := heap.Pop(queue).(chainItem)
+		last := item.chain[len(item.chain)-1]
+		if matchesStorePath(last, target) {
+			chains = append(chains, item.chain)
+		}
+		for _, ref := range referencePaths(last, packages[last]) {
+			d, ok := dist[ref]
+			if !ok {
+				continue
+			}
+			// References are acyclic apart from self-references, so chains
+			// never revisit a path
+			chain := append(append(make([]string, 0, len(item.chain)+1), item.chain...), ref)
+			heap.Push(queue, chainItem{chain: chain, length: len(chain) + d})
+		}
+	}
+	return chains
+}
+
+// distancesTo returns, for every path in the closure of root that leads to
+// a path matching target, the number of references to the nearest one.
+func distancesTo(packages map[string]ClosureNode, root, target string) map[string]int {
+	closure := append([]string{root}, getTransitiveClosure(root, packages)...)
+	referrers := make(map[string][]string)
+	dist := make(map[string]int)
+	var queue []string
+	for _, storePath := range closure {
+		for _, ref := range referencePaths(storePath, packages[storePath]) {
+			referrers[ref] = append(referrers[ref], storePath)
+		}
+		if matchesStorePath(storePath, target) {
+			dist[storePath] = 0
+			queue = append(queue, storePath)
+		}
+	}
+	for len(queue) > 0 {
+		storePath := queue[0]
+		queue = queue[1:]
+		for _, referrer := range referrers[storePath] {
+			if _, seen := dist[referrer]; !seen {
+				dist[referrer] = dist[storePath] + 1
+				queue = append(queue, referrer)
+			}
+		}
+	}
+	return dist
+}
+
+// chainItem is a chain prefix and the length of the shortest chain to a
+// target it can be completed to.
+type chainItem struct {
+	chain  []string
+	length int
+}
+
+// chainQueue is a heap of chain prefixes, shortest completion first and
+// then in store path order, for a stable result.
+type chainQueue []chainItem
+
+func (q chainQueue) Len() int { return len(q) }
+
+func (q chainQueue) Less(i, j int) bool {
+	if q[i].length != q[j].length {
+		return q[i].length < q[j].length
+	}
+	return slices.Compare(q[i].chain, q[j].chain) < 0
+}
+
+func (q chainQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *chainQueue) Push(x any) { *q = append(*q, x.(chainItem)) }
+
+func (q *chainQueue) Pop() any {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
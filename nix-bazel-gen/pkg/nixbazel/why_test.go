@@ -0,0 +1,134 @@
+package nixbazel
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testGraphPath returns a store path whose hash is c repeated.
+func testGraphPath(c, name string) string {
+	return nixStoreDir + "/" + strings.Repeat(c, 32) + "-" + name
+}
+
+var (
+	testMagickPath = testGraphPath("a", "imagemagick-7.1.1")
+	testRsvgPath   = testGraphPath("b", "librsvg-2.58.0")
+	testPangoPath  = testGraphPath("c", "pango-1.52.2")
+	testLLVMPath   = testGraphPath("d", "llvm-18.1.8")
+	testLibcPath   = testGraphPath("f", "glibc-2.40-66")
+	testZlibPath   = testGraphPath("g", "zlib-1.3.1")
+)
+
+// testGraphLockfile returns a lockfile with a small diamond-shaped closure
+// for imagemagick and a separate one for zlib.
+func testGraphLockfile() *Lockfile {
+	node := func(narSize int64, refs ...string) ClosureNode {
+		n := ClosureNode{NarHash: testHelloHash, NarSize: narSize, FileSize: narSize / 2, References: []string{}}
+		for _, ref := range refs {
+			n.References = append(n.References, path.Base(ref))
+		}
+		return n
+	}
+	return &Lockfile{
+		Repositories: map[string]RepositoryLock{
+			"imagemagick": {StorePath: testMagickPath},
+			"zlib":        {StorePath: testZlibPath},
+		},
+		Packages: map[string]ClosureNode{
+			testMagickPath: node(100, testRsvgPath, testLibcPath),
+			testRsvgPath:   node(200, testLLVMPath, testPangoPath),
+			testPangoPath:  node(300, testLLVMPath, testLibcPath),
+			testLLVMPath:   node(3000, testLibcPath),
+			testLibcPath:   node(400, testLibcPath),
+			testZlibPath:   node(10, testLibcPath),
+		},
+	}
+}
+
+func TestWhyDepends(t *testing.T) {
+	lock := testGraphLockfile()
+	tests := []struct {
+		target   string
+		all      bool
+		expected [][]string
+	}{
+		{"llvm", false, [][]string{{testMagickPath, testRsvgPath, testLLVMPath}}},
+		{testLLVMPath, true, [][]string{
+			{testMagickPath, testRsvgPath, testLLVMPath},
+			{testMagickPath, testRsvgPath, testPangoPath, testLLVMPath},
+		}},
+		{path.Base(testLibcPath), false, [][]string{{testMagickPath, testLibcPath}}},
+		{"imagemagick", false, [][]string{{testMagickPath}}},
+	}
+	for _, test := range tests {
+		chains, err := WhyDepends(lock, "imagemagick", test.target, test.all)
+		if err != nil {
+			t.Errorf("WhyDepends(%q, %v) failed: %v", test.target, test.all, err)
+			continue
+		}
+		if !reflect.DeepEqual(chains, test.expected) {
+			t.Errorf("WhyDepends(%q, %v) = %q, expected %q", test.target, test.all, chains, test.expected)
+		}
+	}
+
+	for _, args := range [][2]string{{"imagemagick", "zlib"}, {"missing", "llvm"}, {"zlib", "llvm"}} {
+		if _, err := WhyDepends(lock, args[0], args[1], false); err == nil {
+			t.Errorf("WhyDepends(%q, %q) succeeded, expected an error", args[0], args[1])
+		}
+	}
+}
+
+// A ladder of 40 layers has 2^40 chains to its bottom, which must not be
+// enumerated one by one.
+func TestWhyDependsAllLarge(t *testing.T) {
+	const layers = 40
+	name := func(layer, i int) string {
+		return nixStoreDir + "/" + fmt.Sprintf("%032d", layer*2+i) + fmt.Sprintf("-node%d-%d", layer, i)
+	}
+	target := nixStoreDir + "/" + strings.Repeat("z", 32) + "-llvm-18.1.8"
+	root := nixStoreDir + "/" + strings.Repeat("a", 32) + "-root"
+	lock := &Lockfile{
+		Repositories: map[string]RepositoryLock{"root": {StorePath: root}},
+		Packages: map[string]ClosureNode{
+			root:   {References: []string{path.Base(name(0, 0)), path.Base(name(0, 1)), path.Base(target)}},
+			target: {References: []string{}},
+		},
+	}
+	for layer := 0; layer < layers; layer++ {
+		for i := 0; i < 2; i++ {
+			next := []string{path.Base(target)}
+			if layer+1 < layers {
+				next = []string{path.Base(name(layer+1, 0)), path.Base(name(layer+1, 1))}
+			}
+			lock.Packages[name(layer, i)] = ClosureNode{References: next}
+		}
+	}
+
+	start := time.Now()
+	chains, err := WhyDepends(lock, "root", "llvm", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("WhyDepends(--all) took %v", elapsed)
+	}
+	if len(chains) != maxWhyChains {
+		t.Fatalf("WhyDepends(--all) returned %d chains, expected %d", len(chains), maxWhyChains)
+	}
+	if expected := []string{root, target}; !reflect.DeepEqual(chains[0], expected) {
+		t.Errorf("first chain = %q, expected %q", chains[0], expected)
+	}
+	for i := 1; i < len(chains); i++ {
+		if len(chains[i]) < len(chains[i-1]) {
+			t.Fatalf("chain %d is shorter than chain %d", i, i-1)
+		}
+	}
+	// Every chain through the ladder has the same length
+	if got := len(chains[1]); got != layers+2 {
+		t.Errorf("second chain has %d paths, expected %d", got, layers+2)
+	}
+}
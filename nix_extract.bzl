@@ -0,0 +1,60 @@
+def _nix_extract_impl(ctx):
+    # Outputs that are copies of files extracted by another package,
+    # e.g. lib/libz.so in zlib-dev pointing into zlib.
+    link_srcs = {}
+    for src in ctx.attr.link_srcs:
+        key = "//%s:%s" % (src.label.package, src.label.name)
+        link_srcs[key] = src.files.to_list()[0]
+
+    args = ctx.actions.args()
+    extracted = []
+    out_dir = None
+    pkg_prefix = ctx.label.package + "/"
+    for out in ctx.outputs.outs:
+        # Path relative to the package, e.g. include/zlib.h
+        name = out.short_path[out.short_path.find(pkg_prefix) + len(pkg_prefix):]
+        if name in ctx.attr.links:
+            ctx.actions.symlink(
+                output = out,
+                target_file = link_srcs[ctx.attr.links[name]],
+            )
+            continue
+        extracted.append(out)
+        args.add("--extract", name)
+        # All outputs live under the package directory
+        out_dir = out.path[:-len(name) - 1]
+
+    if extracted:
+        args.add("--archive", ctx.file.nar_file)
+        args.add("--store-path", "/nix/store/" + ctx.attr.store_name)
+        args.add("--out", out_dir)
+
+        # No PATH is needed: the tool decompresses xz itself
+        ctx.actions.run(
+            outputs = extracted,
+            inputs = [ctx.file.nar_file],
+            executable = ctx.executable.fetch_tool,
+            arguments = [args],
+            mnemonic = "NixExtract",
+            progress_message = "Extracting files from %s" % ctx.attr.store_name,
+        )
+
+    return [DefaultInfo(files = depset(ctx.outputs.outs))]
+
+nix_extract = rule(
+    implementation = _nix_extract_impl,
+    attrs = {
+        "nar_file": attr.label(allow_single_file = True, mandatory = True),
+        "store_name": attr.string(mandatory = True),
+        "outs": attr.output_list(),
+        # Output name -> label of the file it copies
+        "links": attr.string_dict(),
+        "link_srcs": attr.label_list(allow_files = True),
+        "fetch_tool": attr.label(
+            default = Label("//:nix-bazel-fetch"),
+            executable = True,
+            cfg = "exec",
+            allow_files = True,
+        ),
+    },
+)
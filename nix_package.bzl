@@ -1,3 +1,9 @@
+def _manifest_path(lockfile):
+    """Returns the manifest sidecar of a lockfile, like ManifestPath in Go."""
+    if lockfile.endswith(".lock.json"):
+        return lockfile.removesuffix(".lock.json") + ".manifest.json"
+    return lockfile.removesuffix(".json") + ".manifest.json"
+
 def _nix_package_impl(repository_ctx):
     # Tools
     resolve_tool = repository_ctx.path(Label("//:nix-bazel-resolve"))
@@ -14,18 +20,42 @@ def _nix_package_impl(repository_ctx):
         lockfile_content = repository_ctx.read(lockfile_path)
         lock = json.decode(lockfile_content)
 
+        # Optional manifest sidecar (see `nix-bazel-resolve --manifests`).
+        # Reading it makes Bazel refetch when it changes.
+        manifest_path = repository_ctx.path(_manifest_path(str(lockfile_path)))
+        if manifest_path.exists:
+            repository_ctx.read(manifest_path)
+
         # 2. Collect all unique store paths (already flat)
         unique_paths = lock.get("packages", {})
 
         # 3. Download and unpack each store path
         for store_path, node in unique_paths.items():
-            # Download
+            if node.get("localOnly"):
+                fail("%s is only in the local Nix store (see nix-bazel-resolve --local-db); push it to a binary cache first" % store_path)
+
+            # Download. URLs from substituters other than cache.nixos.org are absolute.
+            url = node["url"]
+            if "://" not in url:
+                url = "https://cache.nixos.org/" + url
+            # fileIntegrity (SRI) is only written for non-sha256 file hashes.
+            # nix-bazel loads only lockfiles with hex hashes, but this rule
+            # reads the file itself, so check before handing it to Bazel.
+            if not node.get("fileIntegrity") and (len(node["fileHash"]) != 64 or node["fileHash"].lower() != node["fileHash"]):
+                fail("%s: fileHash %r is not a lowercase hex sha256 and there is no fileIntegrity; re-run nix-bazel-resolve" % (store_path, node["fileHash"]))
             download_path = repository_ctx.path("downloads/" + node["fileHash"])
-            repository_ctx.download(
-                url = "https://cache.nixos.org/" + node["url"],
-                output = download_path,
-                sha256 = node["fileHash"],
-            )
+            if node.get("fileIntegrity"):
+                repository_ctx.download(
+                    url = url,
+                    output = download_path,
+                    integrity = node["fileIntegrity"],
+                )
+            else:
+                repository_ctx.download(
+                    url = url,
+                    output = download_path,
+                    sha256 = node["fileHash"],
+                )
 
             # Unpacking is now done by nix_unpack rule at build time
             pass
@@ -43,8 +73,10 @@ def _nix_package_impl(repository_ctx):
             if result.return_code != 0:
                 fail("Failed to generate BUILD files: \n%s\n%s" % (result.stdout, result.stderr))
 
-        # Copy nix_bwrap.bzl, nix_unpack.bzl, nix_providers.bzl
+        # Copy nix_bwrap.bzl, nix_unpack.bzl, nix_providers.bzl, nix_extract.bzl, nix_toolchain.bzl
         repository_ctx.symlink(Label("//:nix_bwrap.bzl"), "nix_bwrap.bzl")
+        repository_ctx.symlink(Label("//:nix_extract.bzl"), "nix_extract.bzl")
+        repository_ctx.symlink(Label("//:nix_toolchain.bzl"), "nix_toolchain.bzl")
         repository_ctx.symlink(Label("//:nix_unpack.bzl"), "nix_unpack.bzl")
         repository_ctx.symlink(Label("//:nix_providers.bzl"), "nix_providers.bzl")
         repository_ctx.symlink(Label("//:nix_root.bzl"), "nix_root.bzl")
@@ -85,6 +117,8 @@ def _nix_extension_impl(module_ctx):
             packages[pkg.name] = {
                 "package": pkg.package,
                 "entrypoint": pkg.entrypoint,
+                "toolchain": pkg.toolchain,
+                "files": pkg.files,
             }
 
     # Serialize packages to JSON
@@ -112,6 +146,13 @@ nix_extension = module_extension(
                 "name": attr.string(mandatory = True),
                 "package": attr.string(mandatory = True),
                 "entrypoint": attr.string(mandatory = False),
+                # Register the package as a toolchain of this kind
+                "toolchain": attr.string(
+                    mandatory = False,
+                    values = ["", "cc", "python", "go", "nodejs"],
+                ),
+                # Paths inside the package exported as @nix_deps//:<name>/<path>
+                "files": attr.string_list(mandatory = False),
             },
         ),
     },
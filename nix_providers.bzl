@@ -3,5 +3,7 @@ NixStorePathInfo = provider(
     fields = {
         "nar_file": "The NAR archive file",
         "store_path": "The original /nix/store path (string)",
+        "references": "Direct references of the store path, as store names (list of strings)",
+        "nar_hash": "NarHash of the store path in hex, or empty if unknown (string)",
     },
 )
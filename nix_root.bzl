@@ -3,79 +3,55 @@ load(":nix_providers.bzl", "NixStorePathInfo")
 def _nix_root_impl(ctx):
     # We create a single output directory containing all unpacked packages
     out_dir = ctx.actions.declare_directory(ctx.label.name)
-    
-    fetch_tool = ctx.executable.fetch_tool
-    
-    inputs = [fetch_tool]
-    args = []
-    
-    # Script to unpack and rewrite
-    # We generate a script that calls fetch_tool for each NAR
-    # and then rewrites symlinks.
-    
-    script_lines = [
-        "set -e",
-        "OUT_DIR=$1",
-        "FETCH_TOOL=$2",
-        "mkdir -p \"$OUT_DIR\"",
-    ]
-    
-    for dep in ctx.attr.deps:
-        if NixStorePathInfo in dep:
-            info = dep[NixStorePathInfo]
-            inputs.append(info.nar_file)
-            
-            store_name = info.store_path.split("/")[-1]
-            
-            script_lines.append(
-                "\"$FETCH_TOOL\" --archive \"%s\" --out \"$OUT_DIR\" --store-path \"%s\"" % (info.nar_file.path, info.store_path)
-            )
-            
-    # Symlink rewriting logic
-    # Convert absolute /nix/store/... symlinks to relative ../...
-    script_lines.append("""
-    find "$OUT_DIR" -type l -print0 | while IFS= read -r -d '' LINK; do
-      TARGET=$(readlink "$LINK")
-      if [[ "$TARGET" == /nix/store/* ]]; then
-        # Absolute symlink to store
-        # Convert to relative using pure bash string manipulation to avoid realpath issues
-        
-        # 1. Get directory of the link relative to OUT_DIR
-        # LINK is $OUT_DIR/path/to/link
-        REL_LINK=${LINK#$OUT_DIR/}
-        REL_LINK_DIR=$(dirname "$REL_LINK")
-        
-        # 2. Construct traversal up to root
-        DOTS=""
-        if [ "$REL_LINK_DIR" != "." ]; then
-            # Replace each component with ..
-            # Use sed with escaped backslash for Starlark
-            DOTS=$(echo "$REL_LINK_DIR" | sed 's|[^/][^/]*|..|g')
-            DOTS="$DOTS/"
-        fi
-        
-        # 3. Construct new target
-        # Target relative to OUT_DIR (stripping /nix/store prefix)
-        REL_TARGET=${TARGET#/nix/store/}
-        NEW_TARGET="${DOTS}${REL_TARGET}"
-        
-        rm "$LINK"
-        ln -s "$NEW_TARGET" "$LINK"
-      fi
-    done
-    """)
 
-    
-    ctx.actions.run_shell(
+    infos = [dep[NixStorePathInfo] for dep in ctx.attr.deps if NixStorePathInfo in dep]
+
+    # nix-bazel-fetch unpacks every NAR in parallel and makes /nix/store
+    # symlinks relative to the root, so this is a single action. Each entry
+    # carries the references of its package, so relocation adds only that
+    # package's closure to its RUNPATHs.
+    manifest = ctx.actions.declare_file(ctx.label.name + ".unpack.json")
+    ctx.actions.write(manifest, json.encode([
+        {
+            "archive": info.nar_file.path,
+            "storePath": info.store_path,
+            "references": getattr(info, "references", None) or [],
+            "narHash": getattr(info, "nar_hash", None) or "",
+        }
+        for info in infos
+    ]))
+
+    args = ctx.actions.args()
+    args.add("--out", out_dir.path)
+    args.add("--relative-symlinks")
+    args.add("--unpack-manifest", manifest)
+
+    if ctx.attr.canonical:
+        args.add("--canonical")
+
+    # Implies canonical, as only read-only files are linked
+    if ctx.attr.dedup:
+        args.add("--dedup")
+
+    if ctx.attr.relocate:
+        args.add("--relocate")
+
+    # The action is cached under its inputs, which do not include the local
+    # store, so copies must match the NarHash a NAR would unpack to. Paths
+    # without one are always unpacked.
+    if ctx.attr.local_store:
+        args.add("--local-store")
+        args.add("--verify-local")
+
+    ctx.actions.run(
         outputs = [out_dir],
-        inputs = inputs,
-        command = "\n".join(script_lines),
-        arguments = [out_dir.path, fetch_tool.path],
+        inputs = [manifest] + [info.nar_file for info in infos],
+        executable = ctx.executable.fetch_tool,
+        arguments = [args],
         mnemonic = "NixRootUnpack",
         progress_message = "Unpacking Nix Root %s" % ctx.label.name,
-        use_default_shell_env = True,
     )
-            
+
     return [
         DefaultInfo(
             files = depset([out_dir]),
@@ -93,5 +69,62 @@ nix_root = rule(
             cfg = "exec",
             allow_files = True,
         ),
+        # Rewrite ELF interpreters and RUNPATHs to point into the root, so
+        # binaries run without bwrap. RUNPATHs are $ORIGIN-relative, but the
+        # kernel does not expand $ORIGIN in PT_INTERP, so the interpreter is
+        # execroot-relative: relocated binaries only work from the execroot
+        # (build actions), not from runfiles under bazel run or bazel test.
+        "relocate": attr.bool(default = False),
+        # Normalise modes and mtimes like the Nix store so the tree artifact is
+        # identical on every machine, which remote caching relies on.
+        "canonical": attr.bool(default = False),
+        # Hardlink identical files across the packages of the root, like
+        # nix-store --optimise. Implies canonical.
+        "dedup": attr.bool(default = False),
+        # Copy store paths from /nix/store when the machine running the action
+        # has them with the locked NarHash, instead of unpacking their NAR.
+        # The NARs are still downloaded by nix_package.
+        "local_store": attr.bool(default = False),
+    },
+)
+
+def _nix_root_subdir_impl(ctx):
+    root_dir = ctx.attr.root[DefaultInfo].files.to_list()[0]
+    out_dir = ctx.actions.declare_directory(ctx.label.name)
+
+    # Symlinks in the root are relative to the root, so nix-bazel-fetch
+    # dereferences them while copying. A missing directory yields an empty
+    # tree.
+    args = ctx.actions.args()
+    args.add("--copy", root_dir.path + "/" + ctx.attr.path)
+    args.add("--out", out_dir.path)
+    ctx.actions.run(
+        outputs = [out_dir],
+        inputs = [root_dir],
+        executable = ctx.executable.fetch_tool,
+        arguments = [args],
+        mnemonic = "NixRootSubdir",
+        progress_message = "Copying %s from Nix root" % ctx.attr.path,
+    )
+
+    return [
+        DefaultInfo(
+            files = depset([out_dir]),
+            runfiles = ctx.runfiles(files = [out_dir]),
+        )
+    ]
+
+nix_root_subdir = rule(
+    implementation = _nix_root_subdir_impl,
+    attrs = {
+        "root": attr.label(mandatory = True),
+        # Path inside the root, e.g. <store name>/lib
+        "path": attr.string(mandatory = True),
+        "fetch_tool": attr.label(
+            default = Label("//:nix-bazel-fetch"),
+            executable = True,
+            cfg = "exec",
+            allow_files = True,
+        ),
     },
 )
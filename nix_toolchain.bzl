@@ -0,0 +1,126 @@
+load("@bazel_tools//tools/build_defs/cc:action_names.bzl", "ACTION_NAMES")
+load("@bazel_tools//tools/cpp:cc_toolchain_config_lib.bzl", "env_entry", "env_set", "feature", "flag_group", "flag_set", "tool_path")
+
+_LINK_ACTIONS = [
+    ACTION_NAMES.cpp_link_executable,
+    ACTION_NAMES.cpp_link_dynamic_library,
+    ACTION_NAMES.cpp_link_nodeps_dynamic_library,
+]
+
+# Every action running one of the tool wrappers
+_TOOL_ACTIONS = _LINK_ACTIONS + [
+    ACTION_NAMES.assemble,
+    ACTION_NAMES.preprocess_assemble,
+    ACTION_NAMES.c_compile,
+    ACTION_NAMES.cpp_compile,
+    ACTION_NAMES.cpp_header_parsing,
+    ACTION_NAMES.cpp_module_compile,
+    ACTION_NAMES.cpp_module_codegen,
+    ACTION_NAMES.linkstamp_compile,
+    ACTION_NAMES.cpp_link_static_library,
+    ACTION_NAMES.strip,
+]
+
+def _nix_cc_toolchain_config_impl(ctx):
+    # The wrappers mount the root at /nix/store. Its path is only known
+    # here, so pass it on instead of searching bazel-out for it.
+    root = ctx.attr.root[DefaultInfo].files.to_list()[0]
+    features = [feature(
+        name = "nix_root_env",
+        enabled = True,
+        env_sets = [env_set(
+            actions = _TOOL_ACTIONS,
+            env_entries = [env_entry(key = "NIX_ROOT", value = root.path)],
+        )],
+    )]
+    if ctx.attr.link_flags:
+        features.append(feature(
+            name = "default_linker_flags",
+            enabled = True,
+            flag_sets = [flag_set(
+                actions = _LINK_ACTIONS,
+                flag_groups = [flag_group(flags = ctx.attr.link_flags)],
+            )],
+        ))
+
+    return cc_common.create_cc_toolchain_config_info(
+        ctx = ctx,
+        features = features,
+        # The compiler runs inside bwrap, so its builtin headers live here
+        cxx_builtin_include_directories = ["/nix/store"],
+        toolchain_identifier = ctx.attr.toolchain_identifier,
+        host_system_name = "local",
+        target_system_name = "local",
+        target_cpu = ctx.attr.cpu,
+        target_libc = "glibc",
+        compiler = ctx.attr.compiler,
+        abi_version = "unknown",
+        abi_libc_version = "unknown",
+        tool_paths = [
+            tool_path(name = name, path = path)
+            for name, path in ctx.attr.tool_paths.items()
+        ],
+    )
+
+nix_cc_toolchain_config = rule(
+    implementation = _nix_cc_toolchain_config_impl,
+    attrs = {
+        "compiler": attr.string(default = "gcc"),
+        "cpu": attr.string(default = "k8"),
+        "link_flags": attr.string_list(),
+        # nix_root of the compiler, also part of the cc_toolchain's files
+        "root": attr.label(mandatory = True),
+        # Tool name -> wrapper script, relative to the toolchain package
+        "tool_paths": attr.string_dict(mandatory = True),
+        "toolchain_identifier": attr.string(mandatory = True),
+    },
+    provides = [CcToolchainConfigInfo],
+)
+
+def _nix_tool_toolchain_impl(ctx):
+    root_files = ctx.attr.root[DefaultInfo].files
+    return [platform_common.ToolchainInfo(
+        tool = ctx.executable.tool,
+        files = depset(transitive = [root_files, ctx.attr.tool[DefaultInfo].files]),
+        runfiles = ctx.attr.tool[DefaultInfo].default_runfiles,
+    )]
+
+# A generic toolchain exposing a single Nix binary (e.g. go or node) together
+# with the nix_root tree it needs at runtime.
+nix_tool_toolchain = rule(
+    implementation = _nix_tool_toolchain_impl,
+    attrs = {
+        "tool": attr.label(mandatory = True, executable = True, cfg = "exec"),
+        "root": attr.label(mandatory = True),
+    },
+)
+
+def _resolved_tool(ctx, toolchain_type):
+    toolchain = ctx.toolchains[toolchain_type]
+    executable = ctx.actions.declare_file(ctx.label.name)
+    ctx.actions.symlink(output = executable, target_file = toolchain.tool, is_executable = True)
+    runfiles = ctx.runfiles(transitive_files = toolchain.files).merge(toolchain.runfiles)
+    return [DefaultInfo(executable = executable, runfiles = runfiles)]
+
+_GO_TOOLCHAIN_TYPE = Label("//toolchains:go_toolchain_type")
+_NODEJS_TOOLCHAIN_TYPE = Label("//toolchains:nodejs_toolchain_type")
+
+def _nix_go_impl(ctx):
+    return _resolved_tool(ctx, _GO_TOOLCHAIN_TYPE)
+
+def _nix_nodejs_impl(ctx):
+    return _resolved_tool(ctx, _NODEJS_TOOLCHAIN_TYPE)
+
+# The binary of the go or nodejs toolchain resolved for the current platform,
+# runnable with bazel run or usable as a genrule tool.
+nix_go = rule(
+    implementation = _nix_go_impl,
+    executable = True,
+    toolchains = [_GO_TOOLCHAIN_TYPE],
+)
+
+nix_nodejs = rule(
+    implementation = _nix_nodejs_impl,
+    executable = True,
+    toolchains = [_NODEJS_TOOLCHAIN_TYPE],
+)
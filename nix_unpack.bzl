@@ -13,6 +13,8 @@ def _nix_unpack_impl(ctx):
         NixStorePathInfo(
             nar_file = nar_file,
             store_path = "/nix/store/" + ctx.attr.store_name,
+            references = ctx.attr.references,
+            nar_hash = ctx.attr.nar_hash,
         )
     ]
 
@@ -21,6 +23,12 @@ nix_unpack = rule(
     attrs = {
         "nar_file": attr.label(allow_single_file = True, mandatory = True),
         "store_name": attr.string(mandatory = True),
+        # Direct references of the store path (store names), used by
+        # nix_root to relocate each package against its own closure
+        "references": attr.string_list(),
+        # NarHash (hex) from the lockfile, which nix_root checks copies from
+        # the local Nix store against
+        "nar_hash": attr.string(),
         # fetch_tool is no longer needed here, but we keep it optional to avoid breaking existing calls if any
         "fetch_tool": attr.label(
             default = Label("//:nix-bazel-fetch"),